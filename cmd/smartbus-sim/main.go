@@ -0,0 +1,73 @@
+// smartbus-sim emulates a Smart-Bus segment with ZoneBeast, HMix12,
+// DDP and 8-in-1 sensor devices on it. The driver can connect to it
+// via TCP (host:6000) or UDP ("udp" transport address).
+package main
+
+import (
+	"flag"
+	"github.com/contactless/wb-mqtt-smartbus/smartbus"
+	"github.com/contactless/wbgo"
+	"net"
+	"os"
+	"time"
+)
+
+func serveTCP(bus *smartbus.SimulatedBus, address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		wbgo.Error.Printf("failed to listen on %s: %s", address, err)
+		os.Exit(1)
+	}
+	wbgo.Info.Printf("listening on %s", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			wbgo.Error.Printf("accept failed: %s", err)
+			os.Exit(1)
+		}
+		wbgo.Info.Printf("client connected: %s", conn.RemoteAddr())
+		bus.Attach(smartbus.NewStreamIO(conn, nil))
+	}
+}
+
+func main() {
+	configPath := flag.String("config", "", "simulator config file path (required)")
+	tcpAddress := flag.String("tcp", ":6000", "TCP address to listen on, empty to disable TCP")
+	udp := flag.Bool("udp", false, "use SMARTCLOUD UDP packets on port 6000")
+	debug := flag.Bool("debug", false, "Enable debugging")
+	flag.Parse()
+	if *debug {
+		wbgo.SetDebuggingEnabled(true)
+	}
+	if *configPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := smartbus.LoadSimulatorConfig(*configPath)
+	if err != nil {
+		wbgo.Error.Printf("failed to load config: %s", err)
+		os.Exit(1)
+	}
+	bus := smartbus.NewConfiguredSimulatedBus(config)
+	defer bus.Close()
+
+	if *udp {
+		dgramIO, err := smartbus.NewDatagramIO(nil)
+		if err != nil {
+			wbgo.Error.Printf("failed to open UDP port: %s", err)
+			os.Exit(1)
+		}
+		bus.Attach(dgramIO)
+	}
+	if *tcpAddress != "" {
+		go serveTCP(bus, *tcpAddress)
+	}
+
+	if config.StatusInterval > 0 {
+		for _ = range time.Tick(time.Duration(config.StatusInterval) * time.Millisecond) {
+			bus.BroadcastStatus()
+		}
+	}
+	select {}
+}
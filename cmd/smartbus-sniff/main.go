@@ -0,0 +1,57 @@
+// smartbus-sniff shows the Smart-Bus traffic without
+// sending anything to the bus
+package main
+
+import (
+	"flag"
+	"github.com/contactless/wb-mqtt-smartbus/smartbus"
+	"github.com/contactless/wbgo"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	serial := flag.String("serial", smartbus.DEFAULT_SERIAL_ADDRESS, "serial port address (/dev/..., host:port or udp)")
+	baudRate := flag.Int("baud", smartbus.DEFAULT_SERIAL_BAUD_RATE, "serial port baud rate")
+	sources := flag.String("from", "", "source addresses to show, comma-separated (subnet, subnet:device or subnet:from-to)")
+	targets := flag.String("to", "", "target addresses to show, comma-separated (subnet, subnet:device or subnet:from-to)")
+	deviceTypes := flag.String("type", "", "source device types to show, comma-separated (e.g. 0x139c)")
+	opcodes := flag.String("opcode", "", "opcodes to show, comma-separated (e.g. 0x0031 or SingleChannelControlCommand)")
+	format := flag.String("format", smartbus.SNIFF_FORMAT_TEXT, "output format: text, hex (capture file format) or json")
+	debug := flag.Bool("debug", false, "Enable debugging")
+	flag.Parse()
+	if *debug {
+		wbgo.SetDebuggingEnabled(true)
+	}
+
+	filter, err := smartbus.ParseSnifferFilter(*sources, *targets, *deviceTypes, *opcodes)
+	if err != nil {
+		wbgo.Error.Printf("%s", err)
+		os.Exit(2)
+	}
+	sniffer, err := smartbus.NewSniffer(os.Stdout, *format, filter)
+	if err != nil {
+		wbgo.Error.Printf("%s", err)
+		os.Exit(2)
+	}
+
+	transport := smartbus.NewBusConfig().Transport
+	transport.Address = *serial
+	transport.Serial.BaudRate = *baudRate
+	frames, stop, err := smartbus.ListenRaw(&transport)
+	if err != nil {
+		wbgo.Error.Printf("failed to open %s: %s", *serial, err)
+		os.Exit(1)
+	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		<-ch
+		stop()
+	}()
+	if err := sniffer.Run(frames); err != nil {
+		wbgo.Error.Printf("%s", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,322 @@
+package smartbus
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/contactless/wbgo"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CAPTURE_DIRECTION_IN  = "in"
+	CAPTURE_DIRECTION_OUT = "out"
+	CAPTURE_HEADER        = "# Smart-Bus capture"
+	REPLAY_PREFIX         = "replay:"
+	// the playback starts after a delay so that the
+	// driver is ready to handle the messages
+	REPLAY_START_DELAY = 1 * time.Second
+)
+
+// CapturedFrame is a raw Smart-Bus frame (without the sync bytes)
+// together with the time it was seen and its direction
+type CapturedFrame struct {
+	Time      time.Time
+	Direction string
+	Frame     []byte
+}
+
+// FrameRecorder receives the frames captured by RecordingIO
+type FrameRecorder interface {
+	RecordFrame(frame *CapturedFrame) error
+	Close() error
+}
+
+// TextCaptureWriter writes the frames in the text capture format,
+// one frame per line:
+// <RFC3339 timestamp> <in|out> <frame bytes in hex>
+// Empty lines and lines starting with '#' are ignored.
+type TextCaptureWriter struct {
+	writer io.WriteCloser
+}
+
+func NewTextCaptureWriter(writer io.WriteCloser) *TextCaptureWriter {
+	return &TextCaptureWriter{writer}
+}
+
+func (captureWriter *TextCaptureWriter) RecordFrame(frame *CapturedFrame) error {
+	_, err := fmt.Fprintln(captureWriter.writer, formatCapturedFrame(frame))
+	return err
+}
+
+// formatCapturedFrame returns the text capture line for the frame
+func formatCapturedFrame(frame *CapturedFrame) string {
+	return fmt.Sprintf("%s %s %s",
+		frame.Time.UTC().Format(time.RFC3339Nano), frame.Direction, formatHexBytes(frame.Frame))
+}
+
+func (captureWriter *TextCaptureWriter) Close() error {
+	return captureWriter.writer.Close()
+}
+
+// CreateCaptureFile opens the capture file for appending,
+// creating it if necessary
+func CreateCaptureFile(path string) (*TextCaptureWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintln(f, CAPTURE_HEADER); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return NewTextCaptureWriter(f), nil
+}
+
+// ReadCapture reads the frames in the text capture format
+func ReadCapture(reader io.Reader) ([]*CapturedFrame, error) {
+	frames := make([]*CapturedFrame, 0, 128)
+	scanner := bufio.NewScanner(reader)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("line %d: bad captured frame", lineNo)
+		}
+		t, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad timestamp: %s", lineNo, err)
+		}
+		if parts[1] != CAPTURE_DIRECTION_IN && parts[1] != CAPTURE_DIRECTION_OUT {
+			return nil, fmt.Errorf("line %d: bad direction %q", lineNo, parts[1])
+		}
+		frame, err := parseHexBytes(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		if len(frame) < MIN_FRAME_SIZE || int(frame[0]) != len(frame) {
+			return nil, fmt.Errorf("line %d: bad frame length", lineNo)
+		}
+		frames = append(frames, &CapturedFrame{t, parts[1], frame})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return frames, nil
+}
+
+func ReadCaptureFile(path string) ([]*CapturedFrame, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	frames, err := ReadCapture(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return frames, nil
+}
+
+// EncodeFrame returns the raw frame for the message,
+// without the sync bytes
+func EncodeFrame(msg SmartbusMessage) []byte {
+	var buf bytes.Buffer
+	WriteFrame(&buf, msg)
+	return buf.Bytes()[2:]
+}
+
+// frameTapSetter is implemented by the IOs that are
+// able to pass the raw frames to a FrameTap
+type frameTapSetter interface {
+	SetFrameTap(tap FrameTap)
+}
+
+// RecordingIO is a SmartbusIO that passes all the traffic
+// of the wrapped SmartbusIO to the specified recorder.
+// If the wrapped SmartbusIO supports frame taps, the frames
+// are recorded exactly as they're seen on the wire, including
+// the damaged ones. Otherwise, the messages are re-encoded.
+type RecordingIO struct {
+	sync.Mutex
+	inner    SmartbusIO
+	recorder FrameRecorder
+	timeFunc func() time.Time
+	tapped   bool
+	readCh   chan *SmartbusMessage
+	quit     chan struct{}
+}
+
+func NewRecordingIO(inner SmartbusIO, recorder FrameRecorder) *RecordingIO {
+	return &RecordingIO{
+		inner:    inner,
+		recorder: recorder,
+		timeFunc: time.Now,
+		readCh:   make(chan *SmartbusMessage),
+		quit:     make(chan struct{}),
+	}
+}
+
+// SetTimeFunc sets the function that is used to obtain
+// frame timestamps. Must be called before Start().
+func (recIO *RecordingIO) SetTimeFunc(timeFunc func() time.Time) {
+	recIO.timeFunc = timeFunc
+}
+
+func (recIO *RecordingIO) recordFrame(direction string, frame []byte) {
+	recIO.Lock()
+	defer recIO.Unlock()
+	if recIO.recorder == nil {
+		return
+	}
+	err := recIO.recorder.RecordFrame(&CapturedFrame{recIO.timeFunc(), direction, frame})
+	if err != nil {
+		wbgo.Error.Printf("failed to record the frame, capture stopped: %s", err)
+		recIO.recorder.Close()
+		recIO.recorder = nil
+	}
+}
+
+func (recIO *RecordingIO) Start() chan *SmartbusMessage {
+	if setter, ok := recIO.inner.(frameTapSetter); ok {
+		setter.SetFrameTap(recIO.recordFrame)
+		recIO.tapped = true
+	}
+	innerCh := recIO.inner.Start()
+	go func() {
+		defer close(recIO.readCh)
+		for msg := range innerCh {
+			if !recIO.tapped {
+				recIO.recordFrame(CAPTURE_DIRECTION_IN, EncodeFrame(*msg))
+			}
+			select {
+			case recIO.readCh <- msg:
+			case <-recIO.quit:
+				return
+			}
+		}
+	}()
+	return recIO.readCh
+}
+
+func (recIO *RecordingIO) Send(msg SmartbusMessage) {
+	if !recIO.tapped {
+		recIO.recordFrame(CAPTURE_DIRECTION_OUT, EncodeFrame(msg))
+	}
+	recIO.inner.Send(msg)
+}
+
+func (recIO *RecordingIO) Stop() {
+	close(recIO.quit)
+	recIO.inner.Stop()
+	recIO.Lock()
+	defer recIO.Unlock()
+	if recIO.recorder != nil {
+		recIO.recorder.Close()
+		recIO.recorder = nil
+	}
+}
+
+// ReplayIO is a SmartbusIO that plays back the incoming frames
+// from a capture preserving the intervals between them.
+// The intervals are divided by the speed factor, zero speed
+// means no delays at all. The playback starts after
+// REPLAY_START_DELAY regardless of the speed. The frames
+// with bad CRC are skipped. Outgoing messages are dropped.
+// After the capture is exhausted, ReplayIO stays idle
+// until stopped.
+type ReplayIO struct {
+	frames    []*CapturedFrame
+	timerFunc TimerFunc
+	speed     float64
+	readCh    chan *SmartbusMessage
+	quit      chan struct{}
+}
+
+func NewReplayIO(frames []*CapturedFrame, timerFunc TimerFunc, speed float64) *ReplayIO {
+	if timerFunc == nil {
+		timerFunc = func(d time.Duration) wbgo.Timer {
+			return wbgo.NewRealTimer(d)
+		}
+	}
+	return &ReplayIO{
+		frames:    frames,
+		timerFunc: timerFunc,
+		speed:     speed,
+		readCh:    make(chan *SmartbusMessage),
+		quit:      make(chan struct{}),
+	}
+}
+
+func (replayIO *ReplayIO) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := replayIO.timerFunc(d)
+	select {
+	case <-replayIO.quit:
+		timer.Stop()
+		return false
+	case <-timer.GetChannel():
+		return true
+	}
+}
+
+func (replayIO *ReplayIO) run() {
+	defer close(replayIO.readCh)
+	if !replayIO.wait(REPLAY_START_DELAY) {
+		return
+	}
+	var prev *CapturedFrame
+	for _, frame := range replayIO.frames {
+		if frame.Direction != CAPTURE_DIRECTION_IN {
+			continue
+		}
+		if prev != nil && replayIO.speed > 0 &&
+			!replayIO.wait(time.Duration(float64(frame.Time.Sub(prev.Time))/replayIO.speed)) {
+			return
+		}
+		prev = frame
+		// the damaged frames are captured, too,
+		// but the driver doesn't receive them
+		if crc, ok := checkFrameCRC(frame.Frame); !ok {
+			wbgo.Warn.Printf("skipping captured frame with bad crc (expected: 0x%02x)", crc)
+			continue
+		}
+		msg, err := ParseFrame(frame.Frame)
+		if err != nil {
+			wbgo.Error.Printf("failed to parse captured frame: %s", err)
+			continue
+		}
+		select {
+		case replayIO.readCh <- msg:
+		case <-replayIO.quit:
+			return
+		}
+	}
+	wbgo.Warn.Printf("capture replay finished")
+	<-replayIO.quit
+}
+
+func (replayIO *ReplayIO) Start() chan *SmartbusMessage {
+	go replayIO.run()
+	return replayIO.readCh
+}
+
+func (replayIO *ReplayIO) Send(msg SmartbusMessage) {
+	wbgo.Debug.Printf("replay: dropping outgoing message %#v", msg)
+}
+
+func (replayIO *ReplayIO) Stop() {
+	close(replayIO.quit)
+	for _ = range replayIO.readCh {
+		// drain read queue
+	}
+}
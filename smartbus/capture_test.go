@@ -0,0 +1,187 @@
+package smartbus
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/contactless/wbgo/testutils"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type captureBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (buf *captureBuffer) Close() error {
+	buf.closed = true
+	return nil
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	p, r := net.Pipe()
+	buf := &captureBuffer{}
+	recIO := NewRecordingIO(NewStreamIO(p, nil), NewTextCaptureWriter(buf))
+	ts := time.Date(2015, 1, 25, 9, 9, 20, 0, time.UTC)
+	recIO.SetTimeFunc(func() time.Time { return ts })
+
+	appHandler := NewFakeHandler(t)
+	conn := NewSmartbusConnection(recIO)
+	appEp := conn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	appEp.Observe(appHandler)
+
+	relayHandler := NewFakeHandler(t)
+	remoteConn := NewSmartbusConnection(NewStreamIO(r, nil))
+	relayEp := remoteConn.MakeSmartbusEndpoint(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, SAMPLE_RELAY_DEVICE_TYPE)
+	relayEp.Observe(relayHandler)
+	relayToAppDev := relayEp.GetSmartbusDevice(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID)
+
+	appEp.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID).SingleChannelControl(2, LIGHT_LEVEL_ON, 0)
+	relayHandler.Verify("03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 2/100/0>")
+	relayToAppDev.SingleChannelControlResponse(2, true, LIGHT_LEVEL_ON, parseChannelStatus("-x"))
+	appHandler.Verify("01/1c (type 139c) -> 03/fe: <SingleChannelControlResponse 2/true/100/-x>")
+	ts = ts.Add(2 * time.Second)
+	relayToAppDev.SingleChannelControlResponse(3, true, LIGHT_LEVEL_ON, parseChannelStatus("-xx"))
+	appHandler.Verify("01/1c (type 139c) -> 03/fe: <SingleChannelControlResponse 3/true/100/-xx>")
+
+	conn.Close()
+	remoteConn.Close()
+	if !buf.closed {
+		t.Errorf("the capture is not closed")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("bad capture:\n%s", buf.String())
+	}
+	for i, expected := range []string{
+		"2015-01-25T09:09:20Z out 0f 03 fe ff fe 00 31 01 1c 02 64 00 00 2e 6b",
+		"2015-01-25T09:09:20Z in 10 01 1c 13 9c 00 32 03 fe 02 f8 64 02 02 47 c2",
+		"2015-01-25T09:09:22Z in 10 01 1c 13 9c 00 32 03 fe 03 f8 64 03 06 9e 26",
+	} {
+		if lines[i] != expected {
+			t.Errorf("bad capture line %q (expected %q)", lines[i], expected)
+		}
+	}
+
+	frames, err := ReadCapture(strings.NewReader(CAPTURE_HEADER + "\n" + buf.String()))
+	if err != nil {
+		t.Fatalf("ReadCapture(): %s", err)
+	}
+
+	// replay at double speed
+	rec := testutils.NewRecorder(t)
+	timers := testutils.NewFakeTimerFixture(t, rec)
+	replayIO := NewReplayIO(frames, timers.NewFakeTimer, 2)
+	replayConn := NewSmartbusConnection(replayIO)
+	replayEp := replayConn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	replayEp.Observe(appHandler)
+	rec.Verify(fmt.Sprintf("new fake timer: 1, %d", REPLAY_START_DELAY/time.Millisecond))
+	timers.FireTimer(1, timers.AdvanceTime(REPLAY_START_DELAY))
+	appHandler.Verify("01/1c (type 139c) -> 03/fe: <SingleChannelControlResponse 2/true/100/-x>")
+	rec.Verify("timer.fire(): 1", "new fake timer: 2, 1000")
+	timers.FireTimer(2, timers.AdvanceTime(time.Second))
+	rec.Verify("timer.fire(): 2")
+	appHandler.Verify("01/1c (type 139c) -> 03/fe: <SingleChannelControlResponse 3/true/100/-xx>")
+	testutils.EnsureGotWarnings(t)
+
+	// outgoing messages are dropped
+	replayEp.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID).SingleChannelControl(2, LIGHT_LEVEL_ON, 0)
+	replayConn.Close()
+	appHandler.Verify()
+}
+
+func TestRecordDamagedFrames(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	p, r := net.Pipe()
+	buf := &captureBuffer{}
+	recIO := NewRecordingIO(NewStreamIO(p, nil), NewTextCaptureWriter(buf))
+	ts := time.Date(2015, 1, 25, 9, 9, 20, 0, time.UTC)
+	recIO.SetTimeFunc(func() time.Time { return ts })
+
+	appHandler := NewFakeHandler(t)
+	conn := NewSmartbusConnection(recIO)
+	appEp := conn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	appEp.Observe(appHandler)
+
+	// the first frame has bad CRC
+	bs, err := parseHexBytes("aa aa 10 01 1c 13 9c 00 32 03 fe 02 f8 64 02 02 47 c3 " +
+		"aa aa 10 01 1c 13 9c 00 32 03 fe 02 f8 64 02 02 47 c2")
+	if err != nil {
+		t.Fatalf("parseHexBytes(): %s", err)
+	}
+	go r.Write(bs)
+	appHandler.Verify("01/1c (type 139c) -> 03/fe: <SingleChannelControlResponse 2/true/100/-x>")
+	testutils.EnsureGotErrors(t)
+
+	conn.Close()
+	r.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("bad capture:\n%s", buf.String())
+	}
+	for i, expected := range []string{
+		"2015-01-25T09:09:20Z in 10 01 1c 13 9c 00 32 03 fe 02 f8 64 02 02 47 c3",
+		"2015-01-25T09:09:20Z in 10 01 1c 13 9c 00 32 03 fe 02 f8 64 02 02 47 c2",
+	} {
+		if lines[i] != expected {
+			t.Errorf("bad capture line %q (expected %q)", lines[i], expected)
+		}
+	}
+
+	// the frame with bad CRC is skipped on replay
+	frames, err := ReadCapture(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("ReadCapture(): %s", err)
+	}
+	rec := testutils.NewRecorder(t)
+	timers := testutils.NewFakeTimerFixture(t, rec)
+	replayConn := NewSmartbusConnection(NewReplayIO(frames, timers.NewFakeTimer, 0))
+	replayEp := replayConn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	replayEp.Observe(appHandler)
+	rec.Verify(fmt.Sprintf("new fake timer: 1, %d", REPLAY_START_DELAY/time.Millisecond))
+	timers.FireTimer(1, timers.AdvanceTime(REPLAY_START_DELAY))
+	rec.Verify("timer.fire(): 1")
+	appHandler.Verify("01/1c (type 139c) -> 03/fe: <SingleChannelControlResponse 2/true/100/-x>")
+	replayConn.Close()
+	appHandler.Verify()
+	testutils.EnsureGotWarnings(t)
+}
+
+func TestReadCaptureErrors(t *testing.T) {
+	frame := "0f 03 fe ff fe 00 31 01 1c 02 64 00 00 2e 6b"
+	for _, item := range []struct {
+		capture  string
+		expected string
+	}{
+		{"2015-01-25T09:09:20Z in", "line 1: bad captured frame"},
+		{"# comment\n\n2015-01-25 in " + frame, "line 3: bad timestamp"},
+		{"2015-01-25T09:09:20Z sideways " + frame, `line 1: bad direction "sideways"`},
+		{"2015-01-25T09:09:20Z in zz", "line 1: bad payload"},
+		{"2015-01-25T09:09:20Z in 0f 03 fe", "line 1: bad frame length"},
+	} {
+		_, err := ReadCapture(strings.NewReader(item.capture))
+		if err == nil {
+			t.Errorf("ReadCapture() didn't fail for %q", item.capture)
+		} else if !strings.Contains(err.Error(), item.expected) {
+			t.Errorf("error message %q doesn't contain %q", err.Error(), item.expected)
+		}
+	}
+
+	frames, err := ReadCapture(strings.NewReader("2015-01-25T09:09:20.5Z out " + frame + "\n"))
+	if err != nil {
+		t.Fatalf("ReadCapture(): %s", err)
+	}
+	if len(frames) != 1 || frames[0].Direction != CAPTURE_DIRECTION_OUT ||
+		fmt.Sprintf("%x", frames[0].Frame) != strings.Replace(frame, " ", "", -1) {
+		t.Errorf("bad frames: %#v", frames)
+	}
+}
@@ -0,0 +1,582 @@
+package smartbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_SERIAL_ADDRESS   = "/dev/ttyNSC1"
+	DEFAULT_SERIAL_BAUD_RATE = 9600
+	DEFAULT_SERIAL_DATA_BITS = 8
+	DEFAULT_SERIAL_STOP_BITS = 1
+	DEFAULT_SERIAL_PARITY    = "E"
+	DEFAULT_SERIAL_TIMEOUT   = 250 * time.Millisecond
+)
+
+// SerialConfig specifies serial port settings.
+// Timeout is specified in milliseconds.
+type SerialConfig struct {
+	BaudRate int    `json:"baudRate"`
+	DataBits int    `json:"dataBits"`
+	StopBits int    `json:"stopBits"`
+	Parity   string `json:"parity"`
+	Timeout  int    `json:"timeout"`
+}
+
+// TransportConfig specifies how the driver accesses the bus.
+// Address is either a serial port path (/dev/...), "udp",
+// tcp://host:port, host:port or replay:/path/to/capture.
+// If Capture is specified, all the frames sent and received
+// are appended to this file in CaptureFormat ("text", "pcap"
+// or "pcap-udp"). ReplaySpeed is the playback speed factor
+// for replay: addresses, zero means no delays.
+type TransportConfig struct {
+	Address       string       `json:"address"`
+	Gateway       bool         `json:"gateway"`
+	Serial        SerialConfig `json:"serial"`
+	Capture       string       `json:"capture"`
+	CaptureFormat string       `json:"captureFormat"`
+	ReplaySpeed   float64      `json:"replaySpeed"`
+}
+
+// QueueConfig specifies request queue settings.
+// Timeout and Interval are specified in milliseconds.
+// Size is the queue size for each target device,
+// Interval is the minimum interval between the requests.
+type QueueConfig struct {
+	Timeout  int `json:"timeout"`
+	Retries  int `json:"retries"`
+	Size     int `json:"size"`
+	Interval int `json:"interval"`
+}
+
+// DeviceConfig overrides the settings of a device
+// at the specified address. DeviceType, if non-zero,
+// replaces the device type reported by the device.
+type DeviceConfig struct {
+	SubnetID   uint8  `json:"subnet"`
+	DeviceID   uint8  `json:"device"`
+	DeviceType uint16 `json:"deviceType"`
+	Name       string `json:"name"`
+	Title      string `json:"title"`
+	Disabled   bool   `json:"disabled"`
+}
+
+// VirtualDeviceConfig specifies a relay module emulated by the
+// driver at its own bus address. DeviceType defaults to the
+// device type of the driver and Channels defaults to 15.
+// Remark is reported in response to ReadMACAddress queries.
+// Name and Title override the name and title of the MQTT device
+// (sbusvrelay<subnet>_<device> by default).
+type VirtualDeviceConfig struct {
+	SubnetID   uint8  `json:"subnet"`
+	DeviceID   uint8  `json:"device"`
+	DeviceType uint16 `json:"deviceType"`
+	Channels   int    `json:"channels"`
+	Remark     string `json:"remark"`
+	Name       string `json:"name"`
+	Title      string `json:"title"`
+}
+
+func (vdc *VirtualDeviceConfig) UnmarshalJSON(data []byte) error {
+	type plainVirtualDeviceConfig VirtualDeviceConfig
+	plain := plainVirtualDeviceConfig{Channels: NUM_VIRTUAL_RELAYS}
+	if err := decodeStrict(data, &plain); err != nil {
+		return err
+	}
+	*vdc = VirtualDeviceConfig(plain)
+	return nil
+}
+
+// AddressRange specifies a range of device addresses
+// within a subnet. ToDevice defaults to 255.
+type AddressRange struct {
+	SubnetID   uint8 `json:"subnet"`
+	FromDevice uint8 `json:"fromDevice"`
+	ToDevice   uint8 `json:"toDevice"`
+}
+
+func (r *AddressRange) UnmarshalJSON(data []byte) error {
+	type plainAddressRange AddressRange
+	plain := plainAddressRange{ToDevice: BROADCAST_DEVICE}
+	if err := decodeStrict(data, &plain); err != nil {
+		return err
+	}
+	*r = AddressRange(plain)
+	return nil
+}
+
+func (r *AddressRange) Contains(subnetID uint8, deviceID uint8) bool {
+	return subnetID == r.SubnetID && deviceID >= r.FromDevice && deviceID <= r.ToDevice
+}
+
+// MirrorConfig specifies the settings of bus traffic mirroring
+// to MQTT. If Addresses and/or Opcodes are specified, only the
+// matching messages are published.
+type MirrorConfig struct {
+	Enabled   bool           `json:"enabled"`
+	Topic     string         `json:"topic"`
+	Addresses []AddressRange `json:"addresses"`
+	Opcodes   []OpcodeSpec   `json:"opcodes"`
+}
+
+// ScanConfig specifies the settings of the bus scanner.
+// If Addresses are not specified, the driver's own subnet
+// is scanned. Timeout is specified in milliseconds.
+// If Output is specified, the inventory is also written
+// to this file in the specified Format ("json" or "csv").
+type ScanConfig struct {
+	Addresses []AddressRange `json:"addresses"`
+	Timeout   int            `json:"timeout"`
+	Retries   int            `json:"retries"`
+	Output    string         `json:"output"`
+	Format    string         `json:"format"`
+}
+
+// DiscoveryConfig specifies the settings of device rediscovery.
+// Every Interval milliseconds (zero disables it) the driver
+// sends a broadcast ReadMACAddress query and probes the known
+// addresses that don't respond.
+type DiscoveryConfig struct {
+	Interval int `json:"interval"`
+}
+
+// BusConfig specifies the settings of a single bus.
+// Name, if specified, is used to qualify the names of
+// the devices on the bus. If Statistics is set, the link
+// statistics are published as a separate device.
+// A polled device is considered offline after MaxMissedPolls
+// polls left without an answer, zero disables the tracking.
+// If StateFile is specified, the devices seen on the bus are
+// saved to this file and recreated upon driver restart.
+// VirtualDevices are the relay modules emulated by the driver
+// in addition to the virtual relays at the driver's own address.
+// Remark is reported by the driver in response to ReadMACAddress.
+type BusConfig struct {
+	Name           string                `json:"name"`
+	Transport      TransportConfig       `json:"transport"`
+	SubnetID       uint8                 `json:"subnet"`
+	DeviceID       uint8                 `json:"device"`
+	DeviceType     uint16                `json:"deviceType"`
+	Remark         string                `json:"remark"`
+	Queue          QueueConfig           `json:"queue"`
+	VirtualRelays  int                   `json:"virtualRelays"`
+	VirtualDevices []VirtualDeviceConfig `json:"virtualDevices"`
+	Devices        []DeviceConfig        `json:"devices"`
+	Mirror         MirrorConfig          `json:"mirror"`
+	Scan           ScanConfig            `json:"scan"`
+	Statistics     bool                  `json:"statistics"`
+	MaxMissedPolls int                   `json:"maxMissedPolls"`
+	Discovery      DiscoveryConfig       `json:"discovery"`
+	StateFile      string                `json:"stateFile"`
+}
+
+// DriverConfig specifies either a single bus (the top-level
+// settings) or a list of buses. In the latter case, the
+// top-level settings serve as the defaults for the buses.
+type DriverConfig struct {
+	BusConfig
+	Buses []BusConfig `json:"buses"`
+}
+
+func NewBusConfig() *BusConfig {
+	return &BusConfig{
+		Transport: TransportConfig{
+			Address: DEFAULT_SERIAL_ADDRESS,
+			Serial: SerialConfig{
+				BaudRate: DEFAULT_SERIAL_BAUD_RATE,
+				DataBits: DEFAULT_SERIAL_DATA_BITS,
+				StopBits: DEFAULT_SERIAL_STOP_BITS,
+				Parity:   DEFAULT_SERIAL_PARITY,
+				Timeout:  int(DEFAULT_SERIAL_TIMEOUT / time.Millisecond),
+			},
+			CaptureFormat: CAPTURE_FORMAT_TEXT,
+			ReplaySpeed:   1,
+		},
+		SubnetID:   DRIVER_SUBNET,
+		DeviceID:   DRIVER_DEVICE_ID,
+		DeviceType: DRIVER_DEVICE_TYPE,
+		Remark:     DRIVER_REMARK,
+		Queue: QueueConfig{
+			Timeout:  int(REQUEST_TIMEOUT / time.Millisecond),
+			Retries:  REQUEST_NUM_RETRIES,
+			Size:     REQUEST_QUEUE_SIZE,
+			Interval: int(REQUEST_MIN_INTERVAL / time.Millisecond),
+		},
+		VirtualRelays: NUM_VIRTUAL_RELAYS,
+		Scan: ScanConfig{
+			Timeout: int(DEFAULT_SCAN_TIMEOUT / time.Millisecond),
+			Retries: DEFAULT_SCAN_RETRIES,
+			Format:  "json",
+		},
+		Statistics:     false,
+		MaxMissedPolls: DEFAULT_MAX_MISSED_POLLS,
+		Discovery: DiscoveryConfig{
+			Interval: int(DEFAULT_DISCOVERY_INTERVAL / time.Millisecond),
+		},
+	}
+}
+
+func NewDriverConfig() *DriverConfig {
+	return &DriverConfig{BusConfig: *NewBusConfig()}
+}
+
+// LoadConfig reads the config file. The values that are
+// not specified in the file are set to their defaults.
+func LoadConfig(path string) (*DriverConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := NewDriverConfig()
+	if err := decodeStrict(data, config); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line, col := textPosition(data, syntaxErr.Offset)
+			return nil, fmt.Errorf("%s:%d:%d: %s", path, line, col, err)
+		}
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	// decode the buses once again, now using the
+	// top-level settings as the defaults
+	var rawBuses struct {
+		Buses []json.RawMessage `json:"buses"`
+	}
+	if err := json.Unmarshal(data, &rawBuses); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for i, rawBus := range rawBuses.Buses {
+		bus := config.BusConfig
+		bus.Name = ""
+		bus.Devices = nil
+		bus.VirtualDevices = nil
+		// decoding reuses the backing arrays of the slices,
+		// so the top-level ones must not be shared
+		bus.Mirror.Addresses = append([]AddressRange(nil), bus.Mirror.Addresses...)
+		bus.Mirror.Opcodes = append([]OpcodeSpec(nil), bus.Mirror.Opcodes...)
+		bus.Scan.Addresses = append([]AddressRange(nil), bus.Scan.Addresses...)
+		if err := decodeStrict(rawBus, &bus); err != nil {
+			return nil, fmt.Errorf("%s: buses[%d]: %s", path, i, err)
+		}
+		config.Buses[i] = bus
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewBuffer(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func textPosition(data []byte, offset int64) (line, col int) {
+	line, col = 1, 1
+	for _, c := range data[:offset] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return
+}
+
+// Validate checks the config and returns an error
+// listing all of the problems found
+func (config *DriverConfig) Validate() error {
+	problems := make([]string, 0)
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(config.Buses) > 0 {
+		if config.Name != "" {
+			problem("name must be specified per bus when buses are used")
+		}
+		if len(config.Devices) > 0 {
+			problem("devices must be specified per bus when buses are used")
+		}
+		if len(config.VirtualDevices) > 0 {
+			problem("virtualDevices must be specified per bus when buses are used")
+		}
+	}
+
+	buses := config.BusConfigs()
+	names := make(map[string]bool)
+	addresses := make(map[string]bool)
+	stateFiles := make(map[string]bool)
+	captures := make(map[string]bool)
+	deviceNames := make(map[string]bool)
+	udpUsed := false
+	for i, bus := range buses {
+		prefix := ""
+		if len(config.Buses) > 0 {
+			prefix = fmt.Sprintf("buses[%d].", i)
+		}
+		bus.validate(func(format string, args ...interface{}) {
+			problem(prefix+format, args...)
+		})
+		switch {
+		case bus.Name == "" && len(buses) > 1:
+			problem("%sname must be specified when there's more than one bus", prefix)
+		case bus.Name != "" && names[bus.Name]:
+			problem("%sduplicate bus name %q", prefix, bus.Name)
+		}
+		names[bus.Name] = true
+		if bus.Transport.Address != "udp" {
+			if addresses[bus.Transport.Address] {
+				problem("%sduplicate transport.address %q", prefix, bus.Transport.Address)
+			}
+			addresses[bus.Transport.Address] = true
+		}
+		if bus.StateFile != "" {
+			if stateFiles[bus.StateFile] {
+				problem("%sduplicate stateFile %q", prefix, bus.StateFile)
+			}
+			stateFiles[bus.StateFile] = true
+		}
+		if bus.Transport.Capture != "" {
+			if captures[bus.Transport.Capture] {
+				problem("%sduplicate transport.capture %q", prefix, bus.Transport.Capture)
+			}
+			captures[bus.Transport.Capture] = true
+		}
+		// the names are checked across the buses
+		// as they're not qualified by the bus name
+		for j, dc := range bus.Devices {
+			if dc.Name == "" {
+				continue
+			}
+			if deviceNames[dc.Name] {
+				problem("%sdevices[%d]: duplicate name %q", prefix, j, dc.Name)
+			}
+			deviceNames[dc.Name] = true
+		}
+		if bus.Transport.Address == "udp" || bus.Transport.Gateway {
+			if udpUsed {
+				problem("%sUDP port is already used by another bus", prefix)
+			}
+			udpUsed = true
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (config *BusConfig) validate(problem func(format string, args ...interface{})) {
+	if strings.ContainsAny(config.Name, "/+# ") {
+		problem("bad name: %q", config.Name)
+	}
+
+	transport := &config.Transport
+	if transport.Address == "" {
+		problem("transport.address is not specified")
+	}
+	if transport.Gateway && transport.Address == "udp" {
+		problem("transport.gateway cannot be used with udp transport")
+	}
+	if transport.Gateway && strings.HasPrefix(transport.Address, REPLAY_PREFIX) {
+		problem("transport.gateway cannot be used with replay transport")
+	}
+	switch transport.CaptureFormat {
+	case CAPTURE_FORMAT_TEXT, CAPTURE_FORMAT_PCAP, CAPTURE_FORMAT_PCAP_UDP:
+	default:
+		problem("bad transport.captureFormat: %q", transport.CaptureFormat)
+	}
+	if transport.ReplaySpeed < 0 {
+		problem("bad transport.replaySpeed: %g", transport.ReplaySpeed)
+	}
+	if transport.Serial.BaudRate <= 0 {
+		problem("bad transport.serial.baudRate: %d", transport.Serial.BaudRate)
+	}
+	if transport.Serial.DataBits < 5 || transport.Serial.DataBits > 8 {
+		problem("bad transport.serial.dataBits: %d", transport.Serial.DataBits)
+	}
+	if transport.Serial.StopBits != 1 && transport.Serial.StopBits != 2 {
+		problem("bad transport.serial.stopBits: %d", transport.Serial.StopBits)
+	}
+	switch transport.Serial.Parity {
+	case "N", "E", "O":
+	default:
+		problem("bad transport.serial.parity: %q (must be N, E or O)", transport.Serial.Parity)
+	}
+	if transport.Serial.Timeout <= 0 {
+		problem("bad transport.serial.timeout: %d", transport.Serial.Timeout)
+	}
+
+	if config.SubnetID == BROADCAST_SUBNET {
+		problem("subnet cannot be the broadcast subnet (%d)", BROADCAST_SUBNET)
+	}
+	if config.DeviceID == BROADCAST_DEVICE {
+		problem("device cannot be the broadcast device id (%d)", BROADCAST_DEVICE)
+	}
+
+	if config.Queue.Timeout <= 0 {
+		problem("bad queue.timeout: %d", config.Queue.Timeout)
+	}
+	if config.Queue.Retries < 0 {
+		problem("bad queue.retries: %d", config.Queue.Retries)
+	}
+	if config.Queue.Size <= 0 {
+		problem("bad queue.size: %d", config.Queue.Size)
+	}
+	if config.Queue.Interval < 0 {
+		problem("bad queue.interval: %d", config.Queue.Interval)
+	}
+
+	if len(config.Remark) >= 64 {
+		problem("remark too long")
+	}
+
+	if config.VirtualRelays <= 0 || config.VirtualRelays > 255 {
+		problem("bad virtualRelays: %d (must be 1..255)", config.VirtualRelays)
+	}
+
+	if config.MaxMissedPolls < 0 {
+		problem("bad maxMissedPolls: %d", config.MaxMissedPolls)
+	}
+
+	if config.Discovery.Interval < 0 {
+		problem("bad discovery.interval: %d", config.Discovery.Interval)
+	}
+
+	if strings.ContainsAny(config.Mirror.Topic, "+#") {
+		problem("bad mirror.topic: %q", config.Mirror.Topic)
+	}
+	for i, r := range config.Mirror.Addresses {
+		if r.FromDevice > r.ToDevice {
+			problem("bad mirror.addresses[%d]: empty device range %d-%d",
+				i, r.FromDevice, r.ToDevice)
+		}
+	}
+
+	for i, r := range config.Scan.Addresses {
+		if r.FromDevice > r.ToDevice {
+			problem("bad scan.addresses[%d]: empty device range %d-%d",
+				i, r.FromDevice, r.ToDevice)
+		}
+	}
+	if config.Scan.Timeout <= 0 {
+		problem("bad scan.timeout: %d", config.Scan.Timeout)
+	}
+	if config.Scan.Retries < 0 {
+		problem("bad scan.retries: %d", config.Scan.Retries)
+	}
+	if config.Scan.Format != "json" && config.Scan.Format != "csv" {
+		problem("bad scan.format: %q (must be json or csv)", config.Scan.Format)
+	}
+
+	seen := make(map[uint16]bool)
+	for i, dc := range config.Devices {
+		key := deviceKey(dc.SubnetID, dc.DeviceID)
+		switch {
+		case dc.SubnetID == BROADCAST_SUBNET || dc.DeviceID == BROADCAST_DEVICE:
+			problem("devices[%d]: broadcast address %d:%d", i, dc.SubnetID, dc.DeviceID)
+		case dc.SubnetID == config.SubnetID && dc.DeviceID == config.DeviceID:
+			problem("devices[%d]: address %d:%d is used by the driver itself",
+				i, dc.SubnetID, dc.DeviceID)
+		case seen[key]:
+			problem("devices[%d]: duplicate address %d:%d", i, dc.SubnetID, dc.DeviceID)
+		}
+		seen[key] = true
+		if dc.DeviceType != 0 {
+			if _, found := smartbusDeviceModelTypes[dc.DeviceType]; !found {
+				problem("devices[%d]: unsupported deviceType %d (0x%04x)",
+					i, dc.DeviceType, dc.DeviceType)
+			}
+		}
+	}
+
+	for i, vdc := range config.VirtualDevices {
+		key := deviceKey(vdc.SubnetID, vdc.DeviceID)
+		switch {
+		case vdc.SubnetID == BROADCAST_SUBNET || vdc.DeviceID == BROADCAST_DEVICE:
+			problem("virtualDevices[%d]: broadcast address %d:%d", i, vdc.SubnetID, vdc.DeviceID)
+		case vdc.SubnetID == config.SubnetID && vdc.DeviceID == config.DeviceID:
+			problem("virtualDevices[%d]: address %d:%d is used by the driver itself",
+				i, vdc.SubnetID, vdc.DeviceID)
+		case seen[key]:
+			problem("virtualDevices[%d]: duplicate address %d:%d", i, vdc.SubnetID, vdc.DeviceID)
+		}
+		seen[key] = true
+		if vdc.Channels <= 0 || vdc.Channels > 255 {
+			problem("virtualDevices[%d]: bad channels: %d (must be 1..255)", i, vdc.Channels)
+		}
+		if len(vdc.Remark) >= 64 {
+			problem("virtualDevices[%d]: remark too long", i)
+		}
+	}
+}
+
+// BusConfigs returns the settings of all the buses
+func (config *DriverConfig) BusConfigs() []*BusConfig {
+	if len(config.Buses) == 0 {
+		return []*BusConfig{&config.BusConfig}
+	}
+	buses := make([]*BusConfig, len(config.Buses))
+	for i := range config.Buses {
+		buses[i] = &config.Buses[i]
+	}
+	return buses
+}
+
+func (config *BusConfig) deviceConfig(subnetID uint8, deviceID uint8) *DeviceConfig {
+	for i := range config.Devices {
+		if config.Devices[i].SubnetID == subnetID && config.Devices[i].DeviceID == deviceID {
+			return &config.Devices[i]
+		}
+	}
+	return nil
+}
+
+func (config *BusConfig) requestTimeout() time.Duration {
+	return time.Duration(config.Queue.Timeout) * time.Millisecond
+}
+
+func (config *BusConfig) requestMinInterval() time.Duration {
+	return time.Duration(config.Queue.Interval) * time.Millisecond
+}
+
+func (config *BusConfig) mirrorTopic() string {
+	switch {
+	case config.Mirror.Topic != "":
+		return config.Mirror.Topic
+	case config.Name != "":
+		return "/smartbus/" + config.Name + "/traffic"
+	default:
+		return "/smartbus/traffic"
+	}
+}
+
+// scanAddresses returns the address ranges to scan
+func (config *BusConfig) scanAddresses() []AddressRange {
+	if len(config.Scan.Addresses) > 0 {
+		return config.Scan.Addresses
+	}
+	return []AddressRange{{SubnetID: config.SubnetID, FromDevice: 1, ToDevice: BROADCAST_DEVICE - 1}}
+}
+
+func (config *BusConfig) discoveryInterval() time.Duration {
+	return time.Duration(config.Discovery.Interval) * time.Millisecond
+}
+
+func (config *BusConfig) scanTimeout() time.Duration {
+	return time.Duration(config.Scan.Timeout) * time.Millisecond
+}
+
+func (serialConfig *SerialConfig) timeout() time.Duration {
+	return time.Duration(serialConfig.Timeout) * time.Millisecond
+}
@@ -0,0 +1,296 @@
+package smartbus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTempConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "smartbus-config")
+	if err != nil {
+		t.Fatalf("TempDir(): %s", err)
+	}
+	path := filepath.Join(dir, "wb-mqtt-smartbus.conf")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile(): %s", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfig(t *testing.T) {
+	path, cleanup := writeTempConfig(t, `{
+  "transport": {
+    "address": "tcp://192.168.1.10:6000",
+    "serial": { "baudRate": 19200 }
+  },
+  "subnet": 3,
+  "queue": { "retries": 5 },
+  "virtualRelays": 4,
+  "mirror": {
+    "enabled": true,
+    "addresses": [ { "subnet": 1 }, { "subnet": 2, "fromDevice": 10, "toDevice": 20 } ],
+    "opcodes": [ "SingleChannelControlCommand", "0x0284", 50 ]
+  },
+  "scan": { "addresses": [ { "subnet": 1, "fromDevice": 1, "toDevice": 100 } ], "output": "/tmp/inventory.csv", "format": "csv" },
+  "devices": [
+    { "subnet": 1, "device": 28, "name": "hall_relay", "title": "Hall Relay" },
+    { "subnet": 1, "device": 20, "disabled": true }
+  ],
+  "virtualDevices": [
+    { "subnet": 1, "device": 100, "name": "floor1_relays", "remark": "floor1" },
+    { "subnet": 2, "device": 100, "deviceType": 4661, "channels": 4 }
+  ]
+}`)
+	defer cleanup()
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig(): %s", err)
+	}
+
+	expected := NewDriverConfig()
+	expected.Transport.Address = "tcp://192.168.1.10:6000"
+	expected.Transport.Serial.BaudRate = 19200
+	expected.SubnetID = 3
+	expected.Queue.Retries = 5
+	expected.VirtualRelays = 4
+	expected.Mirror = MirrorConfig{
+		Enabled: true,
+		Addresses: []AddressRange{
+			{SubnetID: 1, FromDevice: 0, ToDevice: 255},
+			{SubnetID: 2, FromDevice: 10, ToDevice: 20},
+		},
+		Opcodes: []OpcodeSpec{0x0031, 0x0284, 0x0032},
+	}
+	expected.Scan.Addresses = []AddressRange{{SubnetID: 1, FromDevice: 1, ToDevice: 100}}
+	expected.Scan.Output = "/tmp/inventory.csv"
+	expected.Scan.Format = "csv"
+	expected.Devices = []DeviceConfig{
+		{SubnetID: 1, DeviceID: 28, Name: "hall_relay", Title: "Hall Relay"},
+		{SubnetID: 1, DeviceID: 20, Disabled: true},
+	}
+	expected.VirtualDevices = []VirtualDeviceConfig{
+		{SubnetID: 1, DeviceID: 100, Channels: NUM_VIRTUAL_RELAYS, Name: "floor1_relays", Remark: "floor1"},
+		{SubnetID: 2, DeviceID: 100, DeviceType: 4661, Channels: 4},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("bad config: %#v (expected %#v)", config, expected)
+	}
+
+	if devConfig := config.deviceConfig(1, 28); devConfig == nil || devConfig.Name != "hall_relay" {
+		t.Errorf("bad device config for 1:28: %#v", devConfig)
+	}
+	if devConfig := config.deviceConfig(1, 29); devConfig != nil {
+		t.Errorf("unexpected device config for 1:29: %#v", devConfig)
+	}
+}
+
+func TestLoadMultiBusConfig(t *testing.T) {
+	path, cleanup := writeTempConfig(t, `{
+  "transport": { "serial": { "baudRate": 19200 } },
+  "queue": { "retries": 5 },
+  "buses": [
+    {
+      "name": "trunk_a",
+      "transport": { "address": "/dev/ttyNSC0", "gateway": true },
+      "devices": [ { "subnet": 1, "device": 28, "name": "hall_relay" } ]
+    },
+    {
+      "name": "trunk_b",
+      "transport": { "address": "/dev/ttyNSC1", "serial": { "parity": "N" } },
+      "subnet": 2
+    }
+  ]
+}`)
+	defer cleanup()
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig(): %s", err)
+	}
+
+	busA := NewBusConfig()
+	busA.Name = "trunk_a"
+	busA.Transport.Address = "/dev/ttyNSC0"
+	busA.Transport.Gateway = true
+	busA.Transport.Serial.BaudRate = 19200
+	busA.Queue.Retries = 5
+	busA.Devices = []DeviceConfig{{SubnetID: 1, DeviceID: 28, Name: "hall_relay"}}
+
+	busB := NewBusConfig()
+	busB.Name = "trunk_b"
+	busB.Transport.Address = "/dev/ttyNSC1"
+	busB.Transport.Serial.BaudRate = 19200
+	busB.Transport.Serial.Parity = "N"
+	busB.SubnetID = 2
+	busB.Queue.Retries = 5
+
+	buses := config.BusConfigs()
+	if len(buses) != 2 {
+		t.Fatalf("bad number of buses: %d", len(buses))
+	}
+	for i, expected := range []*BusConfig{busA, busB} {
+		if !reflect.DeepEqual(buses[i], expected) {
+			t.Errorf("bad bus %d config: %#v (expected %#v)", i, buses[i], expected)
+		}
+	}
+}
+
+func TestLoadMultiBusConfigInheritedSlices(t *testing.T) {
+	path, cleanup := writeTempConfig(t, `{
+  "scan": { "addresses": [ { "subnet": 1, "fromDevice": 1, "toDevice": 100 } ] },
+  "buses": [
+    {
+      "name": "trunk_a",
+      "transport": { "address": "/dev/ttyNSC0" },
+      "scan": { "addresses": [ { "subnet": 1, "fromDevice": 20, "toDevice": 30 } ] }
+    },
+    {
+      "name": "trunk_b",
+      "transport": { "address": "/dev/ttyNSC1" }
+    }
+  ]
+}`)
+	defer cleanup()
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig(): %s", err)
+	}
+
+	// the ranges specified for trunk_a don't
+	// replace the top-level ones for trunk_b
+	topLevel := []AddressRange{{SubnetID: 1, FromDevice: 1, ToDevice: 100}}
+	for i, expected := range [][]AddressRange{
+		{{SubnetID: 1, FromDevice: 20, ToDevice: 30}},
+		topLevel,
+	} {
+		if actual := config.Buses[i].Scan.Addresses; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("bad scan addresses for bus %d: %#v (expected %#v)", i, actual, expected)
+		}
+	}
+	if !reflect.DeepEqual(config.Scan.Addresses, topLevel) {
+		t.Errorf("top-level scan addresses changed: %#v", config.Scan.Addresses)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, item := range []struct {
+		content  string
+		expected []string
+	}{
+		{
+			"{\n  \"subnet\": 1,\n  \"device\" 2\n}",
+			[]string{":3:13: "},
+		},
+		{
+			`{ "serialPort": "/dev/ttyS0" }`,
+			[]string{"serialPort"},
+		},
+		{
+			`{
+  "transport": { "address": "udp", "gateway": true, "serial": { "parity": "X" } },
+  "device": 255,
+  "remark": "0123456789012345678901234567890123456789012345678901234567890123",
+  "queue": { "size": 0, "interval": -1 },
+  "virtualRelays": 0,
+  "maxMissedPolls": -1,
+  "discovery": { "interval": -1 },
+  "devices": [
+    { "subnet": 1, "device": 28, "deviceType": 1 },
+    { "subnet": 1, "device": 28 }
+  ],
+  "virtualDevices": [
+    { "subnet": 1, "device": 28 },
+    { "subnet": 255, "device": 100 },
+    { "subnet": 1, "device": 101, "channels": 0 },
+    { "subnet": 1, "device": 102, "remark": "0123456789012345678901234567890123456789012345678901234567890123" }
+  ]
+}`,
+			[]string{
+				"transport.gateway cannot be used with udp transport",
+				"bad transport.serial.parity",
+				"device cannot be the broadcast device id",
+				"bad queue.size: 0",
+				"bad queue.interval: -1",
+				"remark too long",
+				"bad virtualRelays: 0",
+				"bad maxMissedPolls: -1",
+				"bad discovery.interval: -1",
+				"devices[0]: unsupported deviceType 1",
+				"devices[1]: duplicate address 1:28",
+				"virtualDevices[0]: duplicate address 1:28",
+				"virtualDevices[1]: broadcast address 255:100",
+				"virtualDevices[2]: bad channels: 0 (must be 1..255)",
+				"virtualDevices[3]: remark too long",
+			},
+		},
+		{
+			`{
+  "devices": [ { "subnet": 1, "device": 28 } ],
+  "virtualDevices": [ { "subnet": 1, "device": 100 } ],
+  "buses": [
+    { "transport": { "address": "udp" } },
+    { "name": "a/b", "transport": { "address": "/dev/ttyNSC1", "gateway": true, "capture": "/tmp/bus.log" },
+      "stateFile": "/tmp/state.json", "devices": [ { "subnet": 1, "device": 28, "name": "relay" } ] },
+    { "name": "a/b", "transport": { "address": "/dev/ttyNSC1", "capture": "/tmp/bus.log" },
+      "stateFile": "/tmp/state.json", "devices": [ { "subnet": 1, "device": 30, "name": "relay" } ] }
+  ]
+}`,
+			[]string{
+				"devices must be specified per bus when buses are used",
+				"virtualDevices must be specified per bus when buses are used",
+				"buses[0].name must be specified when there's more than one bus",
+				"buses[1].bad name: \"a/b\"",
+				"buses[1].UDP port is already used by another bus",
+				"buses[2].duplicate bus name \"a/b\"",
+				"buses[2].duplicate transport.address \"/dev/ttyNSC1\"",
+				"buses[2].duplicate stateFile \"/tmp/state.json\"",
+				"buses[2].duplicate transport.capture \"/tmp/bus.log\"",
+				"buses[2].devices[0]: duplicate name \"relay\"",
+			},
+		},
+		{
+			`{ "mirror": { "topic": "/smartbus/#", "addresses": [ { "subnet": 1, "fromDevice": 20, "toDevice": 10 } ] } }`,
+			[]string{
+				`bad mirror.topic: "/smartbus/#"`,
+				"bad mirror.addresses[0]: empty device range 20-10",
+			},
+		},
+		{
+			`{ "scan": { "addresses": [ { "subnet": 1, "fromDevice": 20, "toDevice": 10 } ], ` +
+				`"timeout": 0, "retries": -1, "format": "xml" } }`,
+			[]string{
+				"bad scan.addresses[0]: empty device range 20-10",
+				"bad scan.timeout: 0",
+				"bad scan.retries: -1",
+				`bad scan.format: "xml" (must be json or csv)`,
+			},
+		},
+		{
+			`{ "mirror": { "opcodes": [ "NoSuchMessage" ] } }`,
+			[]string{`bad opcode: "NoSuchMessage"`},
+		},
+		{
+			`{ "buses": [ { "name": "a", "baudRate": 9600 } ] }`,
+			[]string{"baudRate"},
+		},
+	} {
+		path, cleanup := writeTempConfig(t, item.content)
+		_, err := LoadConfig(path)
+		cleanup()
+		if err == nil {
+			t.Errorf("LoadConfig() didn't fail for %s", item.content)
+			continue
+		}
+		for _, s := range item.expected {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("error message %q doesn't contain %q", err.Error(), s)
+			}
+		}
+	}
+}
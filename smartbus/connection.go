@@ -2,6 +2,7 @@ package smartbus
 
 import (
 	wbgo "github.com/contactless/wbgo"
+	"sync"
 )
 
 // SmartbusConnection provides higher-level interface for
@@ -9,6 +10,7 @@ import (
 // messages by their destination and assign source
 // addresses to outgoind messages.
 type SmartbusConnection struct {
+	sync.Mutex
 	smartbusIO SmartbusIO
 	endpoints  []*SmartbusEndpoint
 }
@@ -26,30 +28,42 @@ func (conn *SmartbusConnection) run() {
 	readCh := conn.smartbusIO.Start()
 	go func() {
 		for msg := range readCh {
-			for _, ep := range conn.endpoints {
+			for _, ep := range conn.getEndpoints() {
 				ep.maybeHandleMessage(msg)
 			}
 		}
 	}()
 }
 
+func (conn *SmartbusConnection) getEndpoints() []*SmartbusEndpoint {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.endpoints
+}
+
 func (conn *SmartbusConnection) Send(msg SmartbusMessage) {
 	conn.smartbusIO.Send(msg)
 }
 
+// MakeSmartbusEndpoint creates a new endpoint with the
+// specified address. This function is threadsafe.
 func (conn *SmartbusConnection) MakeSmartbusEndpoint(subnetID uint8,
 	deviceID uint8, deviceType uint16) *SmartbusEndpoint {
 	ep := &SmartbusEndpoint{
-		conn,
-		subnetID,
-		deviceID,
-		deviceType,
-		make(map[uint16]*SmartbusDevice),
-		make([]interface{}, 0, 16),
-		make([]interface{}, 0, 16),
-		make([]interface{}, 0, 16),
+		Connection:      conn,
+		SubnetID:        subnetID,
+		DeviceID:        deviceID,
+		DeviceType:      deviceType,
+		deviceMap:       make(map[uint16]*SmartbusDevice),
+		responseWaiters: newResponseWaiters(),
 	}
-	conn.endpoints = append(conn.endpoints, ep)
+	conn.Lock()
+	defer conn.Unlock()
+	// the slice is copied so that the reader goroutine
+	// may iterate over the old one without locking
+	endpoints := make([]*SmartbusEndpoint, len(conn.endpoints), len(conn.endpoints)+1)
+	copy(endpoints, conn.endpoints)
+	conn.endpoints = append(endpoints, ep)
 	return ep
 }
 
@@ -57,22 +71,105 @@ func (conn *SmartbusConnection) Close() {
 	conn.smartbusIO.Stop()
 }
 
+// the kinds of the messages passed to subscriptions
+const (
+	// the messages addressed to the endpoint, including
+	// broadcast ones (see SmartbusEndpoint.Observe())
+	SUBSCRIBE_RECEIVED = iota
+	// the messages addressed to other devices
+	// (see SmartbusEndpoint.AddInputSniffer())
+	SUBSCRIBE_SNIFFED
+	// the messages sent by the endpoint
+	// (see SmartbusEndpoint.AddOutputSniffer())
+	SUBSCRIBE_SENT
+)
+
+// MessageHandler handles the messages passed to a subscription
+type MessageHandler func(msg Message, header *MessageHeader)
+
+// SubscriptionFilter selects the messages passed to a subscription
+// handler. Kind is one of SUBSCRIBE_... constants. Opcodes and
+// Sources are the lists of opcodes and source address ranges to
+// match, empty lists match any message. The opcode of a message
+// type can be obtained from its zero value, e.g.
+// (&SingleChannelControlResponse{}).Opcode()
+type SubscriptionFilter struct {
+	Kind    int
+	Opcodes []uint16
+	Sources []AddressRange
+}
+
+// MessageTypes returns a filter for the received messages
+// of the same types as the specified ones
+func MessageTypes(msgs ...Message) SubscriptionFilter {
+	filter := SubscriptionFilter{Kind: SUBSCRIBE_RECEIVED}
+	for _, msg := range msgs {
+		filter.Opcodes = append(filter.Opcodes, msg.Opcode())
+	}
+	return filter
+}
+
+func (filter *SubscriptionFilter) matches(msg Message, header *MessageHeader) bool {
+	return matchUint16(filter.Opcodes, msg.Opcode()) &&
+		matchAddress(filter.Sources, header.OrigSubnetID, header.OrigDeviceID)
+}
+
+// Subscription is a handle for the handler
+// registered with SmartbusEndpoint.Subscribe()
+type Subscription struct {
+	ep        *SmartbusEndpoint
+	filter    SubscriptionFilter
+	handler   MessageHandler
+	cancelled bool
+}
+
+// Cancel removes the subscription. The handler is not called
+// after Cancel() returns, unless Cancel() is called from another
+// goroutine while the handler is running. This function is
+// threadsafe and may be called from the handler itself.
+func (sub *Subscription) Cancel() {
+	ep := sub.ep
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	sub.cancelled = true
+	subs := make([]*Subscription, 0, len(ep.subscriptions))
+	for _, s := range ep.subscriptions {
+		if s != sub {
+			subs = append(subs, s)
+		}
+	}
+	ep.subscriptions = subs
+}
+
+func (sub *Subscription) isCancelled() bool {
+	sub.ep.mutex.Lock()
+	defer sub.ep.mutex.Unlock()
+	return sub.cancelled
+}
+
 type SmartbusEndpoint struct {
-	Connection     *SmartbusConnection
-	SubnetID       uint8
-	DeviceID       uint8
-	DeviceType     uint16
-	deviceMap      map[uint16]*SmartbusDevice
-	observers      []interface{}
-	inputSniffers  []interface{}
-	outputSniffers []interface{}
+	// mutex guards deviceMap, subscriptions
+	// and the cancelled flags of the latter
+	mutex         sync.Mutex
+	Connection    *SmartbusConnection
+	SubnetID      uint8
+	DeviceID      uint8
+	DeviceType    uint16
+	deviceMap     map[uint16]*SmartbusDevice
+	subscriptions []*Subscription
+	// the requests made with SmartbusDevice.Request()
+	responseWaiters *responseWaiters
 }
 
 func deviceKey(subnetID uint8, deviceID uint8) uint16 {
 	return (uint16(subnetID) << 8) + uint16(deviceID)
 }
 
+// GetSmartbusDevice returns the device with the specified address
+// that's used to send messages to it. This function is threadsafe.
 func (ep *SmartbusEndpoint) GetSmartbusDevice(subnetID uint8, deviceID uint8) *SmartbusDevice {
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
 	dev, found := ep.deviceMap[deviceKey(subnetID, deviceID)]
 	if !found {
 		dev = &SmartbusDevice{ep, subnetID, deviceID, 0}
@@ -89,20 +186,47 @@ func (ep *SmartbusEndpoint) Send(msg SmartbusMessage) {
 	msg.Header.OrigSubnetID = ep.SubnetID
 	msg.Header.OrigDeviceID = ep.DeviceID
 	msg.Header.OrigDeviceType = ep.DeviceType
-	ep.notify(ep.outputSniffers, &msg)
+	ep.notify(SUBSCRIBE_SENT, &msg)
 	ep.Connection.Send(msg)
 }
 
-func (ep *SmartbusEndpoint) Observe(observer interface{}) {
-	ep.observers = append(ep.observers, observer)
+// Subscribe registers the handler for the messages that
+// pass the filter. The handlers are invoked on the connection
+// goroutine for the received messages and on the sending
+// goroutine for the sent ones. This function is threadsafe.
+func (ep *SmartbusEndpoint) Subscribe(filter SubscriptionFilter, handler MessageHandler) *Subscription {
+	sub := &Subscription{ep: ep, filter: filter, handler: handler}
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	subs := make([]*Subscription, len(ep.subscriptions), len(ep.subscriptions)+1)
+	copy(subs, ep.subscriptions)
+	ep.subscriptions = append(subs, sub)
+	return sub
 }
 
-func (ep *SmartbusEndpoint) AddInputSniffer(observer interface{}) {
-	ep.inputSniffers = append(ep.inputSniffers, observer)
+func (ep *SmartbusEndpoint) visitor(kind int, observer interface{}) *Subscription {
+	return ep.Subscribe(SubscriptionFilter{Kind: kind}, func(msg Message, header *MessageHeader) {
+		wbgo.Visit(observer, msg, "On", header)
+	})
 }
 
-func (ep *SmartbusEndpoint) AddOutputSniffer(observer interface{}) {
-	ep.outputSniffers = append(ep.outputSniffers, observer)
+// Observe registers the observer for the messages addressed to
+// the endpoint. The messages are dispatched to On<MessageType>
+// or OnAnything methods of the observer.
+func (ep *SmartbusEndpoint) Observe(observer interface{}) *Subscription {
+	return ep.visitor(SUBSCRIBE_RECEIVED, observer)
+}
+
+// AddInputSniffer registers the observer for the messages
+// addressed to other devices
+func (ep *SmartbusEndpoint) AddInputSniffer(observer interface{}) *Subscription {
+	return ep.visitor(SUBSCRIBE_SNIFFED, observer)
+}
+
+// AddOutputSniffer registers the observer for
+// the messages sent by the endpoint
+func (ep *SmartbusEndpoint) AddOutputSniffer(observer interface{}) *Subscription {
+	return ep.visitor(SUBSCRIBE_SENT, observer)
 }
 
 func (ep *SmartbusEndpoint) isMessageForUs(smartbusMsg *SmartbusMessage) bool {
@@ -116,16 +240,25 @@ func (ep *SmartbusEndpoint) isMessageForUs(smartbusMsg *SmartbusMessage) bool {
 
 func (ep *SmartbusEndpoint) maybeHandleMessage(smartbusMsg *SmartbusMessage) {
 	if ep.isMessageForUs(smartbusMsg) {
-		ep.notify(ep.observers, smartbusMsg)
+		ep.responseWaiters.deliver(smartbusMsg)
+		ep.notify(SUBSCRIBE_RECEIVED, smartbusMsg)
 	} else {
-		ep.notify(ep.inputSniffers, smartbusMsg)
+		ep.notify(SUBSCRIBE_SNIFFED, smartbusMsg)
 	}
 }
 
-func (ep *SmartbusEndpoint) notify(observers []interface{},
-	smartbusMsg *SmartbusMessage) {
-	for _, observer := range observers {
-		wbgo.Visit(observer, smartbusMsg.Message, "On", &smartbusMsg.Header)
+func (ep *SmartbusEndpoint) getSubscriptions() []*Subscription {
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	return ep.subscriptions
+}
+
+func (ep *SmartbusEndpoint) notify(kind int, smartbusMsg *SmartbusMessage) {
+	msg := smartbusMsg.Message.(Message)
+	for _, sub := range ep.getSubscriptions() {
+		if sub.filter.Kind == kind && sub.filter.matches(msg, &smartbusMsg.Header) && !sub.isCancelled() {
+			sub.handler(msg, &smartbusMsg.Header)
+		}
 	}
 }
 
@@ -231,6 +231,10 @@ func (f *MessageFormatter) OnSensorStatusBroadcast(msg *SensorStatusBroadcast, h
 		msg.DryContact1, msg.DryContact2)
 }
 
+func (f *MessageFormatter) OnRawMessage(msg *RawMessage, hdr *MessageHeader) {
+	f.log(hdr, "<RawMessage %04x [%s]>", msg.RawOpcode, formatHexBytes(msg.Payload))
+}
+
 type MessageDumper struct {
 	MessageFormatter
 }
@@ -7,14 +7,16 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
-// FIXME
+// the defaults for the driver's own identity on the bus
 const (
 	DRIVER_SUBNET      = 0x01
 	DRIVER_DEVICE_ID   = 0x99
 	DRIVER_DEVICE_TYPE = 0x1234
+	DRIVER_REMARK      = "wb-mqtt-smartbus"
 	DRIVER_CLIENT_ID   = "smartbus"
 )
 
@@ -26,6 +28,42 @@ func (wrapper *serialWrapper) IsTimeout(err error) bool {
 	return err == serial.ErrTimeout
 }
 
+const (
+	TCP_KEEPALIVE_PERIOD = 30 * time.Second
+)
+
+// gatewayStreamIO is a SmartbusStreamIO that relays the traffic
+// to and from the UDP gateway. Stopping it also stops the gateway
+// so that the UDP port is released upon reconnection.
+type gatewayStreamIO struct {
+	*SmartbusStreamIO
+	sync.Mutex
+	dgramIO         *DatagramIO
+	rawSerialReadCh chan []byte
+	stopped         bool
+}
+
+func (gwIO *gatewayStreamIO) relay(ch chan []byte, send func(frame []byte)) {
+	for frame := range ch {
+		gwIO.Lock()
+		if !gwIO.stopped {
+			send(frame)
+		}
+		gwIO.Unlock()
+	}
+}
+
+func (gwIO *gatewayStreamIO) Stop() {
+	gwIO.Lock()
+	gwIO.stopped = true
+	gwIO.Unlock()
+	gwIO.SmartbusStreamIO.Stop()
+	// the serial reader is finished at this point
+	close(gwIO.rawSerialReadCh)
+	// rawUdpReadCh is closed by the DatagramIO
+	gwIO.dgramIO.Stop()
+}
+
 func createStreamIO(stream io.ReadWriteCloser, provideUdpGateway bool) (SmartbusIO, error) {
 	if !provideUdpGateway {
 		return NewStreamIO(stream, nil), nil
@@ -35,40 +73,106 @@ func createStreamIO(stream io.ReadWriteCloser, provideUdpGateway bool) (Smartbus
 	wbgo.Debug.Println("using UDP gateway mode")
 	dgramIO, err := NewDatagramIO(rawUdpReadCh)
 	if err != nil {
+		stream.Close()
 		return nil, err
 	}
-	streamIO := NewStreamIO(stream, rawSerialReadCh)
+	gwIO := &gatewayStreamIO{
+		SmartbusStreamIO: NewStreamIO(stream, rawSerialReadCh),
+		dgramIO:          dgramIO,
+		rawSerialReadCh:  rawSerialReadCh,
+	}
 	dgramIO.Start()
-	go func() {
-		for frame := range rawUdpReadCh {
-			streamIO.SendRaw(frame)
-		}
-	}()
-	go func() {
-		for frame := range rawSerialReadCh {
-			dgramIO.SendRaw(frame)
-		}
-	}()
-	return streamIO, nil
+	go gwIO.relay(rawUdpReadCh, gwIO.SmartbusStreamIO.SendRaw)
+	go gwIO.relay(rawSerialReadCh, dgramIO.SendRaw)
+	return gwIO, nil
+}
+
+func dialTCP(address string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	// TCP-to-RS485 converters may reboot without closing
+	// the connection, use keepalives to detect this
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(TCP_KEEPALIVE_PERIOD)
+	}
+	return conn, nil
+}
+
+func openSerial(transport *TransportConfig) (io.ReadWriteCloser, error) {
+	port, err := serial.Open(&serial.Config{
+		Address:  transport.Address,
+		BaudRate: transport.Serial.BaudRate,
+		DataBits: transport.Serial.DataBits,
+		StopBits: transport.Serial.StopBits,
+		Parity:   transport.Serial.Parity,
+		Timeout:  transport.Serial.timeout(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &serialWrapper{port}, nil
+}
+
+// linkStatsSetter is implemented by the IOs that are
+// able to count framing errors
+type linkStatsSetter interface {
+	SetLinkStats(stats *LinkStats)
+}
+
+// connect opens the transport. If stats is not nil, the
+// framing errors are counted using it.
+func connect(transport *TransportConfig, stats *LinkStats) (SmartbusIO, error) {
+	if transport.Capture == "" {
+		return connectWithStats(transport, stats)
+	}
+	// open the capture file first so that there's no need
+	// to stop the transport if it cannot be opened
+	recorder, err := CreateCaptureRecorder(transport.Capture, transport.CaptureFormat)
+	if err != nil {
+		return nil, err
+	}
+	smartbusIO, err := connectWithStats(transport, stats)
+	if err != nil {
+		recorder.Close()
+		return nil, err
+	}
+	return NewRecordingIO(smartbusIO, recorder), nil
 }
 
-func connect(serialAddress string, provideUdpGateway bool) (SmartbusIO, error) {
+func connectWithStats(transport *TransportConfig, stats *LinkStats) (SmartbusIO, error) {
+	smartbusIO, err := connectTransport(transport)
+	if err != nil {
+		return nil, err
+	}
+	if setter, ok := smartbusIO.(linkStatsSetter); ok && stats != nil {
+		setter.SetLinkStats(stats)
+	}
+	return smartbusIO, nil
+}
+
+func connectTransport(transport *TransportConfig) (SmartbusIO, error) {
+	address := transport.Address
 	switch {
-	case strings.HasPrefix(serialAddress, "/"):
-		if port, err := serial.Open(&serial.Config{
-			Address:  serialAddress,
-			BaudRate: 9600,
-			DataBits: 8,
-			StopBits: 1,
-			Parity:   "E",
-			Timeout:  250 * time.Millisecond,
-		}); err != nil {
+	case strings.HasPrefix(address, REPLAY_PREFIX):
+		if transport.Gateway {
+			return nil, errors.New("cannot provide UDP gw in replay mode")
+		}
+		if frames, err := ReadCaptureFile(address[len(REPLAY_PREFIX):]); err != nil {
+			return nil, err
+		} else {
+			return NewReplayIO(frames, nil, transport.ReplaySpeed), nil
+		}
+	case strings.HasPrefix(address, "/"):
+		if port, err := openSerial(transport); err != nil {
 			return nil, err
 		} else {
-			return createStreamIO(&serialWrapper{port}, provideUdpGateway)
+			return createStreamIO(port, transport.Gateway)
 		}
-	case serialAddress == "udp":
-		if provideUdpGateway {
+	case address == "udp":
+		if transport.Gateway {
 			return nil, errors.New("cannot provide UDP gw in udp device access mode")
 		}
 		if dgramIO, err := NewDatagramIO(nil); err != nil {
@@ -76,27 +180,120 @@ func connect(serialAddress string, provideUdpGateway bool) (SmartbusIO, error) {
 		} else {
 			return dgramIO, nil
 		}
-	case strings.HasPrefix(serialAddress, "tcp://"):
-		if conn, err := net.Dial("tcp", serialAddress[6:]); err != nil {
+	case strings.HasPrefix(address, "tcp://"):
+		if conn, err := dialTCP(address[6:]); err != nil {
 			return nil, err
 		} else {
-			return createStreamIO(conn, provideUdpGateway)
+			return createStreamIO(conn, transport.Gateway)
 		}
 	}
 
-	if conn, err := net.Dial("tcp", serialAddress); err != nil {
+	if conn, err := dialTCP(address); err != nil {
 		return nil, err
 	} else {
 		return NewStreamIO(conn, nil), nil
 	}
 }
 
-func NewSmartbusTCPDriver(serialAddress, brokerAddress string, provideUdpGateway bool) (*wbgo.Driver, error) {
-	model := NewSmartbusModel(func() (SmartbusIO, error) {
-		return connect(serialAddress, provideUdpGateway)
-	}, DRIVER_SUBNET, DRIVER_DEVICE_ID, DRIVER_DEVICE_TYPE, func(d time.Duration) wbgo.Timer {
+// ListenRaw opens the transport in listen-only mode and returns
+// the channel that receives the raw frames (without the sync bytes)
+// together with the function that closes the transport.
+// Nothing is ever sent to the bus. The channel is closed when
+// the connection is lost.
+func ListenRaw(transport *TransportConfig) (chan []byte, func(), error) {
+	address := transport.Address
+	rawReadCh := make(chan []byte)
+	if address == "udp" {
+		dgramIO, err := NewDatagramIO(rawReadCh)
+		if err != nil {
+			return nil, nil, err
+		}
+		dgramIO.Start()
+		return rawReadCh, dgramIO.Stop, nil
+	}
+
+	var stream io.ReadWriteCloser
+	var err error
+	switch {
+	case strings.HasPrefix(address, REPLAY_PREFIX):
+		return nil, nil, errors.New("cannot listen to a capture replay")
+	case strings.HasPrefix(address, "/"):
+		stream, err = openSerial(transport)
+	case strings.HasPrefix(address, "tcp://"):
+		stream, err = dialTCP(address[6:])
+	default:
+		stream, err = dialTCP(address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	streamIO := NewStreamIO(stream, rawReadCh)
+	readCh := streamIO.Start()
+	go func() {
+		// the raw frames are sent before the parsed ones,
+		// so there are no more raw frames after readCh is closed
+		for _ = range readCh {
+		}
+		close(rawReadCh)
+	}()
+	return rawReadCh, streamIO.Stop, nil
+}
+
+func newBusModel(config *BusConfig) (model *SmartbusModel) {
+	model = NewConfiguredSmartbusModel(func() (SmartbusIO, error) {
+		return connect(&config.Transport, model.LinkStats())
+	}, config, func(d time.Duration) wbgo.Timer {
 		return wbgo.NewRealTimer(d)
 	})
-	driver := wbgo.NewDriver(model, wbgo.NewPahoMQTTClient(brokerAddress, DRIVER_CLIENT_ID, false))
+	return
+}
+
+// ScanBus connects to the bus and probes the specified
+// address ranges, using the config's scan settings
+func ScanBus(config *BusConfig, ranges []AddressRange) ([]*InventoryEntry, error) {
+	// the UDP gateway is not needed for scanning
+	transport := config.Transport
+	transport.Gateway = false
+	smartbusIO, err := connect(&transport, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn := NewSmartbusConnection(smartbusIO)
+	defer conn.Close()
+	ep := conn.MakeSmartbusEndpoint(config.SubnetID, config.DeviceID, config.DeviceType)
+	scanner := NewScanner(ep, func(d time.Duration) wbgo.Timer {
+		return wbgo.NewRealTimer(d)
+	}, config.scanTimeout(), config.Scan.Retries)
+	if len(ranges) == 0 {
+		ranges = config.scanAddresses()
+	}
+	return scanner.Scan(ranges)
+}
+
+func NewSmartbusDriver(config *DriverConfig, brokerAddress string) (*wbgo.Driver, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	client := wbgo.NewPahoMQTTClient(brokerAddress, DRIVER_CLIENT_ID, false)
+	buses := config.BusConfigs()
+	busModels := make([]*SmartbusModel, len(buses))
+	for i, bus := range buses {
+		busModels[i] = newBusModel(bus)
+		busModels[i].SetMQTTClient(client)
+	}
+	var model wbgo.Model
+	if len(busModels) == 1 {
+		model = busModels[0]
+	} else {
+		model = NewMultiBusModel(busModels...)
+	}
+	driver := wbgo.NewDriver(model, client)
 	return driver, nil
 }
+
+func NewSmartbusTCPDriver(serialAddress, brokerAddress string, provideUdpGateway bool) (*wbgo.Driver, error) {
+	config := NewDriverConfig()
+	config.Transport.Address = serialAddress
+	config.Transport.Gateway = provideUdpGateway
+	return NewSmartbusDriver(config, brokerAddress)
+}
@@ -96,6 +96,10 @@ func WriteFrame(writer io.Writer, fullMsg SmartbusMessage) {
 }
 
 func ReadSync(reader io.Reader, mutex MutexLike) error {
+	return readSync(reader, mutex, nil)
+}
+
+func readSync(reader io.Reader, mutex MutexLike, stats *LinkStats) error {
 	var b byte
 	for {
 		if err := binary.Read(reader, binary.BigEndian, &b); err != nil {
@@ -106,6 +110,7 @@ func ReadSync(reader io.Reader, mutex MutexLike) error {
 		}
 		if b != 0xaa {
 			wbgo.Debug.Printf("unsync byte 0: %02x", b)
+			stats.Count(STATS_UNSYNC_BYTES)
 			continue
 		}
 
@@ -113,6 +118,7 @@ func ReadSync(reader io.Reader, mutex MutexLike) error {
 		if err := binary.Read(reader, binary.BigEndian, &b); err != nil {
 			if isTimeout(reader, err) {
 				wbgo.Debug.Printf("sync byte 1 timeout")
+				stats.Count(STATS_TIMEOUTS)
 				continue
 			}
 			mutex.Unlock()
@@ -123,6 +129,7 @@ func ReadSync(reader io.Reader, mutex MutexLike) error {
 		}
 
 		wbgo.Debug.Printf("unsync byte 1: %02x", b)
+		stats.Count(STATS_UNSYNC_BYTES)
 		mutex.Unlock()
 	}
 	// the mutex is locked here
@@ -138,7 +145,8 @@ func ParseFrame(frame []byte) (*SmartbusMessage, error) {
 	}
 	msgParser, found := recognizedMessages[header.Opcode]
 	if !found {
-		return nil, fmt.Errorf("opcode %04x not recognized", header.Opcode)
+		wbgo.Debug.Printf("opcode %04x not recognized, passing the message as raw", header.Opcode)
+		msgParser = MakeRawPacketParser(header.Opcode)
 	}
 
 	if msg, err := msgParser(buf); err != nil {
@@ -148,11 +156,30 @@ func ParseFrame(frame []byte) (*SmartbusMessage, error) {
 	}
 }
 
+// FrameTap receives the raw frames (without the sync bytes) as
+// they're read from or written to the bus. The incoming frames
+// are passed to it before they're checked, so the frames with
+// bad CRC and the ones that cannot be parsed are passed, too.
+// direction is either CAPTURE_DIRECTION_IN or CAPTURE_DIRECTION_OUT.
+type FrameTap func(direction string, frame []byte)
+
+// checkFrameCRC returns the CRC calculated for the raw frame
+// (without the sync bytes) and whether the frame carries it
+func checkFrameCRC(frame []byte) (uint16, bool) {
+	crc := crc16(frame[:len(frame)-2])
+	return crc, crc == binary.BigEndian.Uint16(frame[len(frame)-2:])
+}
+
 func ReadSmartbusFrame(reader io.Reader) ([]byte, bool) {
+	return readSmartbusFrame(reader, nil, nil)
+}
+
+func readSmartbusFrame(reader io.Reader, stats *LinkStats, tap FrameTap) ([]byte, bool) {
 	var l byte
 	if err := binary.Read(reader, binary.BigEndian, &l); err != nil {
 		if isTimeout(reader, err) {
 			wbgo.Error.Printf("timed out reading frame length")
+			stats.Count(STATS_TIMEOUTS)
 			return nil, true
 		}
 		wbgo.Error.Printf("error reading frame length: %v", err)
@@ -160,6 +187,7 @@ func ReadSmartbusFrame(reader io.Reader) ([]byte, bool) {
 	}
 	if l < MIN_FRAME_SIZE {
 		wbgo.Error.Printf("frame too short")
+		stats.Count(STATS_SHORT_FRAMES)
 		return nil, true
 	}
 	var frame []byte = make([]byte, l)
@@ -167,15 +195,19 @@ func ReadSmartbusFrame(reader io.Reader) ([]byte, bool) {
 	if _, err := io.ReadFull(reader, frame[1:]); err != nil {
 		if isTimeout(reader, err) {
 			wbgo.Error.Printf("timed out reading frame body")
+			stats.Count(STATS_TIMEOUTS)
 			return nil, true
 		}
 		wbgo.Error.Printf("error reading frame body (%d bytes): %v", l, err)
 		return nil, false
 	}
+	if tap != nil {
+		tap(CAPTURE_DIRECTION_IN, frame)
+	}
 
-	crc := crc16(frame[:len(frame)-2])
-	if crc != binary.BigEndian.Uint16(frame[len(frame)-2:]) {
+	if crc, ok := checkFrameCRC(frame); !ok {
 		wbgo.Error.Printf("bad crc (expected: 0x%02x)", crc)
+		stats.Count(STATS_CRC_ERRORS)
 		return nil, true
 	}
 
@@ -183,6 +215,10 @@ func ReadSmartbusFrame(reader io.Reader) ([]byte, bool) {
 }
 
 func ReadSmartbusRaw(reader io.Reader, mutex MutexLike, frameHandler func(frame []byte)) {
+	readSmartbusRaw(reader, mutex, nil, nil, frameHandler)
+}
+
+func readSmartbusRaw(reader io.Reader, mutex MutexLike, stats *LinkStats, tap FrameTap, frameHandler func(frame []byte)) {
 	var err error
 	defer func() {
 		switch {
@@ -200,14 +236,14 @@ func ReadSmartbusRaw(reader io.Reader, mutex MutexLike, frameHandler func(frame
 		}
 	}()
 	for {
-		if err = ReadSync(reader, mutex); err != nil {
+		if err = readSync(reader, mutex, stats); err != nil {
 			wbgo.Debug.Printf("ReadSync error: %v", err)
 			// the mutex is not locked if ReadSync failed
 			break
 		}
 
 		// the mutex is locked here
-		frame, cont := ReadSmartbusFrame(reader)
+		frame, cont := readSmartbusFrame(reader, stats, tap)
 		mutex.Unlock()
 		if frame != nil {
 			frameHandler(frame)
@@ -219,12 +255,18 @@ func ReadSmartbusRaw(reader io.Reader, mutex MutexLike, frameHandler func(frame
 }
 
 func ReadSmartbus(reader io.Reader, mutex MutexLike, ch chan *SmartbusMessage, rawReadCh chan []byte) {
-	ReadSmartbusRaw(reader, mutex, func(frame []byte) {
+	readSmartbus(reader, mutex, nil, nil, ch, rawReadCh)
+}
+
+func readSmartbus(reader io.Reader, mutex MutexLike, stats *LinkStats, tap FrameTap,
+	ch chan *SmartbusMessage, rawReadCh chan []byte) {
+	readSmartbusRaw(reader, mutex, stats, tap, func(frame []byte) {
 		if rawReadCh != nil {
 			rawReadCh <- frame
 		}
 		if msg, err := ParseFrame(frame); err != nil {
 			wbgo.Error.Printf("failed to parse smartbus frame: %s", err)
+			stats.Count(STATS_PARSE_ERRORS)
 		} else {
 			ch <- msg
 		}
@@ -233,17 +275,28 @@ func ReadSmartbus(reader io.Reader, mutex MutexLike, ch chan *SmartbusMessage, r
 }
 
 func WriteSmartbus(writer io.Writer, mutex MutexLike, ch chan interface{}) {
+	writeSmartbus(writer, mutex, nil, ch)
+}
+
+func writeSmartbus(writer io.Writer, mutex MutexLike, tap FrameTap, ch chan interface{}) {
 	for msg := range ch {
-		mutex.Lock()
+		// the frame is encoded first so that the tap
+		// receives exactly the bytes that are written
+		var buf bytes.Buffer
 		switch msg.(type) {
 		case SmartbusMessage:
-			WriteFrame(writer, msg.(SmartbusMessage))
+			WriteFrame(&buf, msg.(SmartbusMessage))
 		case []byte:
-			WritePreBuiltFrame(writer, msg.([]byte))
+			WritePreBuiltFrame(&buf, msg.([]byte))
 		default:
 			panic("unsupported message object type")
 		}
+		mutex.Lock()
+		writer.Write(buf.Bytes())
 		mutex.Unlock()
+		if tap != nil {
+			tap(CAPTURE_DIRECTION_OUT, buf.Bytes()[2:])
+		}
 	}
 }
 
@@ -253,12 +306,20 @@ type SmartbusIO interface {
 	Stop()
 }
 
+// SmartbusStreamIO is a SmartbusIO working over a stream such
+// as a serial port or a TCP connection. Send() may be called
+// concurrently with Stop(), in which case the message is dropped.
 type SmartbusStreamIO struct {
 	stream    io.ReadWriteCloser
 	readCh    chan *SmartbusMessage
 	writeCh   chan interface{}
 	rawReadCh chan []byte
 	mutex     sync.Mutex
+	stats     *LinkStats
+	tap       FrameTap
+	stopMutex sync.RWMutex
+	stopped   bool
+	quit      chan struct{}
 }
 
 func NewStreamIO(stream io.ReadWriteCloser, rawReadCh chan []byte) *SmartbusStreamIO {
@@ -267,25 +328,56 @@ func NewStreamIO(stream io.ReadWriteCloser, rawReadCh chan []byte) *SmartbusStre
 		readCh:    make(chan *SmartbusMessage),
 		writeCh:   make(chan interface{}),
 		rawReadCh: rawReadCh,
+		quit:      make(chan struct{}),
 	}
 }
 
+// SetLinkStats makes the SmartbusStreamIO count framing
+// errors using the specified LinkStats. Must be called
+// before Start().
+func (streamIO *SmartbusStreamIO) SetLinkStats(stats *LinkStats) {
+	streamIO.stats = stats
+}
+
+// SetFrameTap makes the SmartbusStreamIO pass all the raw
+// frames to the specified tap. Must be called before Start().
+func (streamIO *SmartbusStreamIO) SetFrameTap(tap FrameTap) {
+	streamIO.tap = tap
+}
+
 func (streamIO *SmartbusStreamIO) Start() chan *SmartbusMessage {
-	go ReadSmartbus(streamIO.stream, &streamIO.mutex, streamIO.readCh, streamIO.rawReadCh)
-	go WriteSmartbus(streamIO.stream, &streamIO.mutex, streamIO.writeCh)
+	go readSmartbus(streamIO.stream, &streamIO.mutex, streamIO.stats, streamIO.tap,
+		streamIO.readCh, streamIO.rawReadCh)
+	go writeSmartbus(streamIO.stream, &streamIO.mutex, streamIO.tap, streamIO.writeCh)
 	return streamIO.readCh
 }
 
+func (streamIO *SmartbusStreamIO) send(msg interface{}) {
+	streamIO.stopMutex.RLock()
+	defer streamIO.stopMutex.RUnlock()
+	if streamIO.stopped {
+		return
+	}
+	select {
+	case streamIO.writeCh <- msg:
+	case <-streamIO.quit:
+	}
+}
+
 func (streamIO *SmartbusStreamIO) Send(msg SmartbusMessage) {
-	streamIO.writeCh <- msg
+	streamIO.send(msg)
 }
 
 func (streamIO *SmartbusStreamIO) SendRaw(msg []byte) {
-	streamIO.writeCh <- msg
+	streamIO.send(msg)
 }
 
 func (streamIO *SmartbusStreamIO) Stop() {
+	close(streamIO.quit) // this releases the senders blocked on writeCh
+	streamIO.stopMutex.Lock()
+	streamIO.stopped = true
 	close(streamIO.writeCh) // this kills WriteSmartbus goroutine
+	streamIO.stopMutex.Unlock()
 	streamIO.stream.Close() // this kills ReadSmartbus goroutine by causing read error
 	for _ = range streamIO.readCh {
 		// drain read queue
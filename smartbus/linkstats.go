@@ -0,0 +1,211 @@
+package smartbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/contactless/wbgo"
+	"strconv"
+	"sync"
+)
+
+// the names of the link statistics counters, also
+// used as the control names of the statistics device
+const (
+	STATS_FRAMES_IN    = "Frames In"
+	STATS_FRAMES_OUT   = "Frames Out"
+	STATS_UNSYNC_BYTES = "Unsync Bytes"
+	STATS_SHORT_FRAMES = "Short Frames"
+	STATS_CRC_ERRORS   = "CRC Errors"
+	STATS_TIMEOUTS     = "Timeouts"
+	STATS_PARSE_ERRORS = "Parse Errors"
+	STATS_RETRIES      = "Retries"
+	STATS_FAILURES     = "Failures"
+	STATS_QUEUE_DEPTH  = "Queue Depth"
+
+	STATS_IN_BY_OPCODE  = "Frames In By Opcode"
+	STATS_OUT_BY_OPCODE = "Frames Out By Opcode"
+	STATS_IN_BY_DEVICE  = "Frames In By Device"
+	STATS_OUT_BY_DEVICE = "Frames Out By Device"
+)
+
+var statsCounterNames = []string{
+	STATS_FRAMES_IN,
+	STATS_FRAMES_OUT,
+	STATS_UNSYNC_BYTES,
+	STATS_SHORT_FRAMES,
+	STATS_CRC_ERRORS,
+	STATS_TIMEOUTS,
+	STATS_PARSE_ERRORS,
+	STATS_RETRIES,
+	STATS_FAILURES,
+}
+
+var statsBreakdownNames = []string{
+	STATS_IN_BY_OPCODE,
+	STATS_OUT_BY_OPCODE,
+	STATS_IN_BY_DEVICE,
+	STATS_OUT_BY_DEVICE,
+}
+
+// LinkStats counts the frames seen on the bus together with
+// framing errors, request retries and failures. The methods
+// may be called on a nil LinkStats, in which case nothing
+// is counted. LinkStats is safe for concurrent use.
+type LinkStats struct {
+	sync.Mutex
+	counters   map[string]uint64
+	breakdowns map[string]map[string]uint64
+}
+
+func NewLinkStats() *LinkStats {
+	stats := &LinkStats{
+		counters:   make(map[string]uint64),
+		breakdowns: make(map[string]map[string]uint64),
+	}
+	for _, name := range statsBreakdownNames {
+		stats.breakdowns[name] = make(map[string]uint64)
+	}
+	return stats
+}
+
+// Count increments the specified counter
+func (stats *LinkStats) Count(name string) {
+	if stats == nil {
+		return
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	stats.counters[name]++
+}
+
+// Counter returns the value of the specified counter
+func (stats *LinkStats) Counter(name string) uint64 {
+	if stats == nil {
+		return 0
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	return stats.counters[name]
+}
+
+func opcodeKey(msg Message) string {
+	if _, raw := msg.(*RawMessage); raw {
+		return fmt.Sprintf("%04x", msg.Opcode())
+	}
+	return MessageName(msg)
+}
+
+func (stats *LinkStats) countFrame(in bool, msg Message, subnetID uint8, deviceID uint8) {
+	if stats == nil {
+		return
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	counter, byOpcode, byDevice := STATS_FRAMES_OUT, STATS_OUT_BY_OPCODE, STATS_OUT_BY_DEVICE
+	if in {
+		counter, byOpcode, byDevice = STATS_FRAMES_IN, STATS_IN_BY_OPCODE, STATS_IN_BY_DEVICE
+	}
+	stats.counters[counter]++
+	stats.breakdowns[byOpcode][opcodeKey(msg)]++
+	stats.breakdowns[byDevice][fmt.Sprintf("%d:%d", subnetID, deviceID)]++
+}
+
+// Values returns the values of the counters as strings.
+// The per-opcode and per-device breakdowns are returned
+// as JSON objects.
+func (stats *LinkStats) Values() map[string]string {
+	stats.Lock()
+	defer stats.Unlock()
+	values := make(map[string]string)
+	for _, name := range statsCounterNames {
+		values[name] = strconv.FormatUint(stats.counters[name], 10)
+	}
+	for _, name := range statsBreakdownNames {
+		bs, _ := json.Marshal(stats.breakdowns[name])
+		values[name] = string(bs)
+	}
+	return values
+}
+
+// Attach makes the LinkStats count all the frames
+// received and sent by the endpoint. Incoming frames are
+// counted by their source address and outgoing ones by
+// their target address.
+func (stats *LinkStats) Attach(ep *SmartbusEndpoint) {
+	ep.Observe(&statsObserver{stats, true})
+	ep.AddInputSniffer(&statsObserver{stats, true})
+	ep.AddOutputSniffer(&statsObserver{stats, false})
+}
+
+// AttachOutput makes the LinkStats count the frames
+// sent by the endpoint. It's used for the extra endpoints
+// of the driver, as the frames they receive are also
+// seen by the main one.
+func (stats *LinkStats) AttachOutput(ep *SmartbusEndpoint) {
+	ep.AddOutputSniffer(&statsObserver{stats, false})
+}
+
+type statsObserver struct {
+	stats *LinkStats
+	in    bool
+}
+
+func (observer *statsObserver) OnAnything(msg Message, header *MessageHeader) {
+	if observer.in {
+		observer.stats.countFrame(true, msg, header.OrigSubnetID, header.OrigDeviceID)
+	} else {
+		observer.stats.countFrame(false, msg, header.TargetSubnetID, header.TargetDeviceID)
+	}
+}
+
+// StatsDevice is a virtual device that publishes
+// the link statistics
+type StatsDevice struct {
+	wbgo.DeviceBase
+	values map[string]string
+}
+
+func NewStatsDevice() *StatsDevice {
+	r := &StatsDevice{values: make(map[string]string)}
+	r.DevName = "sbusstats"
+	r.DevTitle = "Smart-Bus Statistics"
+	return r
+}
+
+func (dm *StatsDevice) Publish(values map[string]string) {
+	for _, name := range statsCounterNames {
+		dm.publishControl(name, "value", values[name])
+	}
+	dm.publishControl(STATS_QUEUE_DEPTH, "value", values[STATS_QUEUE_DEPTH])
+	for _, name := range statsBreakdownNames {
+		dm.publishControl(name, "text", values[name])
+	}
+}
+
+func (dm *StatsDevice) publishControl(name, paramType, value string) {
+	dm.values[name] = value
+	dm.Observer.OnNewControl(dm, name, paramType, value, true, -1, true)
+}
+
+// Update publishes the values that have changed
+func (dm *StatsDevice) Update(values map[string]string) {
+	for name, value := range values {
+		if old, found := dm.values[name]; found && old != value {
+			dm.values[name] = value
+			dm.Observer.OnValue(dm, name, value)
+		}
+	}
+}
+
+func (dm *StatsDevice) AcceptValue(name, value string) {
+	// ignore retained values
+}
+
+func (dm *StatsDevice) AcceptOnValue(name, value string) bool {
+	// the statistics cannot be changed
+	return false
+}
+
+func (dm *StatsDevice) IsVirtual() bool {
+	return true
+}
@@ -0,0 +1,60 @@
+package smartbus
+
+import (
+	"bytes"
+	"github.com/contactless/wbgo/testutils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLinkStatsFramingErrors(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureGotErrors(t)
+
+	bs := append([]uint8{
+		0x00, // unsync byte
+		0xaa, // Sync1
+		0x00, // unsync byte
+		0xaa, // Sync1
+		0xaa, // Sync2
+		0x05, // Len (too short)
+		0xaa, // Sync1
+		0xaa, // Sync2
+		0x0f, // Len
+		0x01, 0x14, 0x00, 0x95, 0x00, 0x31, 0x01, 0x1c,
+		0x01, 0x00, 0x00, 0x00,
+		0xff, 0xff, // bad CRC
+	}, messageTestCases[0].Packet...)
+	stats := NewLinkStats()
+	ch := make(chan *SmartbusMessage)
+	go readSmartbus(bytes.NewBuffer(bs), NewFakeMutex(t), stats, nil, ch, nil)
+	VerifyReadSingle(t, messageTestCases[0], ch)
+
+	assert.Equal(t, uint64(2), stats.Counter(STATS_UNSYNC_BYTES))
+	assert.Equal(t, uint64(1), stats.Counter(STATS_SHORT_FRAMES))
+	assert.Equal(t, uint64(1), stats.Counter(STATS_CRC_ERRORS))
+	assert.Equal(t, uint64(0), stats.Counter(STATS_TIMEOUTS))
+}
+
+func TestLinkStatsValues(t *testing.T) {
+	stats := NewLinkStats()
+	stats.countFrame(true, &ReadMACAddressResponse{}, 1, 28)
+	stats.countFrame(true, &ReadMACAddressResponse{}, 1, 20)
+	stats.countFrame(false, &RawMessage{0x1234, []byte{1}}, 1, 28)
+	stats.Count(STATS_RETRIES)
+
+	values := stats.Values()
+	assert.Equal(t, "2", values[STATS_FRAMES_IN])
+	assert.Equal(t, "1", values[STATS_FRAMES_OUT])
+	assert.Equal(t, "1", values[STATS_RETRIES])
+	assert.Equal(t, "0", values[STATS_FAILURES])
+	assert.Equal(t, `{"ReadMACAddressResponse":2}`, values[STATS_IN_BY_OPCODE])
+	assert.Equal(t, `{"1234":1}`, values[STATS_OUT_BY_OPCODE])
+	assert.Equal(t, `{"1:20":1,"1:28":1}`, values[STATS_IN_BY_DEVICE])
+	assert.Equal(t, `{"1:28":1}`, values[STATS_OUT_BY_DEVICE])
+
+	// counting on a nil LinkStats is a no-op
+	var nilStats *LinkStats
+	nilStats.Count(STATS_RETRIES)
+	assert.Equal(t, uint64(0), nilStats.Counter(STATS_RETRIES))
+}
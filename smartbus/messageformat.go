@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/contactless/wbgo"
 	"io"
+	"io/ioutil"
 	"reflect"
 )
 
@@ -143,6 +144,22 @@ func WriteTemperatureListField(writer io.Writer, value reflect.Value) error {
 
 // ------
 
+func ReadRawBytesField(reader io.Reader, value reflect.Value) error {
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	value.Set(reflect.ValueOf(buf))
+	return nil
+}
+
+func WriteRawBytesField(writer io.Writer, value reflect.Value) error {
+	_, err := writer.Write(value.Interface().([]uint8))
+	return err
+}
+
+// ------
+
 type FieldReadFunc func(reader io.Reader, value reflect.Value) error
 type FieldWriteFunc func(writer io.Writer, value reflect.Value) error
 
@@ -225,6 +242,20 @@ func arrayConverter(itemConverter converter) converter {
 	}
 }
 
+var panelButtonModeNames []string = []string{
+	"Invalid",
+	"SingleOnOff",
+	"SingleOn",
+	"SingleOff",
+	"CombinationOn",
+	"CombinationOff",
+	"PressOnReleaseOff",
+	"CombinationOnOff",
+	"SeparateLeftRightPressOnReleaseOff",
+	"SeparateLeftRightCombinationOnOff",
+	"LeftOffRightOn",
+}
+
 var converterMap map[string]converter = map[string]converter{
 	"flag": uint8MapConverter(map[uint8]interface{}{
 		0x00: false,
@@ -234,25 +265,12 @@ var converterMap map[string]converter = map[string]converter{
 		0xf8: true,
 		0xf5: false,
 	}),
-	"channelStatus": {ReadChannelStatusField, WriteChannelStatusField},
-	"statusBytes":   {ReadStatusBytesField, WriteStatusBytesField},
-	"panelButtonModes": arrayConverter(
-		uint8NameListConverter(
-			[]string{
-				"Invalid",
-				"SingleOnOff",
-				"SingleOn",
-				"SingleOff",
-				"CombinationOn",
-				"CombinationOff",
-				"PressOnReleaseOff",
-				"CombinationOnOff",
-				"SeparateLeftRightPressOnReleaseOff",
-				"SeparateLeftRightCombinationOnOff",
-				"LeftOffRightOn",
-			})),
-	"remark":   {ReadRemarkField, WriteRemarkField},
-	"templist": {ReadTemperatureListField, WriteTemperatureListField},
+	"channelStatus":    {ReadChannelStatusField, WriteChannelStatusField},
+	"statusBytes":      {ReadStatusBytesField, WriteStatusBytesField},
+	"panelButtonModes": arrayConverter(uint8NameListConverter(panelButtonModeNames)),
+	"remark":           {ReadRemarkField, WriteRemarkField},
+	"templist":         {ReadTemperatureListField, WriteTemperatureListField},
+	"rawBytes":         {ReadRawBytesField, WriteRawBytesField},
 	"sensorTemp": uint8converter(
 		func(in uint8) (interface{}, error) {
 			return int(in) - 20, nil
@@ -372,6 +390,16 @@ func MakePreprocessedPacketParser(construct func() Message) PacketParser {
 }
 
 var recognizedMessages map[uint16]PacketParser = make(map[uint16]PacketParser)
+var messageTypes map[uint16]reflect.Type = make(map[uint16]reflect.Type)
+var messageOpcodesByName map[string]uint16 = make(map[string]uint16)
+
+// MakeRawPacketParser returns a parser that produces
+// a RawMessage with the specified opcode
+func MakeRawPacketParser(opcode uint16) PacketParser {
+	return MakePreprocessedPacketParser(func() Message {
+		return &RawMessage{RawOpcode: opcode}
+	})
+}
 
 func RegisterMessage(messagePtr interface{}) {
 	messageType := reflect.TypeOf(messagePtr)
@@ -390,4 +418,32 @@ func RegisterMessage(messagePtr interface{}) {
 		parser = MakeSimplePacketParser(construct)
 	}
 	recognizedMessages[msg.Opcode()] = parser
+	messageTypes[msg.Opcode()] = messageType
+	messageOpcodesByName[messageType.Name()] = msg.Opcode()
+}
+
+// NewMessage creates an empty message of the registered
+// type with the specified opcode
+func NewMessage(opcode uint16) (Message, bool) {
+	messageType, found := messageTypes[opcode]
+	if !found {
+		return nil, false
+	}
+	return reflect.New(messageType).Interface().(Message), true
+}
+
+// LookupMessageOpcode returns the opcode of the
+// registered message type with the specified name
+func LookupMessageOpcode(name string) (uint16, bool) {
+	opcode, found := messageOpcodesByName[name]
+	return opcode, found
+}
+
+// MessageName returns the name of the message type
+func MessageName(msg Message) string {
+	messageType := reflect.TypeOf(msg)
+	for messageType.Kind() == reflect.Ptr {
+		messageType = messageType.Elem()
+	}
+	return messageType.Name()
 }
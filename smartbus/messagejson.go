@@ -0,0 +1,299 @@
+package smartbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// JSON representation of messages. Message fields are encoded
+// using their Go names in the order of declaration. The fields
+// with sbus tags listed in jsonConverterMap are converted
+// to a more readable form, the rest are encoded as is.
+
+type jsonFieldEncodeFunc func(value reflect.Value) (interface{}, error)
+type jsonFieldDecodeFunc func(data json.RawMessage, value reflect.Value) error
+
+type jsonConverter struct {
+	encode jsonFieldEncodeFunc
+	decode jsonFieldDecodeFunc
+}
+
+// byteListJSONConverter encodes []uint8 as a list of numbers
+// instead of base64 string
+var byteListJSONConverter = jsonConverter{
+	func(value reflect.Value) (interface{}, error) {
+		bs := value.Interface().([]uint8)
+		r := make([]int, len(bs))
+		for i, b := range bs {
+			r[i] = int(b)
+		}
+		return r, nil
+	},
+	func(data json.RawMessage, value reflect.Value) error {
+		var items []uint8
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		if items == nil {
+			items = []uint8{}
+		}
+		value.Set(reflect.ValueOf(items))
+		return nil
+	},
+}
+
+// hexBytesJSONConverter encodes []uint8 as a hex string ("01 02 03")
+var hexBytesJSONConverter = jsonConverter{
+	func(value reflect.Value) (interface{}, error) {
+		return formatHexBytes(value.Interface().([]uint8)), nil
+	},
+	func(data json.RawMessage, value reflect.Value) error {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		bs, err := parseHexBytes(s)
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(bs))
+		return nil
+	},
+}
+
+var channelStatusJSONConverter = jsonConverter{
+	func(value reflect.Value) (interface{}, error) {
+		status := value.Interface().([]bool)
+		if status == nil {
+			status = []bool{}
+		}
+		return status, nil
+	},
+	func(data json.RawMessage, value reflect.Value) error {
+		var status []bool
+		if err := json.Unmarshal(data, &status); err != nil {
+			return err
+		}
+		if status == nil {
+			status = []bool{}
+		}
+		value.Set(reflect.ValueOf(status))
+		return nil
+	},
+}
+
+func nameListJSONConverter(names []string) jsonConverter {
+	known := make(map[string]bool)
+	for _, name := range names {
+		known[name] = true
+	}
+	return jsonConverter{
+		func(value reflect.Value) (interface{}, error) {
+			return value.Interface(), nil
+		},
+		func(data json.RawMessage, value reflect.Value) error {
+			if err := json.Unmarshal(data, value.Addr().Interface()); err != nil {
+				return err
+			}
+			for i, n := 0, value.Len(); i < n; i++ {
+				if name := value.Index(i).String(); !known[name] {
+					return fmt.Errorf("unknown value: %q", name)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+var jsonConverterMap map[string]jsonConverter = map[string]jsonConverter{
+	"channelStatus":    channelStatusJSONConverter,
+	"statusBytes":      byteListJSONConverter,
+	"panelButtonModes": nameListJSONConverter(panelButtonModeNames),
+	"remark":           hexBytesJSONConverter,
+	"rawBytes":         hexBytesJSONConverter,
+}
+
+func messageStructValue(message interface{}) (reflect.Value, error) {
+	d := reflect.ValueOf(message)
+	if d.Kind() != reflect.Ptr || d.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, errors.New("message pointer expected")
+	}
+	return d.Elem(), nil
+}
+
+func jsonFieldSkipped(field reflect.StructField) bool {
+	return field.Tag.Get("json") == "-"
+}
+
+// EncodeMessageFields returns JSON object containing
+// the message fields
+func EncodeMessageFields(message interface{}) (json.RawMessage, error) {
+	v, err := messageStructValue(message)
+	if err != nil {
+		return nil, err
+	}
+	t := v.Type()
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	first := true
+	for i, n := 0, t.NumField(); i < n; i++ {
+		field := t.Field(i)
+		if jsonFieldSkipped(field) {
+			continue
+		}
+		var fieldData interface{} = v.Field(i).Interface()
+		if converter, found := jsonConverterMap[field.Tag.Get("sbus")]; found {
+			if fieldData, err = converter.encode(v.Field(i)); err != nil {
+				return nil, fmt.Errorf("%s: %s", field.Name, err)
+			}
+		}
+		bs, err := json.Marshal(fieldData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", field.Name, err)
+		}
+		if !first {
+			buf.WriteString(",")
+		}
+		first = false
+		name, _ := json.Marshal(field.Name)
+		buf.Write(name)
+		buf.WriteString(":")
+		buf.Write(bs)
+	}
+	buf.WriteString("}")
+	return json.RawMessage(buf.Bytes()), nil
+}
+
+// DecodeMessageFields fills in the message fields from JSON object.
+// The fields that are not specified are left intact.
+func DecodeMessageFields(data json.RawMessage, message interface{}) error {
+	v, err := messageStructValue(message)
+	if err != nil {
+		return err
+	}
+	var fieldMap map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fieldMap); err != nil {
+		return err
+	}
+	t := v.Type()
+	for i, n := 0, t.NumField(); i < n; i++ {
+		field := t.Field(i)
+		if jsonFieldSkipped(field) {
+			continue
+		}
+		fieldData, found := fieldMap[field.Name]
+		if !found {
+			continue
+		}
+		delete(fieldMap, field.Name)
+		if converter, found := jsonConverterMap[field.Tag.Get("sbus")]; found {
+			err = converter.decode(fieldData, v.Field(i))
+		} else {
+			err = json.Unmarshal(fieldData, v.Field(i).Addr().Interface())
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", field.Name, err)
+		}
+	}
+	for name := range fieldMap {
+		return fmt.Errorf("unknown field %q", name)
+	}
+	return nil
+}
+
+type jsonMessageHeader struct {
+	OrigSubnetID   uint8  `json:"origSubnet"`
+	OrigDeviceID   uint8  `json:"origDevice"`
+	OrigDeviceType uint16 `json:"origDeviceType"`
+	TargetSubnetID uint8  `json:"targetSubnet"`
+	TargetDeviceID uint8  `json:"targetDevice"`
+}
+
+type jsonSmartbusMessage struct {
+	Opcode *uint16            `json:"opcode,omitempty"`
+	Type   string             `json:"type,omitempty"`
+	Header *jsonMessageHeader `json:"header"`
+	Fields json.RawMessage    `json:"fields,omitempty"`
+}
+
+func (smartbusMsg SmartbusMessage) MarshalJSON() ([]byte, error) {
+	msg, ok := smartbusMsg.Message.(Message)
+	if !ok {
+		return nil, fmt.Errorf("bad message: %#v", smartbusMsg.Message)
+	}
+	fields, err := EncodeMessageFields(msg)
+	if err != nil {
+		return nil, err
+	}
+	opcode := msg.Opcode()
+	header := smartbusMsg.Header
+	return json.Marshal(&jsonSmartbusMessage{
+		Opcode: &opcode,
+		Type:   MessageName(msg),
+		Header: &jsonMessageHeader{
+			OrigSubnetID:   header.OrigSubnetID,
+			OrigDeviceID:   header.OrigDeviceID,
+			OrigDeviceType: header.OrigDeviceType,
+			TargetSubnetID: header.TargetSubnetID,
+			TargetDeviceID: header.TargetDeviceID,
+		},
+		Fields: fields,
+	})
+}
+
+// UnmarshalJSON decodes the message. Either opcode or type
+// must be specified. Messages with unrecognized opcodes
+// are decoded as RawMessage.
+func (smartbusMsg *SmartbusMessage) UnmarshalJSON(data []byte) error {
+	var jsonMsg jsonSmartbusMessage
+	if err := decodeStrict(data, &jsonMsg); err != nil {
+		return err
+	}
+	if jsonMsg.Header == nil {
+		return errors.New("message header not specified")
+	}
+
+	var opcode uint16
+	isRaw := jsonMsg.Type == MessageName(&RawMessage{})
+	switch {
+	case jsonMsg.Type != "" && !isRaw:
+		var found bool
+		if opcode, found = LookupMessageOpcode(jsonMsg.Type); !found {
+			return fmt.Errorf("unknown message type %q", jsonMsg.Type)
+		}
+		if jsonMsg.Opcode != nil && *jsonMsg.Opcode != opcode {
+			return fmt.Errorf("opcode %04x doesn't match message type %s", *jsonMsg.Opcode, jsonMsg.Type)
+		}
+	case jsonMsg.Opcode != nil:
+		opcode = *jsonMsg.Opcode
+	default:
+		return errors.New("neither opcode nor message type specified")
+	}
+
+	var msg Message
+	if !isRaw {
+		msg, _ = NewMessage(opcode)
+	}
+	if msg == nil {
+		msg = &RawMessage{RawOpcode: opcode, Payload: []uint8{}}
+	}
+	if jsonMsg.Fields != nil {
+		if err := DecodeMessageFields(jsonMsg.Fields, msg); err != nil {
+			return fmt.Errorf("%s: %s", MessageName(msg), err)
+		}
+	}
+
+	smartbusMsg.Header = MessageHeader{
+		OrigSubnetID:   jsonMsg.Header.OrigSubnetID,
+		OrigDeviceID:   jsonMsg.Header.OrigDeviceID,
+		OrigDeviceType: jsonMsg.Header.OrigDeviceType,
+		Opcode:         opcode,
+		TargetSubnetID: jsonMsg.Header.TargetSubnetID,
+		TargetDeviceID: jsonMsg.Header.TargetDeviceID,
+	}
+	smartbusMsg.Message = msg
+	return nil
+}
@@ -0,0 +1,145 @@
+package smartbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestMessageJSONRoundTrip(t *testing.T) {
+	for _, mtc := range messageTestCases {
+		data, err := json.Marshal(mtc.SmartbusMessage)
+		if err != nil {
+			t.Fatalf("%s: json.Marshal() failed: %s", mtc.Name, err)
+		}
+		var msg SmartbusMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("%s: json.Unmarshal() failed: %s\n%s", mtc.Name, err, data)
+		}
+		VerifyRead(t, mtc, &msg)
+
+		var buf bytes.Buffer
+		WriteFrame(&buf, msg)
+		VerifyWrite(t, mtc, buf.Bytes())
+	}
+}
+
+func TestMessageJSON(t *testing.T) {
+	for _, item := range []struct {
+		msg  SmartbusMessage
+		json string
+	}{
+		{
+			SmartbusMessage{
+				MessageHeader{
+					OrigSubnetID:   SAMPLE_SUBNET,
+					OrigDeviceID:   SAMPLE_RELAY_DEVICE_ID,
+					OrigDeviceType: SAMPLE_RELAY_DEVICE_TYPE,
+					TargetSubnetID: BROADCAST_SUBNET,
+					TargetDeviceID: BROADCAST_DEVICE,
+				},
+				&SingleChannelControlResponse{7, true, 0, parseChannelStatus("x--x")},
+			},
+			`{"opcode":50,"type":"SingleChannelControlResponse",` +
+				`"header":{"origSubnet":1,"origDevice":28,"origDeviceType":5020,"targetSubnet":255,"targetDevice":255},` +
+				`"fields":{"ChannelNo":7,"Success":true,"Level":0,"ChannelStatus":[true,false,false,true]}}`,
+		},
+		{
+			SmartbusMessage{
+				MessageHeader{
+					OrigSubnetID:   SAMPLE_SUBNET,
+					OrigDeviceID:   SAMPLE_DDP_DEVICE_ID,
+					OrigDeviceType: SAMPLE_DDP_DEVICE_TYPE,
+					TargetSubnetID: SAMPLE_APP_SUBNET,
+					TargetDeviceID: SAMPLE_APP_DEVICE_ID,
+				},
+				&ReadMACAddressResponse{
+					[8]uint8{0x53, 0x03, 0x00, 0x00, 0x00, 0x00, 0x30, 0xc3},
+					[]uint8{0x20, 0x42, 0x42},
+				},
+			},
+			`{"opcode":61444,"type":"ReadMACAddressResponse",` +
+				`"header":{"origSubnet":1,"origDevice":20,"origDeviceType":149,"targetSubnet":3,"targetDevice":254},` +
+				`"fields":{"MAC":[83,3,0,0,0,0,48,195],"Remark":"20 42 42"}}`,
+		},
+		{
+			SmartbusMessage{
+				MessageHeader{
+					OrigSubnetID:   SAMPLE_SUBNET,
+					OrigDeviceID:   SAMPLE_DDP_DEVICE_ID,
+					OrigDeviceType: SAMPLE_DDP_DEVICE_TYPE,
+					TargetSubnetID: SAMPLE_SUBNET,
+					TargetDeviceID: BROADCAST_DEVICE,
+				},
+				&RawMessage{0x0284, []uint8{0x01, 0x14}},
+			},
+			`{"opcode":644,"type":"RawMessage",` +
+				`"header":{"origSubnet":1,"origDevice":20,"origDeviceType":149,"targetSubnet":1,"targetDevice":255},` +
+				`"fields":{"Payload":"01 14"}}`,
+		},
+	} {
+		data, err := json.Marshal(item.msg)
+		if err != nil {
+			t.Fatalf("json.Marshal() failed: %s", err)
+		}
+		assert.Equal(t, item.json, string(data))
+
+		var msg SmartbusMessage
+		if err := json.Unmarshal([]byte(item.json), &msg); err != nil {
+			t.Fatalf("json.Unmarshal() failed: %s", err)
+		}
+		assert.Equal(t, item.msg.Message, msg.Message)
+	}
+}
+
+func TestMessageJSONDecodeByType(t *testing.T) {
+	var msg SmartbusMessage
+	err := json.Unmarshal([]byte(`{"type":"SetPanelButtonModes",`+
+		`"header":{"origSubnet":3,"origDevice":254,"origDeviceType":65534,"targetSubnet":1,"targetDevice":20},`+
+		`"fields":{"Modes":["Invalid","SingleOnOff","Invalid","Invalid","Invalid","Invalid","Invalid","Invalid",`+
+		`"Invalid","Invalid","Invalid","Invalid","Invalid","Invalid","Invalid","LeftOffRightOn"]}}`), &msg)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() failed: %s", err)
+	}
+	assert.Equal(t, uint16(0xe00a), msg.Header.Opcode)
+	assert.Equal(t, &SetPanelButtonModes{[16]string{
+		"Invalid", "SingleOnOff", "Invalid", "Invalid", "Invalid", "Invalid", "Invalid", "Invalid",
+		"Invalid", "Invalid", "Invalid", "Invalid", "Invalid", "Invalid", "Invalid", "LeftOffRightOn",
+	}}, msg.Message)
+
+	// unrecognized opcodes are decoded as raw messages
+	err = json.Unmarshal([]byte(`{"opcode":65280,`+
+		`"header":{"origSubnet":1,"origDevice":20,"origDeviceType":149,"targetSubnet":255,"targetDevice":255}}`), &msg)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() failed: %s", err)
+	}
+	assert.Equal(t, &RawMessage{0xff00, []uint8{}}, msg.Message)
+}
+
+func TestMessageJSONErrors(t *testing.T) {
+	header := `"header":{"origSubnet":1,"origDevice":20,"origDeviceType":149,"targetSubnet":1,"targetDevice":28}`
+	for _, item := range []struct {
+		json     string
+		expected string
+	}{
+		{`{"type":"SingleChannelControlCommand"}`, "header not specified"},
+		{`{` + header + `}`, "neither opcode nor message type specified"},
+		{`{"type":"NoSuchMessage",` + header + `}`, `unknown message type "NoSuchMessage"`},
+		{`{"opcode":50,"type":"SingleChannelControlCommand",` + header + `}`, "doesn't match"},
+		{`{"type":"SingleChannelControlCommand",` + header + `,"fields":{"Channel":1}}`, `unknown field "Channel"`},
+		{`{"type":"SingleChannelControlCommand",` + header + `,"fields":{"Level":1000}}`, "Level:"},
+		{`{"type":"SetPanelButtonModes",` + header + `,"fields":{"Modes":["Foo"]}}`, `unknown value: "Foo"`},
+		{`{"opcode":644,` + header + `,"fields":{"Payload":"zz"}}`, "bad payload"},
+		{`{"opcode":644,` + header + `,"foo":1}`, "foo"},
+	} {
+		var msg SmartbusMessage
+		err := json.Unmarshal([]byte(item.json), &msg)
+		if err == nil {
+			t.Errorf("json.Unmarshal() didn't fail for %s", item.json)
+		} else if !strings.Contains(err.Error(), item.expected) {
+			t.Errorf("error message %q doesn't contain %q", err.Error(), item.expected)
+		}
+	}
+}
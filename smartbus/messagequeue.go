@@ -1,6 +1,7 @@
 package smartbus
 
 import (
+	"errors"
 	"fmt"
 	"github.com/contactless/wbgo"
 	"sync"
@@ -11,112 +12,484 @@ const (
 	MESSAGE_QUEUE_INBOUND_QUEUE_SIZE = 10
 )
 
+// queue item priorities. The items with higher
+// priority are sent before the ones with lower priority,
+// both within the queue of a device and when the queues
+// of different devices compete for the bus.
+const (
+	QUEUE_PRIORITY_BACKGROUND = iota
+	QUEUE_PRIORITY_NORMAL
+	QUEUE_PRIORITY_USER
+)
+
+// the results of waiting in the queue goroutines
+const (
+	waitOK = iota
+	waitAborted
+	waitStopped
+)
+
+// ErrQueueStopped is returned when an item can't be queued
+// or processed because the queue is not running
+var ErrQueueStopped = errors.New("message queue is not running")
+
 type TimerFunc func(d time.Duration) wbgo.Timer
 
 type QueuePred func(msg Message) bool
 
 type QueueItem interface {
 	Run()
-	IsResponse(msg Message) bool
+	IsResponse(msg Message, header *MessageHeader) bool
 	Name() string
+	// Done is called from the queue goroutine with the response
+	// when it's received, or with nil when all the retries have
+	// failed. It's not called if the queue is stopped while
+	// waiting for the response, if the item is removed while
+	// it's being processed (see Remove()) or if the queue doesn't
+	// wait for responses (no timer function). Stop() doesn't wait for
+	// Done() to return, so Done() may block waiting for the
+	// goroutine that stops the queue.
+	Done(response *SmartbusMessage)
+	// Target returns the address of the device the item is
+	// sent to. The items are queued separately per target.
+	Target() (subnetID uint8, deviceID uint8)
+	// Priority returns the priority of the item
+	// (QUEUE_PRIORITY_...)
+	Priority() int
+	// CoalescingKey returns the key used for coalescing
+	// the items. If an item with the same non-empty key
+	// is still waiting in the queue, it's replaced by the
+	// new one and its Done() is never called.
+	CoalescingKey() string
+}
+
+// queuePartition holds the items for a single target device.
+// The items are kept ordered by priority. The items, current
+// and abort fields are guarded by MessageQueue's partMutex.
+// The partition exists only while it has items to process.
+type queuePartition struct {
+	subnetID uint8
+	deviceID uint8
+	items    []QueueItem
+	messages chan *SmartbusMessage
+	// the item being processed, if any, and the
+	// channel that's closed to abort its processing
+	current QueueItem
+	abort   chan struct{}
+}
+
+// accepts returns true if the message may be a response to the
+// items of the partition, i.e. it's sent by the target device
+// or the items are broadcast
+func (part *queuePartition) accepts(header *MessageHeader) bool {
+	return (part.subnetID == BROADCAST_SUBNET || part.subnetID == header.OrigSubnetID) &&
+		(part.deviceID == BROADCAST_DEVICE || part.deviceID == header.OrigDeviceID)
+}
+
+// flush drops the messages received before the item is sent
+// so that they're not taken for the response to the item
+func (part *queuePartition) flush() {
+	for {
+		select {
+		case <-part.messages:
+		default:
+			return
+		}
+	}
 }
 
+// add puts the item into the partition after the items with
+// the same or higher priority, replacing the item with the same
+// coalescing key, if any. It returns false if the partition is full.
+func (part *queuePartition) add(item QueueItem, maxSize int) bool {
+	if key := item.CoalescingKey(); key != "" {
+		for i, queued := range part.items {
+			if queued.CoalescingKey() == key {
+				wbgo.Debug.Printf("MessageQueue: %s replaces the queued one", item.Name())
+				part.items = append(part.items[:i], part.items[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(part.items) >= maxSize {
+		return false
+	}
+	pos := len(part.items)
+	for i, queued := range part.items {
+		if queued.Priority() < item.Priority() {
+			pos = i
+			break
+		}
+	}
+	part.items = append(part.items, nil)
+	copy(part.items[pos+1:], part.items[pos:])
+	part.items[pos] = item
+	return true
+}
+
+// busArbiter grants the bus to the queue partitions one at a
+// time. If the bus is busy, it's granted to the waiting partition
+// with the highest priority item when released, so the user
+// commands don't wait for the background requests to the
+// other devices. The partitions with the same priority get the
+// bus in the order of their arrival.
+type busArbiter struct {
+	sync.Mutex
+	busy    bool
+	waiters []*busWaiter
+}
+
+type busWaiter struct {
+	priority int
+	granted  chan struct{}
+}
+
+// acquire waits for the bus to be granted. It returns waitOK
+// on success or the reason why the waiting was interrupted.
+func (arb *busArbiter) acquire(priority int, quit, abort chan struct{}) int {
+	arb.Lock()
+	if !arb.busy {
+		arb.busy = true
+		arb.Unlock()
+		return waitOK
+	}
+	waiter := &busWaiter{priority, make(chan struct{})}
+	pos := len(arb.waiters)
+	for i, w := range arb.waiters {
+		if w.priority < priority {
+			pos = i
+			break
+		}
+	}
+	arb.waiters = append(arb.waiters, nil)
+	copy(arb.waiters[pos+1:], arb.waiters[pos:])
+	arb.waiters[pos] = waiter
+	arb.Unlock()
+
+	result := waitOK
+	select {
+	case <-waiter.granted:
+		return waitOK
+	case <-quit:
+		result = waitStopped
+	case <-abort:
+		result = waitAborted
+	}
+
+	arb.Lock()
+	defer arb.Unlock()
+	for i, w := range arb.waiters {
+		if w == waiter {
+			arb.waiters = append(arb.waiters[:i], arb.waiters[i+1:]...)
+			return result
+		}
+	}
+	// the bus was granted meanwhile, pass it on
+	arb.grantNext()
+	return result
+}
+
+// release passes the bus to the next waiting partition, if any
+func (arb *busArbiter) release() {
+	arb.Lock()
+	defer arb.Unlock()
+	arb.grantNext()
+}
+
+// grantNext must be called with the arbiter locked
+func (arb *busArbiter) grantNext() {
+	if len(arb.waiters) == 0 {
+		arb.busy = false
+		return
+	}
+	waiter := arb.waiters[0]
+	arb.waiters = arb.waiters[1:]
+	close(waiter.granted)
+}
+
+// next removes the first item from the partition and returns
+// it along with the channel that's closed if the processing
+// of the item is aborted. If there are no items, the partition
+// is removed so that it doesn't keep its goroutine, and nil
+// is returned.
+func (queue *MessageQueue) next(part *queuePartition) (QueueItem, chan struct{}) {
+	queue.partMutex.Lock()
+	defer queue.partMutex.Unlock()
+	part.current, part.abort = nil, nil
+	if len(part.items) == 0 {
+		key := deviceKey(part.subnetID, part.deviceID)
+		if queue.partitions[key] == part {
+			delete(queue.partitions, key)
+		}
+		return nil, nil
+	}
+	part.current = part.items[0]
+	part.abort = make(chan struct{})
+	part.items = part.items[1:]
+	return part.current, part.abort
+}
+
+// finish marks the item being processed as done so that it
+// can't be aborted anymore. It returns false if the item has
+// been aborted meanwhile.
+func (queue *MessageQueue) finish(part *queuePartition, item QueueItem) bool {
+	queue.partMutex.Lock()
+	defer queue.partMutex.Unlock()
+	if part.current != item {
+		return false
+	}
+	part.current, part.abort = nil, nil
+	return true
+}
+
+// MessageQueue sends the requests and waits for the responses,
+// retrying the requests if necessary. The requests to different
+// devices are queued separately so that a device that doesn't
+// respond doesn't block the requests to other devices. The
+// frames sent by the queue are spaced by at least the minimum
+// interval (see SetMinInterval()) to avoid flooding the bus.
+// When several devices' queues have frames to send, the bus
+// goes to the one with the highest priority item first.
 type MessageQueue struct {
+	// the mutex serializes Start() and Stop() calls
 	sync.Mutex
-	active     bool
-	items      chan QueueItem
-	messages   chan Message
-	quit       chan struct{}
-	done       chan struct{}
-	timerFunc  TimerFunc
-	timeout    time.Duration
-	numRetries int
+	// partMutex guards active and partitions fields
+	partMutex   sync.Mutex
+	active      bool
+	partitions  map[uint16]*queuePartition
+	quit        chan struct{}
+	wg          sync.WaitGroup
+	timerFunc   TimerFunc
+	timeout     time.Duration
+	numRetries  int
+	queueSize   int
+	stats       *LinkStats
+	bus         busArbiter
+	minInterval time.Duration
+	// lastSend is guarded by the bus
+	lastSend time.Time
 }
 
+// NewMessageQueue makes a new queue. queueSize is the
+// maximum number of items waiting for each target device.
 func NewMessageQueue(timerFunc TimerFunc, timeout time.Duration, numRetries int, queueSize int) *MessageQueue {
 	return &MessageQueue{
 		active:     false,
-		items:      make(chan QueueItem, queueSize),
-		messages:   make(chan Message, MESSAGE_QUEUE_INBOUND_QUEUE_SIZE),
+		partitions: make(map[uint16]*queuePartition),
 		quit:       nil,
-		done:       make(chan struct{}),
 		timerFunc:  timerFunc,
 		timeout:    timeout,
 		numRetries: numRetries,
+		queueSize:  queueSize,
+	}
+}
+
+// SetLinkStats makes the queue count retries and failed
+// requests using the specified LinkStats. Must be called
+// before Start().
+func (queue *MessageQueue) SetLinkStats(stats *LinkStats) {
+	queue.stats = stats
+}
+
+// SetMinInterval sets the minimum interval between the frames
+// sent by the queue, for all the target devices together.
+// Must be called before Start().
+func (queue *MessageQueue) SetMinInterval(d time.Duration) {
+	queue.minInterval = d
+}
+
+// Depth returns the number of items waiting in the queue.
+// This function is threadsafe.
+func (queue *MessageQueue) Depth() int {
+	queue.partMutex.Lock()
+	defer queue.partMutex.Unlock()
+	n := 0
+	for _, part := range queue.partitions {
+		n += len(part.items)
 	}
+	return n
 }
 
 func (queue *MessageQueue) Start() {
 	queue.Lock()
 	defer queue.Unlock()
+	queue.partMutex.Lock()
+	defer queue.partMutex.Unlock()
 	if queue.active {
 		return
 	}
 	queue.quit = make(chan struct{})
 	queue.active = true
-	// synchronously flush queues before returning
-	queue.flush()
-	go queue.run()
+	// process the items enqueued before Start()
+	// or left from the previous run
+	for _, part := range queue.partitions {
+		queue.startPartition(part)
+	}
 }
 
-func (queue *MessageQueue) flush() {
-flushLoop:
-	for {
-		select {
-		case <-queue.items:
-		case <-queue.messages:
-		default:
-			break flushLoop
+// startPartition starts the goroutine that handles the partition.
+// Must be called with partMutex locked.
+func (queue *MessageQueue) startPartition(part *queuePartition) {
+	queue.wg.Add(1)
+	go queue.run(part, queue.quit)
+}
+
+// partition returns the partition for the specified target
+// device, creating it if necessary. Must be called with
+// partMutex locked.
+func (queue *MessageQueue) partition(subnetID uint8, deviceID uint8) *queuePartition {
+	key := deviceKey(subnetID, deviceID)
+	part, found := queue.partitions[key]
+	if !found {
+		part = &queuePartition{
+			subnetID: subnetID,
+			deviceID: deviceID,
+			messages: make(chan *SmartbusMessage, MESSAGE_QUEUE_INBOUND_QUEUE_SIZE),
+		}
+		queue.partitions[key] = part
+		if queue.active {
+			queue.startPartition(part)
 		}
 	}
+	return part
 }
 
-func (queue *MessageQueue) run() {
-loop:
+// run processes the items of the partition until there are
+// no items left or the queue is stopped
+func (queue *MessageQueue) run(part *queuePartition, quit chan struct{}) {
 	for {
-		select {
-		case <-queue.quit:
-			break loop
-		case <-queue.messages:
-			// no pending item, items messages don't bother us
-		case item := <-queue.items:
-			if !queue.processItem(item) {
-				// quit signalled while waiting for the response
-				break loop
-			}
+		item, abort := queue.next(part)
+		if item == nil {
+			queue.wg.Done()
+			return
+		}
+		response, result := queue.processItem(item, part, quit, abort)
+		if result == waitOK && !queue.finish(part, item) {
+			result = waitAborted
+		}
+		switch {
+		case result == waitStopped:
+			wbgo.Debug.Printf("MessageQueue: stopping the loop for %d:%d", part.subnetID, part.deviceID)
+			queue.wg.Done()
+			return
+		case result == waitAborted:
+			wbgo.Debug.Printf("MessageQueue: %s aborted", item.Name())
+		case queue.timerFunc == nil:
+			// not waiting for the responses
+		case !queue.complete(item, response, quit):
+			// the queue was stopped while Done() was running
+			return
 		}
 	}
-	wbgo.Debug.Printf("MessageQueue: stopping the loop")
-	queue.done <- struct{}{}
 }
 
-func (queue *MessageQueue) processItem(item QueueItem) bool {
+// complete calls Done() for the item. Stop() doesn't wait for
+// the goroutine while it's in Done(), as Done() may block
+// waiting for the goroutine that stops the queue. complete
+// returns false if the queue has been stopped meanwhile.
+func (queue *MessageQueue) complete(item QueueItem, response *SmartbusMessage, quit chan struct{}) bool {
+	queue.wg.Done()
+	item.Done(response)
+	queue.partMutex.Lock()
+	defer queue.partMutex.Unlock()
+	// quit is closed with partMutex locked before
+	// Stop() starts waiting, so it's safe to rejoin
+	// the wait group here if quit is not closed
+	select {
+	case <-quit:
+		return false
+	default:
+		queue.wg.Add(1)
+		return true
+	}
+}
+
+// newTimer makes a timer using the timer function of the
+// queue, or a real timer if there's no timer function
+func (queue *MessageQueue) newTimer(d time.Duration) wbgo.Timer {
+	if queue.timerFunc == nil {
+		return wbgo.NewRealTimer(d)
+	}
+	return queue.timerFunc(d)
+}
+
+// runItem runs the item, waiting for the minimum interval
+// since the previous frame to pass if necessary. It returns
+// waitOK if the item is run or the reason why it's not.
+func (queue *MessageQueue) runItem(item QueueItem, quit, abort chan struct{}) int {
+	if result := queue.bus.acquire(item.Priority(), quit, abort); result != waitOK {
+		return result
+	}
+	defer queue.bus.release()
+	if queue.minInterval > 0 {
+		if d := queue.minInterval - time.Since(queue.lastSend); d > 0 {
+			timer := queue.newTimer(d)
+			select {
+			case <-quit:
+				timer.Stop()
+				return waitStopped
+			case <-abort:
+				timer.Stop()
+				return waitAborted
+			case <-timer.GetChannel():
+			}
+		}
+	}
+	// the quit or the abort may have been
+	// signalled while the bus was being granted
+	select {
+	case <-quit:
+		return waitStopped
+	case <-abort:
+		return waitAborted
+	default:
+	}
 	item.Run()
+	queue.lastSend = time.Now()
+	return waitOK
+}
+
+// processItem runs the item and waits for the response,
+// retrying if necessary. If the item is processed, waitOK is
+// returned along with the response, or nil if no response was
+// received. Otherwise the reason of the interruption is returned.
+func (queue *MessageQueue) processItem(item QueueItem, part *queuePartition, quit, abort chan struct{}) (*SmartbusMessage, int) {
+	part.flush()
+	if result := queue.runItem(item, quit, abort); result != waitOK {
+		return nil, result
+	}
 	if queue.timerFunc == nil {
-		return true
+		return nil, waitOK
 	}
 	timer := queue.timerFunc(queue.timeout)
 	n := queue.numRetries
 	for {
 		select {
-		case <-queue.quit:
+		case <-quit:
 			timer.Stop()
-			return false
+			return nil, waitStopped
+		case <-abort:
+			timer.Stop()
+			return nil, waitAborted
 		case <-timer.GetChannel():
 			if n == 0 {
 				wbgo.Error.Printf(
 					"command failed after %d retries: %s",
 					queue.numRetries, item.Name())
-				return true
+				queue.stats.Count(STATS_FAILURES)
+				return nil, waitOK
 			}
 			n--
+			queue.stats.Count(STATS_RETRIES)
 			wbgo.Warn.Printf("retrying %s (%d attempts left)", item.Name(), n)
-			item.Run()
+			if result := queue.runItem(item, quit, abort); result != waitOK {
+				return nil, result
+			}
 			timer = queue.timerFunc(queue.timeout)
-		case msg := <-queue.messages:
-			if item.IsResponse(msg) {
+		case msg := <-part.messages:
+			if item.IsResponse(msg.Message.(Message), &msg.Header) {
 				timer.Stop()
-				return true
+				return msg, waitOK
 			}
 		}
 	}
@@ -125,27 +498,88 @@ func (queue *MessageQueue) processItem(item QueueItem) bool {
 func (queue *MessageQueue) Stop() {
 	queue.Lock()
 	defer queue.Unlock()
+	queue.partMutex.Lock()
 	if !queue.active {
+		queue.partMutex.Unlock()
 		return
 	}
 	queue.active = false
 	close(queue.quit)
-	<-queue.done
+	queue.partMutex.Unlock()
+	// partMutex must not be held here because the items
+	// being completed may enqueue new ones
+	queue.wg.Wait()
 }
 
-// Enqueue puts item into the queue. If the queue is full, an error is returned.
+// Enqueue puts item into the queue of its target device
+// according to its priority and coalescing key.
+// If the queue is full, an error is returned.
 // This function is threadsafe.
 func (queue *MessageQueue) Enqueue(item QueueItem) error {
-	select {
-	case queue.items <- item:
-		return nil
-	default:
+	queue.partMutex.Lock()
+	defer queue.partMutex.Unlock()
+	if !queue.partition(item.Target()).add(item, queue.queueSize) {
 		return fmt.Errorf("Message queue overflow, dropping request")
 	}
+	return nil
+}
+
+// enqueueRunning is like Enqueue() but fails with ErrQueueStopped
+// if the queue is not running. On success, it returns the channel
+// that's closed when the queue is stopped.
+func (queue *MessageQueue) enqueueRunning(item QueueItem) (chan struct{}, error) {
+	queue.partMutex.Lock()
+	defer queue.partMutex.Unlock()
+	if !queue.active {
+		return nil, ErrQueueStopped
+	}
+	if !queue.partition(item.Target()).add(item, queue.queueSize) {
+		return nil, fmt.Errorf("Message queue overflow, dropping request")
+	}
+	return queue.quit, nil
+}
+
+// Remove removes the item from the queue. If the item is being
+// processed, its processing is aborted and its Done() is not
+// called. It returns false if the item is not found, e.g. it's
+// already completed. This function is threadsafe.
+func (queue *MessageQueue) Remove(item QueueItem) bool {
+	queue.partMutex.Lock()
+	defer queue.partMutex.Unlock()
+	part, found := queue.partitions[deviceKey(item.Target())]
+	if !found {
+		return false
+	}
+	if part.current == item {
+		close(part.abort)
+		part.current, part.abort = nil, nil
+		return true
+	}
+	for i, queued := range part.items {
+		if queued == item {
+			part.items = append(part.items[:i], part.items[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
 // HandleReceivedMessage notifies the queue about the incoming message.
+// The message is dropped if the inbound queue is full, as this
+// function must never block the goroutine that receives the
+// messages: Done() of the item being completed may wait for it.
 // This function is threadsafe.
-func (queue *MessageQueue) HandleReceivedMessage(msg Message) {
-	queue.messages <- msg
+func (queue *MessageQueue) HandleReceivedMessage(msg Message, header *MessageHeader) {
+	queue.partMutex.Lock()
+	defer queue.partMutex.Unlock()
+	for _, part := range queue.partitions {
+		if !part.accepts(header) {
+			continue
+		}
+		select {
+		case part.messages <- &SmartbusMessage{*header, msg}:
+		default:
+			wbgo.Warn.Printf("MessageQueue: inbound queue overflow, dropping message %04x", msg.Opcode())
+		}
+	}
 }
@@ -20,13 +20,18 @@ type FakeQueueItem struct {
 	rec            *testutils.Recorder
 	name           string
 	expectedOpcode uint16
+	deviceID       uint8
+	priority       int
+	key            string
+	// if set, Done() blocks until the channel is closed
+	blockDone chan struct{}
 }
 
 func (item *FakeQueueItem) Run() {
 	item.rec.Rec("RUN: %s", item.name)
 }
 
-func (item *FakeQueueItem) IsResponse(msg Message) bool {
+func (item *FakeQueueItem) IsResponse(msg Message, header *MessageHeader) bool {
 	return item.expectedOpcode == msg.Opcode()
 }
 
@@ -34,6 +39,25 @@ func (item *FakeQueueItem) Name() string {
 	return item.name
 }
 
+func (item *FakeQueueItem) Target() (uint8, uint8) {
+	return 0, item.deviceID
+}
+
+func (item *FakeQueueItem) Priority() int {
+	return item.priority
+}
+
+func (item *FakeQueueItem) CoalescingKey() string {
+	return item.key
+}
+
+func (item *FakeQueueItem) Done(response *SmartbusMessage) {
+	item.rec.Rec("DONE: %s (success=%v)", item.name, response != nil)
+	if item.blockDone != nil {
+		<-item.blockDone
+	}
+}
+
 type MessageQueueSuite struct {
 	testutils.Suite
 	*testutils.FakeTimerFixture
@@ -55,11 +79,29 @@ func (s *MessageQueueSuite) SetupTest() {
 }
 
 func (s *MessageQueueSuite) SendMessage(opcode uint16, name string) error {
-	return s.queue.Enqueue(&FakeQueueItem{s.Recorder, name, opcode})
+	return s.SendMessageTo(0, opcode, name)
+}
+
+func (s *MessageQueueSuite) SendMessageTo(deviceID uint8, opcode uint16, name string) error {
+	return s.Enqueue(&FakeQueueItem{
+		name:           name,
+		expectedOpcode: opcode,
+		deviceID:       deviceID,
+		priority:       QUEUE_PRIORITY_NORMAL,
+	})
+}
+
+func (s *MessageQueueSuite) Enqueue(item *FakeQueueItem) error {
+	item.rec = s.Recorder
+	return s.queue.Enqueue(item)
 }
 
 func (s *MessageQueueSuite) ReceiveMessage(opcode uint16) {
-	s.queue.HandleReceivedMessage(&FakeMessage{opcode})
+	s.ReceiveMessageFrom(0, opcode)
+}
+
+func (s *MessageQueueSuite) ReceiveMessageFrom(deviceID uint8, opcode uint16) {
+	s.queue.HandleReceivedMessage(&FakeMessage{opcode}, &MessageHeader{OrigDeviceID: deviceID})
 }
 
 func (s *MessageQueueSuite) SimulateTimeout(id int) {
@@ -70,7 +112,7 @@ func (s *MessageQueueSuite) TestMessageQueue() {
 	s.SendMessage(42, "forty-two")
 	s.Verify("RUN: forty-two", "new fake timer: 1, 1000")
 	s.ReceiveMessage(42)
-	s.Verify("timer.Stop(): 1")
+	s.Verify("timer.Stop(): 1", "DONE: forty-two (success=true)")
 
 	// these are ignored
 	s.ReceiveMessage(100)
@@ -80,7 +122,7 @@ func (s *MessageQueueSuite) TestMessageQueue() {
 	s.Verify("RUN: forty-three", "new fake timer: 2, 1000")
 	s.ReceiveMessage(111) // must be just skipped
 	s.ReceiveMessage(43)
-	s.Verify("timer.Stop(): 2")
+	s.Verify("timer.Stop(): 2", "DONE: forty-three (success=true)")
 
 	s.queue.Stop()
 }
@@ -91,7 +133,7 @@ func (s *MessageQueueSuite) TestMessageQueueRetries() {
 	s.SimulateTimeout(1)
 	s.Verify("timer.fire(): 1", "RUN: forty-two", "new fake timer: 2, 1000")
 	s.ReceiveMessage(42)
-	s.Verify("timer.Stop(): 2")
+	s.Verify("timer.Stop(): 2", "DONE: forty-two (success=true)")
 	s.EnsureGotWarnings()
 
 	s.SendMessage(43, "forty-three")
@@ -102,10 +144,10 @@ func (s *MessageQueueSuite) TestMessageQueueRetries() {
 
 	s.ReceiveMessage(99) // ignored
 	s.ReceiveMessage(43)
-	s.Verify("timer.Stop(): 4", "RUN: forty-four", "new fake timer: 5, 1000")
+	s.Verify("timer.Stop(): 4", "DONE: forty-three (success=true)", "RUN: forty-four", "new fake timer: 5, 1000")
 	s.EnsureGotWarnings()
 	s.ReceiveMessage(44)
-	s.Verify("timer.Stop(): 5")
+	s.Verify("timer.Stop(): 5", "DONE: forty-four (success=true)")
 
 	s.SendMessage(45, "forty-five")
 	s.SendMessage(46, "forty-six")
@@ -120,10 +162,10 @@ func (s *MessageQueueSuite) TestMessageQueueRetries() {
 	s.EnsureGotWarnings()
 	// failed to perform the operation, go to the next message
 	s.SimulateTimeout(8)
-	s.Verify("timer.fire(): 8", "RUN: forty-six", "new fake timer: 9, 1000")
+	s.Verify("timer.fire(): 8", "DONE: forty-five (success=false)", "RUN: forty-six", "new fake timer: 9, 1000")
 	s.EnsureGotErrors()
 	s.ReceiveMessage(46)
-	s.Verify("timer.Stop(): 9")
+	s.Verify("timer.Stop(): 9", "DONE: forty-six (success=true)")
 
 	s.queue.Stop()
 }
@@ -148,7 +190,7 @@ func (s *MessageQueueSuite) TestMessageQueueOverflow() {
 			s.Verify("RUN: "+name, fmt.Sprintf("new fake timer: %d, 1000", i))
 		}
 		s.ReceiveMessage(uint16(i))
-		s.Verify(fmt.Sprintf("timer.Stop(): %d", i))
+		s.Verify(fmt.Sprintf("timer.Stop(): %d", i), fmt.Sprintf("DONE: %s (success=true)", name))
 	}
 
 	s.queue.Stop()
@@ -162,11 +204,103 @@ func (s *MessageQueueSuite) TestMessageQueueStoppingTimersOnStop() {
 	s.VerifyEmpty()
 }
 
+func (s *MessageQueueSuite) TestMessageQueueStopWhileDone() {
+	release := make(chan struct{})
+	s.Enqueue(&FakeQueueItem{name: "forty-two", expectedOpcode: 42,
+		priority: QUEUE_PRIORITY_NORMAL, blockDone: release})
+	s.SendMessage(43, "forty-three")
+	s.Verify("RUN: forty-two", "new fake timer: 1, 1000")
+	s.ReceiveMessage(42)
+	s.Verify("timer.Stop(): 1", "DONE: forty-two (success=true)")
+
+	// Done() may block waiting for the goroutine that stops
+	// the queue, e.g. the driver goroutine
+	stopped := make(chan struct{})
+	go func() {
+		s.queue.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		s.T().Fatalf("Stop() blocked by Done()")
+	}
+	close(release)
+	s.VerifyEmpty()
+}
+
+func (s *MessageQueueSuite) TestInboundOverflowWhileDone() {
+	release := make(chan struct{})
+	s.Enqueue(&FakeQueueItem{name: "forty-two", expectedOpcode: 42,
+		priority: QUEUE_PRIORITY_NORMAL, blockDone: release})
+	s.SendMessage(43, "forty-three")
+	s.Verify("RUN: forty-two", "new fake timer: 1, 1000")
+	s.ReceiveMessage(42)
+	s.Verify("timer.Stop(): 1", "DONE: forty-two (success=true)")
+
+	// Done() may block waiting for the goroutine that receives
+	// the messages (e.g. via CallSync), so the messages must
+	// not block it when the inbound queue is full
+	received := make(chan struct{})
+	go func() {
+		for i := 0; i < MESSAGE_QUEUE_INBOUND_QUEUE_SIZE*2; i++ {
+			s.ReceiveMessage(43)
+		}
+		close(received)
+	}()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		s.T().Fatalf("HandleReceivedMessage() blocked by Done()")
+	}
+	s.EnsureGotWarnings()
+	close(release)
+
+	// the messages received before the item is sent
+	// are not taken for the response to it
+	s.Verify("RUN: forty-three", "new fake timer: 2, 1000")
+	s.ReceiveMessage(43)
+	s.Verify("timer.Stop(): 2", "DONE: forty-three (success=true)")
+
+	s.queue.Stop()
+}
+
+func (s *MessageQueueSuite) TestIdlePartitionsRemoved() {
+	for i := 1; i <= 3; i++ {
+		s.SendMessageTo(uint8(i), 42, "forty-two")
+		s.Verify("RUN: forty-two", fmt.Sprintf("new fake timer: %d, 1000", i))
+		s.ReceiveMessageFrom(uint8(i), 42)
+		s.Verify(fmt.Sprintf("timer.Stop(): %d", i), "DONE: forty-two (success=true)")
+	}
+
+	// the partitions are removed after Done()
+	// returns, so wait for it to happen
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		s.queue.partMutex.Lock()
+		n := len(s.queue.partitions)
+		s.queue.partMutex.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			s.T().Fatalf("%d idle partitions left", n)
+		}
+	}
+
+	// a new partition is made for the next item
+	s.SendMessageTo(1, 43, "forty-three")
+	s.Verify("RUN: forty-three", "new fake timer: 4, 1000")
+	s.ReceiveMessageFrom(1, 43)
+	s.Verify("timer.Stop(): 4", "DONE: forty-three (success=true)")
+
+	s.queue.Stop()
+}
+
 func (s *MessageQueueSuite) TestMessageQueueRestart() {
 	s.SendMessage(42, "forty-two")
 	s.Verify("RUN: forty-two", "new fake timer: 1, 1000")
 	s.ReceiveMessage(42)
-	s.Verify("timer.Stop(): 1")
+	s.Verify("timer.Stop(): 1", "DONE: forty-two (success=true)")
 
 	s.queue.Stop()
 	s.queue.Start()
@@ -174,7 +308,125 @@ func (s *MessageQueueSuite) TestMessageQueueRestart() {
 	s.SendMessage(43, "forty-three")
 	s.Verify("RUN: forty-three", "new fake timer: 2, 1000")
 	s.ReceiveMessage(43)
-	s.Verify("timer.Stop(): 2")
+	s.Verify("timer.Stop(): 2", "DONE: forty-three (success=true)")
+
+	s.queue.Stop()
+}
+
+func (s *MessageQueueSuite) TestEnqueueBeforeStart() {
+	s.queue.Stop()
+	s.SendMessageTo(1, 42, "forty-two")
+	s.SendMessageTo(1, 43, "forty-three")
+	s.VerifyEmpty()
+
+	s.queue.Start()
+	s.Verify("RUN: forty-two", "new fake timer: 1, 1000")
+	s.ReceiveMessageFrom(1, 42)
+	s.Verify("timer.Stop(): 1", "DONE: forty-two (success=true)", "RUN: forty-three", "new fake timer: 2, 1000")
+	s.ReceiveMessageFrom(1, 43)
+	s.Verify("timer.Stop(): 2", "DONE: forty-three (success=true)")
+
+	s.queue.Stop()
+}
+
+func (s *MessageQueueSuite) TestPerDeviceQueues() {
+	s.SendMessageTo(1, 42, "forty-two")
+	s.Verify("RUN: forty-two", "new fake timer: 1, 1000")
+
+	// device 1 doesn't respond, but device 2 requests are not blocked
+	s.SendMessageTo(2, 43, "forty-three")
+	s.Verify("RUN: forty-three", "new fake timer: 2, 1000")
+	s.ReceiveMessageFrom(2, 43)
+	s.Verify("timer.Stop(): 2", "DONE: forty-three (success=true)")
+	s.Equal(0, s.queue.Depth())
+
+	// the response from device 2 doesn't complete the device 1 request
+	s.ReceiveMessageFrom(2, 42)
+	s.SendMessageTo(1, 44, "forty-four")
+	s.Equal(1, s.queue.Depth())
+	s.SimulateTimeout(1)
+	s.Verify("timer.fire(): 1", "RUN: forty-two", "new fake timer: 3, 1000")
+	s.EnsureGotWarnings()
+	s.ReceiveMessageFrom(1, 42)
+	s.Verify("timer.Stop(): 3", "DONE: forty-two (success=true)", "RUN: forty-four", "new fake timer: 4, 1000")
+	s.Equal(0, s.queue.Depth())
+
+	s.queue.Stop()
+	s.Verify("timer.Stop(): 4")
+}
+
+func (s *MessageQueueSuite) TestPriorities() {
+	s.SendMessage(42, "forty-two")
+	s.Verify("RUN: forty-two", "new fake timer: 1, 1000")
+
+	s.Enqueue(&FakeQueueItem{name: "bg", expectedOpcode: 1, priority: QUEUE_PRIORITY_BACKGROUND})
+	s.SendMessage(43, "forty-three")
+	s.Nil(s.Enqueue(&FakeQueueItem{name: "user", expectedOpcode: 44, priority: QUEUE_PRIORITY_USER}))
+
+	s.ReceiveMessage(42)
+	s.Verify("timer.Stop(): 1", "DONE: forty-two (success=true)", "RUN: user", "new fake timer: 2, 1000")
+	s.ReceiveMessage(44)
+	s.Verify("timer.Stop(): 2", "DONE: user (success=true)", "RUN: forty-three", "new fake timer: 3, 1000")
+	s.ReceiveMessage(43)
+	s.Verify("timer.Stop(): 3", "DONE: forty-three (success=true)", "RUN: bg", "new fake timer: 4, 1000")
+	s.ReceiveMessage(1)
+	s.Verify("timer.Stop(): 4", "DONE: bg (success=true)")
+
+	s.queue.Stop()
+}
+
+func (s *MessageQueueSuite) TestCoalescing() {
+	s.SendMessage(42, "forty-two")
+	s.Verify("RUN: forty-two", "new fake timer: 1, 1000")
+
+	s.Enqueue(&FakeQueueItem{name: "ch1=1", expectedOpcode: 1, key: "ch1"})
+	s.Enqueue(&FakeQueueItem{name: "ch2=1", expectedOpcode: 2, key: "ch2"})
+	s.Enqueue(&FakeQueueItem{name: "ch1=0", expectedOpcode: 1, key: "ch1"})
+	s.Enqueue(&FakeQueueItem{name: "ch1=1", expectedOpcode: 1, key: "ch1"})
+	s.Equal(2, s.queue.Depth())
+
+	s.ReceiveMessage(42)
+	s.Verify("timer.Stop(): 1", "DONE: forty-two (success=true)", "RUN: ch2=1", "new fake timer: 2, 1000")
+	s.ReceiveMessage(2)
+	s.Verify("timer.Stop(): 2", "DONE: ch2=1 (success=true)", "RUN: ch1=1", "new fake timer: 3, 1000")
+	s.ReceiveMessage(1)
+	s.Verify("timer.Stop(): 3", "DONE: ch1=1 (success=true)")
+
+	s.queue.Stop()
+}
+
+func (s *MessageQueueSuite) TestMinInterval() {
+	s.queue.Stop()
+	s.queue = NewMessageQueue(nil, 0, 0, 3)
+	s.queue.SetMinInterval(50 * time.Millisecond)
+	s.queue.Start()
+
+	start := time.Now()
+	s.SendMessageTo(1, 42, "forty-two")
+	s.SendMessageTo(2, 43, "forty-three")
+	s.SendMessageTo(3, 44, "forty-four")
+	s.VerifyUnordered("RUN: forty-two", "RUN: forty-three", "RUN: forty-four")
+	s.True(time.Since(start) >= 100*time.Millisecond)
+
+	s.queue.Stop()
+}
+
+func (s *MessageQueueSuite) TestBusPriorities() {
+	s.queue.Stop()
+	s.queue = NewMessageQueue(nil, 0, 0, 3)
+	s.queue.SetMinInterval(100 * time.Millisecond)
+	s.queue.Start()
+
+	s.Enqueue(&FakeQueueItem{name: "a", deviceID: 1, priority: QUEUE_PRIORITY_BACKGROUND})
+	s.Verify("RUN: a")
+	// b takes the bus and waits for the interval to pass
+	s.Enqueue(&FakeQueueItem{name: "b", deviceID: 2, priority: QUEUE_PRIORITY_BACKGROUND})
+	time.Sleep(20 * time.Millisecond)
+	// the user command to another device gets the bus
+	// before the background request queued earlier
+	s.Enqueue(&FakeQueueItem{name: "c", deviceID: 3, priority: QUEUE_PRIORITY_BACKGROUND})
+	s.Enqueue(&FakeQueueItem{name: "d", deviceID: 4, priority: QUEUE_PRIORITY_USER})
+	s.Verify("RUN: b", "RUN: d", "RUN: c")
 
 	s.queue.Stop()
 }
@@ -182,3 +434,35 @@ func (s *MessageQueueSuite) TestMessageQueueRestart() {
 func TestMessageQueueSuite(t *testing.T) {
 	testutils.RunSuites(t, new(MessageQueueSuite))
 }
+
+func TestRequestCorrelation(t *testing.T) {
+	relay := &SmartbusDevice{SubnetID: SAMPLE_SUBNET, DeviceID: SAMPLE_RELAY_DEVICE_ID}
+	request := newRequest("SingleChannelControl", relay,
+		&SingleChannelControlResponse{ChannelNo: 2}, func() {})
+	relayHeader := &MessageHeader{OrigSubnetID: SAMPLE_SUBNET, OrigDeviceID: SAMPLE_RELAY_DEVICE_ID}
+	otherHeader := &MessageHeader{OrigSubnetID: SAMPLE_SUBNET, OrigDeviceID: SAMPLE_DDP_DEVICE_ID}
+	for _, item := range []struct {
+		msg      Message
+		header   *MessageHeader
+		expected bool
+	}{
+		{&SingleChannelControlResponse{ChannelNo: 2, Success: true}, relayHeader, true},
+		{&SingleChannelControlResponse{ChannelNo: 2, Success: true}, otherHeader, false},
+		{&SingleChannelControlResponse{ChannelNo: 3, Success: true}, relayHeader, false},
+		{&ReadMACAddressResponse{}, relayHeader, false},
+	} {
+		if actual := request.IsResponse(item.msg, item.header); actual != item.expected {
+			t.Errorf("IsResponse(%#v, %#v): %v instead of %v", item.msg, item.header, actual, item.expected)
+		}
+	}
+
+	request = newRequest("AssignPanelButton",
+		&SmartbusDevice{SubnetID: SAMPLE_SUBNET, DeviceID: SAMPLE_DDP_DEVICE_ID},
+		&AssignPanelButtonResponse{ButtonNo: 5, FunctionNo: 1}, func() {})
+	if !request.IsResponse(&AssignPanelButtonResponse{5, 1}, otherHeader) {
+		t.Errorf("AssignPanelButtonResponse not recognized")
+	}
+	if request.IsResponse(&AssignPanelButtonResponse{4, 1}, otherHeader) {
+		t.Errorf("AssignPanelButtonResponse for another button recognized")
+	}
+}
@@ -333,6 +333,35 @@ func (*SensorStatusBroadcast) Opcode() uint16 { return 0x1647 }
 
 // ------
 
+// RawMessage carries a message with an opcode that isn't
+// recognized by the driver. The payload is kept undecoded
+// so the message can be inspected or re-sent as is.
+type RawMessage struct {
+	RawOpcode uint16  `json:"-"`
+	Payload   []uint8 `sbus:"rawBytes"`
+}
+
+type rawMessagePayload struct {
+	Payload []uint8 `sbus:"rawBytes"`
+}
+
+func (msg *RawMessage) Opcode() uint16 { return msg.RawOpcode }
+
+func (msg *RawMessage) FromRaw(parseRaw func(interface{}) error) error {
+	raw := &rawMessagePayload{}
+	if err := parseRaw(raw); err != nil {
+		return err
+	}
+	msg.Payload = raw.Payload
+	return nil
+}
+
+func (msg *RawMessage) ToRaw() (interface{}, error) {
+	return &rawMessagePayload{msg.Payload}, nil
+}
+
+// ------
+
 func init() {
 	RegisterMessage(new(*SingleChannelControlCommand))
 	RegisterMessage(new(*SingleChannelControlResponse))
@@ -0,0 +1,107 @@
+package smartbus
+
+import (
+	"encoding/json"
+	"github.com/contactless/wbgo"
+	"time"
+)
+
+const (
+	MIRROR_DIRECTION_IN    = "in"    // messages for the driver
+	MIRROR_DIRECTION_OTHER = "other" // messages for other devices
+	MIRROR_DIRECTION_OUT   = "out"   // outgoing messages
+)
+
+type mirrorDocument struct {
+	Time      string          `json:"time"`
+	Direction string          `json:"direction"`
+	Message   SmartbusMessage `json:"message"`
+}
+
+// TrafficMirror publishes the messages seen on the bus
+// to MQTT as JSON documents
+type TrafficMirror struct {
+	client    wbgo.MQTTClient
+	topic     string
+	addresses []AddressRange
+	opcodes   map[uint16]bool
+	timeFunc  func() time.Time
+}
+
+func NewTrafficMirror(config *MirrorConfig, topic string, client wbgo.MQTTClient) *TrafficMirror {
+	mirror := &TrafficMirror{
+		client:    client,
+		topic:     topic,
+		addresses: config.Addresses,
+		timeFunc:  time.Now,
+	}
+	if len(config.Opcodes) > 0 {
+		mirror.opcodes = make(map[uint16]bool)
+		for _, opcode := range config.Opcodes {
+			mirror.opcodes[uint16(opcode)] = true
+		}
+	}
+	return mirror
+}
+
+// SetTimeFunc sets the function that is used to obtain
+// message timestamps
+func (mirror *TrafficMirror) SetTimeFunc(timeFunc func() time.Time) {
+	mirror.timeFunc = timeFunc
+}
+
+// Attach makes the mirror observe all the traffic seen by the endpoint
+func (mirror *TrafficMirror) Attach(ep *SmartbusEndpoint) {
+	ep.Observe(&mirrorObserver{mirror, MIRROR_DIRECTION_IN})
+	ep.AddInputSniffer(&mirrorObserver{mirror, MIRROR_DIRECTION_OTHER})
+	ep.AddOutputSniffer(&mirrorObserver{mirror, MIRROR_DIRECTION_OUT})
+}
+
+// AttachOutput makes the mirror observe the messages sent
+// by the endpoint. It's used for the extra endpoints of
+// the driver, as the messages they receive are also seen
+// by the main one.
+func (mirror *TrafficMirror) AttachOutput(ep *SmartbusEndpoint) {
+	ep.AddOutputSniffer(&mirrorObserver{mirror, MIRROR_DIRECTION_OUT})
+}
+
+func (mirror *TrafficMirror) matches(msg Message, header *MessageHeader) bool {
+	if mirror.opcodes != nil && !mirror.opcodes[msg.Opcode()] {
+		return false
+	}
+	if len(mirror.addresses) == 0 {
+		return true
+	}
+	for _, r := range mirror.addresses {
+		if r.Contains(header.OrigSubnetID, header.OrigDeviceID) ||
+			r.Contains(header.TargetSubnetID, header.TargetDeviceID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mirror *TrafficMirror) publish(direction string, msg Message, header *MessageHeader) {
+	if !mirror.matches(msg, header) {
+		return
+	}
+	bs, err := json.Marshal(&mirrorDocument{
+		Time:      mirror.timeFunc().UTC().Format(time.RFC3339Nano),
+		Direction: direction,
+		Message:   SmartbusMessage{*header, msg},
+	})
+	if err != nil {
+		wbgo.Error.Printf("failed to encode mirrored message: %s", err)
+		return
+	}
+	mirror.client.Publish(wbgo.MQTTMessage{mirror.topic, string(bs), 0, false})
+}
+
+type mirrorObserver struct {
+	mirror    *TrafficMirror
+	direction string
+}
+
+func (observer *mirrorObserver) OnAnything(msg Message, header *MessageHeader) {
+	observer.mirror.publish(observer.direction, msg, header)
+}
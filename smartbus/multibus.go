@@ -0,0 +1,51 @@
+package smartbus
+
+import (
+	"github.com/contactless/wbgo"
+)
+
+// MultiBusModel combines the models of several buses
+// so that they can be served by a single driver
+type MultiBusModel struct {
+	wbgo.ModelBase
+	models []*SmartbusModel
+}
+
+func NewMultiBusModel(models ...*SmartbusModel) *MultiBusModel {
+	return &MultiBusModel{models: models}
+}
+
+func (model *MultiBusModel) Models() []*SmartbusModel {
+	return model.models
+}
+
+func (model *MultiBusModel) Observe(observer wbgo.ModelObserver) {
+	model.ModelBase.Observe(observer)
+	for _, busModel := range model.models {
+		busModel.Observe(observer)
+	}
+}
+
+func (model *MultiBusModel) Start() error {
+	for i, busModel := range model.models {
+		if err := busModel.Start(); err != nil {
+			for _, startedModel := range model.models[:i] {
+				startedModel.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (model *MultiBusModel) Stop() {
+	for _, busModel := range model.models {
+		busModel.Stop()
+	}
+}
+
+func (model *MultiBusModel) Poll() {
+	for _, busModel := range model.models {
+		busModel.Poll()
+	}
+}
@@ -0,0 +1,219 @@
+package smartbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+const (
+	PCAP_MAGIC         = 0xa1b2c3d4
+	PCAP_VERSION_MAJOR = 2
+	PCAP_VERSION_MINOR = 4
+	PCAP_SNAPLEN       = 65535
+	PCAP_HEADER_SIZE   = 24
+	// frames are written with the sync bytes
+	LINKTYPE_USER0 = 147
+	// frames are written as SMARTCLOUD UDP packets
+	LINKTYPE_RAW = 101
+
+	CAPTURE_FORMAT_TEXT     = "text"
+	CAPTURE_FORMAT_PCAP     = "pcap"
+	CAPTURE_FORMAT_PCAP_UDP = "pcap-udp"
+)
+
+// the addresses used for UDP encapsulation
+var (
+	pcapDriverIP = net.IPv4(10, 0, 0, 1).To4()
+	pcapBusIP    = net.IPv4(10, 0, 0, 2).To4()
+)
+
+type pcapFileHeader struct {
+	Magic        uint32
+	VersionMajor uint16
+	VersionMinor uint16
+	ThisZone     int32
+	SigFigs      uint32
+	SnapLen      uint32
+	LinkType     uint32
+}
+
+type pcapRecordHeader struct {
+	Seconds      uint32
+	Microseconds uint32
+	CapturedLen  uint32
+	OriginalLen  uint32
+}
+
+// PcapWriter writes the frames to a pcap file that can
+// be opened in Wireshark. The frames are written either
+// as is, using the user link type (DLT_USER0), or
+// encapsulated in SMARTCLOUD UDP packets like the
+// ones handled by DatagramIO. In the latter case the
+// direction is reflected by the source and destination
+// addresses, 10.0.0.1 being the driver.
+type PcapWriter struct {
+	writer io.WriteCloser
+	udp    bool
+}
+
+// NewPcapWriter creates a pcap writer. If writeHeader
+// is false, the file header is not written, which
+// is used for appending to existing files.
+func NewPcapWriter(writer io.WriteCloser, udp bool, writeHeader bool) (*PcapWriter, error) {
+	pcapWriter := &PcapWriter{writer, udp}
+	if writeHeader {
+		header := pcapFileHeader{
+			Magic:        PCAP_MAGIC,
+			VersionMajor: PCAP_VERSION_MAJOR,
+			VersionMinor: PCAP_VERSION_MINOR,
+			SnapLen:      PCAP_SNAPLEN,
+			LinkType:     pcapWriter.linkType(),
+		}
+		if err := binary.Write(writer, binary.LittleEndian, &header); err != nil {
+			return nil, err
+		}
+	}
+	return pcapWriter, nil
+}
+
+func (pcapWriter *PcapWriter) linkType() uint32 {
+	if pcapWriter.udp {
+		return LINKTYPE_RAW
+	}
+	return LINKTYPE_USER0
+}
+
+func (pcapWriter *PcapWriter) RecordFrame(frame *CapturedFrame) error {
+	var packet []byte
+	if pcapWriter.udp {
+		packet = udpEncapsulate(frame)
+	} else {
+		packet = append([]byte{0xaa, 0xaa}, frame.Frame...)
+	}
+	var buf bytes.Buffer
+	// the record is written at once so that
+	// the file isn't broken if the write fails
+	binary.Write(&buf, binary.LittleEndian, &pcapRecordHeader{
+		Seconds:      uint32(frame.Time.Unix()),
+		Microseconds: uint32(frame.Time.Nanosecond() / 1000),
+		CapturedLen:  uint32(len(packet)),
+		OriginalLen:  uint32(len(packet)),
+	})
+	buf.Write(packet)
+	_, err := pcapWriter.writer.Write(buf.Bytes())
+	return err
+}
+
+func (pcapWriter *PcapWriter) Close() error {
+	return pcapWriter.writer.Close()
+}
+
+// udpEncapsulate makes an IPv4 packet containing SMARTCLOUD
+// UDP datagram with the frame
+func udpEncapsulate(frame *CapturedFrame) []byte {
+	srcIP, dstIP := pcapBusIP, pcapDriverIP
+	if frame.Direction == CAPTURE_DIRECTION_OUT {
+		srcIP, dstIP = pcapDriverIP, pcapBusIP
+	}
+
+	var payload bytes.Buffer
+	payload.Write(srcIP)
+	payload.Write(udpSignature[:len(udpSignature)-2])
+	WritePreBuiltFrame(&payload, frame.Frame)
+
+	var packet bytes.Buffer
+	ipHeader := []byte{
+		0x45, 0x00, 0x00, 0x00, // version, IHL, TOS, total length
+		0x00, 0x00, 0x40, 0x00, // id, flags (DF), fragment offset
+		0x40, 0x11, 0x00, 0x00, // TTL, protocol (UDP), checksum
+	}
+	binary.BigEndian.PutUint16(ipHeader[2:], uint16(20+8+payload.Len()))
+	ipHeader = append(ipHeader, srcIP...)
+	ipHeader = append(ipHeader, dstIP...)
+	binary.BigEndian.PutUint16(ipHeader[10:], ipChecksum(ipHeader))
+	packet.Write(ipHeader)
+	// the checksum is optional for UDP over IPv4
+	binary.Write(&packet, binary.BigEndian, []uint16{
+		SmartbusPort, SmartbusPort, uint16(8 + payload.Len()), 0,
+	})
+	packet.Write(payload.Bytes())
+	return packet.Bytes()
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// CreatePcapFile opens the pcap file for appending, creating
+// it if necessary. Appending to the file with a different
+// link type is an error.
+func CreatePcapFile(path string, udp bool) (*PcapWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var header pcapFileHeader
+	err = binary.Read(f, binary.LittleEndian, &header)
+	switch {
+	case err == io.EOF:
+		pcapWriter, err := NewPcapWriter(f, udp, true)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return pcapWriter, nil
+	case err != nil:
+		f.Close()
+		return nil, fmt.Errorf("%s: bad pcap file: %s", path, err)
+	}
+	pcapWriter, _ := NewPcapWriter(f, udp, false)
+	if header.Magic != PCAP_MAGIC || header.LinkType != pcapWriter.linkType() {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a pcap file or link type mismatch", path)
+	}
+	return pcapWriter, nil
+}
+
+// CreateCaptureRecorder opens the capture file in
+// the specified format for appending
+func CreateCaptureRecorder(path string, format string) (FrameRecorder, error) {
+	switch format {
+	case CAPTURE_FORMAT_TEXT:
+		return CreateCaptureFile(path)
+	case CAPTURE_FORMAT_PCAP:
+		return CreatePcapFile(path, false)
+	case CAPTURE_FORMAT_PCAP_UDP:
+		return CreatePcapFile(path, true)
+	default:
+		return nil, fmt.Errorf("unknown capture format %q", format)
+	}
+}
+
+// ConvertCapture converts the text capture to pcap format
+func ConvertCapture(reader io.Reader, writer io.WriteCloser, udp bool) error {
+	frames, err := ReadCapture(reader)
+	if err != nil {
+		return err
+	}
+	pcapWriter, err := NewPcapWriter(writer, udp, true)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if err := pcapWriter.RecordFrame(frame); err != nil {
+			return err
+		}
+	}
+	return pcapWriter.Close()
+}
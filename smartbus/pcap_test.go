@@ -0,0 +1,121 @@
+package smartbus
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pcapSampleFrame = &CapturedFrame{
+	Time:      time.Date(2015, 1, 25, 9, 9, 20, 500000000, time.UTC),
+	Direction: CAPTURE_DIRECTION_OUT,
+	Frame: []byte{
+		0x0f, 0x03, 0xfe, 0xff, 0xfe, 0x00, 0x31, 0x01,
+		0x1c, 0x02, 0x64, 0x00, 0x00, 0x2e, 0x6b,
+	},
+}
+
+func TestPcapWriter(t *testing.T) {
+	buf := &captureBuffer{}
+	pcapWriter, err := NewPcapWriter(buf, false, true)
+	if err != nil {
+		t.Fatalf("NewPcapWriter(): %s", err)
+	}
+	if err := pcapWriter.RecordFrame(pcapSampleFrame); err != nil {
+		t.Fatalf("RecordFrame(): %s", err)
+	}
+	pcapWriter.Close()
+	assert.True(t, buf.closed)
+
+	expected := []byte{
+		// file header
+		0xd4, 0xc3, 0xb2, 0xa1, 0x02, 0x00, 0x04, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xff, 0xff, 0x00, 0x00, 0x93, 0x00, 0x00, 0x00,
+		// record header
+		0xc0, 0xb2, 0xc4, 0x54, 0x20, 0xa1, 0x07, 0x00,
+		0x11, 0x00, 0x00, 0x00, 0x11, 0x00, 0x00, 0x00,
+		// frame
+		0xaa, 0xaa,
+	}
+	expected = append(expected, pcapSampleFrame.Frame...)
+	assert.Equal(t, expected, buf.Bytes())
+}
+
+func TestPcapUDPEncapsulation(t *testing.T) {
+	packet := udpEncapsulate(pcapSampleFrame)
+	payloadLen := 4 + len(udpSignature) + len(pcapSampleFrame.Frame)
+	if len(packet) != 20+8+payloadLen {
+		t.Fatalf("bad packet length %d", len(packet))
+	}
+	assert.Equal(t, uint16(0), ipChecksum(packet[:20]), "bad IP header checksum")
+	assert.Equal(t, []byte{10, 0, 0, 1, 10, 0, 0, 2}, packet[12:20])
+	assert.Equal(t, uint16(SmartbusPort), binary.BigEndian.Uint16(packet[20:]))
+	assert.Equal(t, uint16(SmartbusPort), binary.BigEndian.Uint16(packet[22:]))
+	assert.Equal(t, uint16(8+payloadLen), binary.BigEndian.Uint16(packet[24:]))
+	payload := packet[28:]
+	assert.Equal(t, []byte{10, 0, 0, 1}, payload[:4])
+	assert.Equal(t, udpSignature, payload[4:4+len(udpSignature)])
+	assert.Equal(t, pcapSampleFrame.Frame, payload[4+len(udpSignature):])
+}
+
+func TestCreatePcapFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartbus-pcap")
+	if err != nil {
+		t.Fatalf("TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.pcap")
+
+	// the header is written only once
+	for i := 0; i < 2; i++ {
+		recorder, err := CreateCaptureRecorder(path, CAPTURE_FORMAT_PCAP_UDP)
+		if err != nil {
+			t.Fatalf("CreateCaptureRecorder(): %s", err)
+		}
+		if err := recorder.RecordFrame(pcapSampleFrame); err != nil {
+			t.Fatalf("RecordFrame(): %s", err)
+		}
+		recorder.Close()
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(): %s", err)
+	}
+	recordSize := 16 + len(udpEncapsulate(pcapSampleFrame))
+	assert.Equal(t, PCAP_HEADER_SIZE+2*recordSize, len(data))
+	assert.Equal(t, uint32(LINKTYPE_RAW), binary.LittleEndian.Uint32(data[20:]))
+
+	if _, err := CreateCaptureRecorder(path, CAPTURE_FORMAT_PCAP); err == nil {
+		t.Errorf("no error for link type mismatch")
+	}
+
+	if _, err := CreateCaptureRecorder(path, "foo"); err == nil {
+		t.Errorf("no error for unknown capture format")
+	}
+}
+
+func TestConvertCapture(t *testing.T) {
+	capture := "2015-01-25T09:09:20.5Z out 0f 03 fe ff fe 00 31 01 1c 02 64 00 00 2e 6b\n" +
+		"2015-01-25T09:09:21Z in 10 01 1c 13 9c 00 32 03 fe 02 f8 64 02 02 47 c2\n"
+	buf := &captureBuffer{}
+	if err := ConvertCapture(strings.NewReader(capture), buf, false); err != nil {
+		t.Fatalf("ConvertCapture(): %s", err)
+	}
+	assert.True(t, buf.closed)
+	data := buf.Bytes()
+	assert.Equal(t, PCAP_HEADER_SIZE+16+17+16+18, len(data))
+	assert.Equal(t, []byte{
+		0xaa, 0xaa, 0x10, 0x01, 0x1c, 0x13, 0x9c, 0x00, 0x32,
+		0x03, 0xfe, 0x02, 0xf8, 0x64, 0x02, 0x02, 0x47, 0xc2,
+	}, data[len(data)-18:])
+
+	if err := ConvertCapture(strings.NewReader("foo"), &captureBuffer{}, false); err == nil {
+		t.Errorf("no error for bad capture")
+	}
+}
@@ -0,0 +1,195 @@
+package smartbus
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OpcodeSpec is an opcode specified in JSON either as a number,
+// a hex string ("0x0031") or the name of a registered
+// message type ("SingleChannelControlCommand")
+type OpcodeSpec uint16
+
+func (spec *OpcodeSpec) UnmarshalJSON(data []byte) error {
+	var n uint16
+	if err := json.Unmarshal(data, &n); err == nil {
+		*spec = OpcodeSpec(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("bad opcode: %s", data)
+	}
+	opcode, err := parseOpcodeString(s)
+	if err != nil {
+		return err
+	}
+	*spec = OpcodeSpec(opcode)
+	return nil
+}
+
+// parseOpcodeString parses an opcode specified either as
+// a hex string ("0x0031") or a message type name
+func parseOpcodeString(s string) (uint16, error) {
+	if opcode, found := LookupMessageOpcode(s); found {
+		return opcode, nil
+	}
+	if strings.HasPrefix(s, "0x") {
+		if n, err := strconv.ParseUint(s[2:], 16, 16); err == nil {
+			return uint16(n), nil
+		}
+	}
+	return 0, fmt.Errorf("bad opcode: %q", s)
+}
+
+// ParseOpcode parses an opcode specified as a decimal number,
+// a hex string ("0x0031") or a message type name
+func ParseOpcode(s string) (uint16, error) {
+	if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return uint16(n), nil
+	}
+	return parseOpcodeString(s)
+}
+
+// RawCommand is a request to send an arbitrary message.
+// The message body is specified either as Fields (for
+// the registered message types) or as hex Payload.
+// If Response is specified, the command is sent via the
+// request queue and retried until the response arrives.
+type RawCommand struct {
+	SubnetID *uint8          `json:"subnet"`
+	DeviceID *uint8          `json:"device"`
+	Opcode   *OpcodeSpec     `json:"opcode"`
+	Fields   json.RawMessage `json:"fields"`
+	Payload  *string         `json:"payload"`
+	Response *OpcodeSpec     `json:"response"`
+}
+
+// RawResponse is the reply to RawCommand
+type RawResponse struct {
+	SubnetID   uint8           `json:"subnet"`
+	DeviceID   uint8           `json:"device"`
+	DeviceType uint16          `json:"deviceType"`
+	Opcode     uint16          `json:"opcode"`
+	Message    string          `json:"message,omitempty"`
+	Fields     json.RawMessage `json:"fields,omitempty"`
+	Payload    string          `json:"payload,omitempty"`
+}
+
+func ParseRawCommand(data []byte) (*RawCommand, error) {
+	cmd := &RawCommand{}
+	if err := decodeStrict(data, cmd); err != nil {
+		return nil, err
+	}
+	switch {
+	case cmd.SubnetID == nil:
+		return nil, errors.New("subnet not specified")
+	case cmd.DeviceID == nil:
+		return nil, errors.New("device not specified")
+	case cmd.Opcode == nil:
+		return nil, errors.New("opcode not specified")
+	case cmd.Fields != nil && cmd.Payload != nil:
+		return nil, errors.New("fields and payload cannot be specified together")
+	}
+	return cmd, nil
+}
+
+// Message builds the message to send
+func (cmd *RawCommand) Message() (Message, error) {
+	opcode := uint16(*cmd.Opcode)
+	if cmd.Payload != nil {
+		payload, err := parseHexBytes(*cmd.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return &RawMessage{opcode, payload}, nil
+	}
+
+	msg, found := NewMessage(opcode)
+	if !found {
+		if cmd.Fields != nil {
+			return nil, fmt.Errorf("opcode %04x is not recognized, use payload instead of fields", opcode)
+		}
+		return &RawMessage{opcode, []uint8{}}, nil
+	}
+	if cmd.Fields != nil {
+		if err := DecodeMessageFields(cmd.Fields, msg); err != nil {
+			return nil, fmt.Errorf("bad fields: %s", err)
+		}
+	}
+	return msg, nil
+}
+
+// IsResponse returns true if the message is
+// the response to the command
+func (cmd *RawCommand) IsResponse(msg Message, header *MessageHeader) bool {
+	if cmd.Response == nil || msg.Opcode() != uint16(*cmd.Response) {
+		return false
+	}
+	return (*cmd.SubnetID == BROADCAST_SUBNET || *cmd.SubnetID == header.OrigSubnetID) &&
+		(*cmd.DeviceID == BROADCAST_DEVICE || *cmd.DeviceID == header.OrigDeviceID)
+}
+
+func NewRawResponse(msg Message, header *MessageHeader) (*RawResponse, error) {
+	resp := &RawResponse{
+		SubnetID:   header.OrigSubnetID,
+		DeviceID:   header.OrigDeviceID,
+		DeviceType: header.OrigDeviceType,
+		Opcode:     msg.Opcode(),
+	}
+	if rawMsg, ok := msg.(*RawMessage); ok {
+		resp.Payload = formatHexBytes(rawMsg.Payload)
+	} else {
+		fields, err := EncodeMessageFields(msg)
+		if err != nil {
+			return nil, err
+		}
+		resp.Message = MessageName(msg)
+		resp.Fields = fields
+	}
+	return resp, nil
+}
+
+func (resp *RawResponse) String() string {
+	bs, err := json.Marshal(resp)
+	if err != nil {
+		// shouldn't happen
+		panic(fmt.Sprintf("failed to marshal raw response: %s", err))
+	}
+	return string(bs)
+}
+
+func rawErrorResponse(err error) string {
+	bs, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return string(bs)
+}
+
+func parseHexBytes(s string) ([]uint8, error) {
+	s = strings.Map(func(r rune) rune {
+		if r == ' ' || r == ':' {
+			return -1
+		}
+		return r
+	}, s)
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad payload: %s", err)
+	}
+	return bs, nil
+}
+
+func formatHexBytes(bs []uint8) string {
+	var buf bytes.Buffer
+	for i, b := range bs {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&buf, "%02x", b)
+	}
+	return buf.String()
+}
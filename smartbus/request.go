@@ -0,0 +1,259 @@
+package smartbus
+
+import (
+	"context"
+	"errors"
+	"github.com/contactless/wbgo"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_REQUEST_RETRIES = 2
+)
+
+// ErrNoResponse is returned by SmartbusDevice.Request()
+// if the device didn't respond after all the retries
+var ErrNoResponse = errors.New("no response")
+
+// RequestPolicy specifies the response timeout and the number
+// of retries for SmartbusDevice.Request(). TimerFunc is used
+// to make the timeout timers, real timers are used if it's nil.
+type RequestPolicy struct {
+	Timeout   time.Duration
+	Retries   int
+	TimerFunc TimerFunc
+}
+
+func DefaultRequestPolicy() RequestPolicy {
+	return RequestPolicy{Timeout: REQUEST_TIMEOUT, Retries: DEFAULT_REQUEST_RETRIES}
+}
+
+func (policy *RequestPolicy) newTimer() wbgo.Timer {
+	if policy.TimerFunc == nil {
+		return wbgo.NewRealTimer(policy.Timeout)
+	}
+	return policy.TimerFunc(policy.Timeout)
+}
+
+// responseWaiter receives the response to a request
+// made with SmartbusDevice.Request()
+type responseWaiter struct {
+	subnetID uint8
+	deviceID uint8
+	opcode   uint16
+	key      string
+	ch       chan *SmartbusMessage
+}
+
+// responseWaiters keeps the requests of an endpoint
+// that are waiting for the responses
+type responseWaiters struct {
+	sync.Mutex
+	policy  RequestPolicy
+	queue   *MessageQueue
+	waiters map[*responseWaiter]bool
+}
+
+func newResponseWaiters() *responseWaiters {
+	return &responseWaiters{
+		policy:  DefaultRequestPolicy(),
+		waiters: make(map[*responseWaiter]bool),
+	}
+}
+
+func (rw *responseWaiters) requestPolicy() RequestPolicy {
+	rw.Lock()
+	defer rw.Unlock()
+	return rw.policy
+}
+
+func (rw *responseWaiters) setRequestPolicy(policy RequestPolicy) {
+	rw.Lock()
+	defer rw.Unlock()
+	rw.policy = policy
+}
+
+func (rw *responseWaiters) requestQueue() *MessageQueue {
+	rw.Lock()
+	defer rw.Unlock()
+	return rw.queue
+}
+
+func (rw *responseWaiters) setRequestQueue(queue *MessageQueue) {
+	rw.Lock()
+	defer rw.Unlock()
+	rw.queue = queue
+}
+
+func (rw *responseWaiters) add(waiter *responseWaiter) {
+	rw.Lock()
+	defer rw.Unlock()
+	rw.waiters[waiter] = true
+}
+
+func (rw *responseWaiters) remove(waiter *responseWaiter) {
+	rw.Lock()
+	defer rw.Unlock()
+	delete(rw.waiters, waiter)
+}
+
+// deliver passes the message to the waiters
+// for which it's the expected response
+func (rw *responseWaiters) deliver(smartbusMsg *SmartbusMessage) {
+	rw.Lock()
+	defer rw.Unlock()
+	msg := smartbusMsg.Message.(Message)
+	for waiter := range rw.waiters {
+		if !matchResponse(msg, &smartbusMsg.Header, waiter.subnetID, waiter.deviceID, waiter.opcode, waiter.key) {
+			continue
+		}
+		select {
+		case waiter.ch <- smartbusMsg:
+		default:
+			// the waiter has already got its response
+		}
+	}
+}
+
+// SetRequestPolicy sets the policy used by Request() calls
+// for the devices of the endpoint
+func (ep *SmartbusEndpoint) SetRequestPolicy(policy RequestPolicy) {
+	ep.responseWaiters.setRequestPolicy(policy)
+}
+
+// SetRequestQueue makes Request() calls for the devices of the
+// endpoint go through the queue, so that they're serialized with
+// the other requests to the same device and rate limited along
+// with the rest of the queue. The timeout and the retries of the
+// queue are used instead of the request policy then. If the queue
+// doesn't wait for the responses (no timer function), Request()
+// waits for the response until the context is done.
+func (ep *SmartbusEndpoint) SetRequestQueue(queue *MessageQueue) {
+	ep.responseWaiters.setRequestQueue(queue)
+}
+
+// queuedRequest is the queue item for a Request() call
+// made for an endpoint that has a request queue
+type queuedRequest struct {
+	dev    *SmartbusDevice
+	msg    Message
+	waiter *responseWaiter
+	failed chan struct{}
+}
+
+func (item *queuedRequest) Run() {
+	item.dev.Send(item.msg)
+}
+
+func (item *queuedRequest) IsResponse(msg Message, header *MessageHeader) bool {
+	waiter := item.waiter
+	return matchResponse(msg, header, waiter.subnetID, waiter.deviceID, waiter.opcode, waiter.key)
+}
+
+func (item *queuedRequest) Name() string {
+	return MessageName(item.msg)
+}
+
+// Done reports the failure to the waiting Request() call.
+// The response itself is delivered via the waiter.
+func (item *queuedRequest) Done(response *SmartbusMessage) {
+	if response == nil {
+		close(item.failed)
+	}
+}
+
+func (item *queuedRequest) Target() (uint8, uint8) {
+	return item.dev.SubnetID, item.dev.DeviceID
+}
+
+func (item *queuedRequest) Priority() int {
+	return QUEUE_PRIORITY_NORMAL
+}
+
+func (item *queuedRequest) CoalescingKey() string {
+	return ""
+}
+
+// Request sends the message to the device and waits for the
+// response, which is expected to have the opcode following the
+// one of the request as usual for Smart-Bus. See RequestOpcode().
+func (dev *SmartbusDevice) Request(ctx context.Context, msg Message) (Message, error) {
+	return dev.RequestOpcode(ctx, msg, msg.Opcode()+1)
+}
+
+// RequestOpcode sends the message to the device and waits for
+// the response with the specified opcode. The response must be
+// sent by the device, unless it's a broadcast one, and its key
+// fields such as the channel number must match the request.
+// The request is retried according to the request policy of
+// the endpoint. ErrNoResponse is returned if there's no response
+// after all the retries, and the context error is returned if
+// the context is cancelled or its deadline is exceeded.
+// If the endpoint has a request queue (see SetRequestQueue()),
+// the request is sent via the queue, and ErrQueueStopped is
+// returned if the queue is not running.
+// This function is threadsafe.
+func (dev *SmartbusDevice) RequestOpcode(ctx context.Context, msg Message, responseOpcode uint16) (Message, error) {
+	rw := dev.Endpoint.responseWaiters
+	waiter := &responseWaiter{
+		subnetID: dev.SubnetID,
+		deviceID: dev.DeviceID,
+		opcode:   responseOpcode,
+		key:      requestKey(msg),
+		ch:       make(chan *SmartbusMessage, 1),
+	}
+	rw.add(waiter)
+	defer rw.remove(waiter)
+
+	if queue := rw.requestQueue(); queue != nil {
+		return dev.queueRequest(ctx, queue, msg, waiter)
+	}
+
+	policy := rw.requestPolicy()
+	for n := 0; ; n++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		dev.Send(msg)
+		timer := policy.newTimer()
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case smartbusMsg := <-waiter.ch:
+			timer.Stop()
+			return smartbusMsg.Message.(Message), nil
+		case <-timer.GetChannel():
+			if n >= policy.Retries {
+				return nil, ErrNoResponse
+			}
+			wbgo.Debug.Printf("retrying %s to %d:%d", MessageName(msg), dev.SubnetID, dev.DeviceID)
+		}
+	}
+}
+
+// queueRequest sends the request via the queue and waits for the
+// response. If the context is done or the queue is stopped before
+// the response is received, the request is removed from the queue,
+// aborting it if it's being processed. ErrQueueStopped is returned
+// if the queue is not running or is stopped meanwhile.
+func (dev *SmartbusDevice) queueRequest(ctx context.Context, queue *MessageQueue, msg Message, waiter *responseWaiter) (Message, error) {
+	item := &queuedRequest{dev, msg, waiter, make(chan struct{})}
+	quit, err := queue.enqueueRunning(item)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		queue.Remove(item)
+		return nil, ctx.Err()
+	case <-quit:
+		queue.Remove(item)
+		return nil, ErrQueueStopped
+	case smartbusMsg := <-waiter.ch:
+		return smartbusMsg.Message.(Message), nil
+	case <-item.failed:
+		return nil, ErrNoResponse
+	}
+}
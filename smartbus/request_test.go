@@ -0,0 +1,157 @@
+package smartbus
+
+import (
+	"context"
+	"github.com/contactless/wbgo"
+	"github.com/contactless/wbgo/testutils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDeviceRequest(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	bus := NewSimulatedBus()
+	defer bus.Close()
+	bus.AddDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, NewSimulatedZoneBeast(4, []int8{22}))
+	bus.AddDevice(SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID, NewSimulatedPanel())
+
+	conn := NewSmartbusConnection(bus.NewIO())
+	defer conn.Close()
+	ep := conn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	ep.SetRequestPolicy(RequestPolicy{Timeout: 20 * time.Millisecond, Retries: 1})
+	relayDev := ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID)
+	ctx := context.Background()
+
+	response, err := relayDev.Request(ctx, &SingleChannelControlCommand{2, LIGHT_LEVEL_ON, 0})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &SingleChannelControlResponse{2, true, LIGHT_LEVEL_ON, parseChannelStatus("----")}, response)
+
+	response, err = relayDev.Request(ctx, &ReadTemperatureValues{true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &ReadTemperatureValuesResponse{true, []int8{22}}, response)
+
+	response, err = ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID).Request(
+		ctx, &QueryPanelButtonAssignment{3, 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint8(3), response.(*QueryPanelButtonAssignmentResponse).ButtonNo)
+
+	// any device may respond to a broadcast request
+	response, err = ep.GetBroadcastDevice().Request(ctx, &ReadMACAddress{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.IsType(t, &ReadMACAddressResponse{}, response)
+
+	// no such device
+	_, err = ep.GetSmartbusDevice(SAMPLE_SUBNET, 0x63).Request(ctx, &ReadMACAddress{})
+	assert.Equal(t, ErrNoResponse, err)
+}
+
+func TestDeviceRequestCancel(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	bus := NewSimulatedBus()
+	defer bus.Close()
+	conn := NewSmartbusConnection(bus.NewIO())
+	defer conn.Close()
+	ep := conn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	ep.SetRequestPolicy(RequestPolicy{Timeout: time.Hour, Retries: 1})
+	dev := ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := dev.Request(ctx, &ReadMACAddress{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = dev.Request(ctx, &ReadMACAddress{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestDeviceRequestQueue(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	bus := NewSimulatedBus()
+	defer bus.Close()
+	bus.AddDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, NewSimulatedZoneBeast(4, []int8{22}))
+	conn := NewSmartbusConnection(bus.NewIO())
+	defer conn.Close()
+	ep := conn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	queue := NewMessageQueue(func(d time.Duration) wbgo.Timer {
+		return wbgo.NewRealTimer(d)
+	}, time.Hour, 0, 3)
+	ep.Subscribe(SubscriptionFilter{}, queue.HandleReceivedMessage)
+	ep.SetRequestQueue(queue)
+	queue.Start()
+	defer queue.Stop()
+	ctx := context.Background()
+
+	response, err := ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID).Request(
+		ctx, &SingleChannelControlCommand{2, LIGHT_LEVEL_ON, 0})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &SingleChannelControlResponse{2, true, LIGHT_LEVEL_ON, parseChannelStatus("----")}, response)
+
+	// the request waits for the queued items for the same
+	// device and is removed from the queue when cancelled
+	rec := testutils.NewRecorder(t)
+	queue.Enqueue(&FakeQueueItem{rec: rec, name: "pending", expectedOpcode: 42, deviceID: 0x63})
+	rec.Verify("RUN: pending")
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = ep.GetSmartbusDevice(0, 0x63).Request(ctx, &ReadMACAddress{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, queue.Depth())
+
+	// the request being sent is aborted when cancelled,
+	// so it doesn't hold the items for the same device
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = ep.GetSmartbusDevice(0, 0x64).Request(ctx, &ReadMACAddress{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	queue.Enqueue(&FakeQueueItem{rec: rec, name: "next", expectedOpcode: 42, deviceID: 0x64})
+	rec.Verify("RUN: next")
+}
+
+func TestDeviceRequestQueueStopped(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	bus := NewSimulatedBus()
+	defer bus.Close()
+	conn := NewSmartbusConnection(bus.NewIO())
+	defer conn.Close()
+	ep := conn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	queue := NewMessageQueue(func(d time.Duration) wbgo.Timer {
+		return wbgo.NewRealTimer(d)
+	}, time.Hour, 0, 3)
+	ep.SetRequestQueue(queue)
+	dev := ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID)
+	ctx := context.Background()
+
+	// the queue is not started yet
+	_, err := dev.Request(ctx, &ReadMACAddress{})
+	assert.Equal(t, ErrQueueStopped, err)
+
+	// the queue is stopped while waiting for the response
+	queue.Start()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		queue.Stop()
+	}()
+	_, err = dev.Request(ctx, &ReadMACAddress{})
+	assert.Equal(t, ErrQueueStopped, err)
+}
@@ -0,0 +1,280 @@
+package smartbus
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/contactless/wbgo"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SCAN_MESSAGE_QUEUE_SIZE = 100
+	DEFAULT_SCAN_TIMEOUT    = 200 * time.Millisecond
+	DEFAULT_SCAN_RETRIES    = 1
+)
+
+// InventoryEntry describes a device found by Scanner
+type InventoryEntry struct {
+	SubnetID   uint8    `json:"subnet"`
+	DeviceID   uint8    `json:"device"`
+	DeviceType uint16   `json:"deviceType"`
+	MAC        string   `json:"mac"`
+	Remark     string   `json:"remark"`
+	Opcodes    []uint16 `json:"opcodes"`
+	Supported  bool     `json:"supported"`
+}
+
+func (entry *InventoryEntry) addOpcode(opcode uint16) {
+	for _, o := range entry.Opcodes {
+		if o == opcode {
+			return
+		}
+	}
+	entry.Opcodes = append(entry.Opcodes, opcode)
+	sort.Slice(entry.Opcodes, func(i, j int) bool {
+		return entry.Opcodes[i] < entry.Opcodes[j]
+	})
+}
+
+// Scanner probes the specified address ranges using ReadMACAddress
+// requests and collects the information about the devices that
+// respond. All the other messages seen on the bus during the scan
+// are recorded, too, so the devices that don't answer the probe
+// but send something are also listed in the inventory.
+type Scanner struct {
+	sync.Mutex
+	ep        *SmartbusEndpoint
+	timerFunc TimerFunc
+	timeout   time.Duration
+	retries   int
+	active    bool
+	messages  chan *SmartbusMessage
+	quit      chan struct{}
+}
+
+func NewScanner(ep *SmartbusEndpoint, timerFunc TimerFunc, timeout time.Duration, retries int) *Scanner {
+	scanner := &Scanner{
+		ep:        ep,
+		timerFunc: timerFunc,
+		timeout:   timeout,
+		retries:   retries,
+		messages:  make(chan *SmartbusMessage, SCAN_MESSAGE_QUEUE_SIZE),
+		quit:      make(chan struct{}),
+	}
+	ep.Observe(scanner)
+	ep.AddInputSniffer(scanner)
+	return scanner
+}
+
+func (scanner *Scanner) OnAnything(msg Message, header *MessageHeader) {
+	scanner.Lock()
+	defer scanner.Unlock()
+	if !scanner.active {
+		return
+	}
+	select {
+	case scanner.messages <- &SmartbusMessage{*header, msg}:
+	default:
+		wbgo.Warn.Printf("Scanner: message queue overflow, dropping message")
+	}
+}
+
+func (scanner *Scanner) setActive(active bool) bool {
+	scanner.Lock()
+	defer scanner.Unlock()
+	if active && scanner.active {
+		return false
+	}
+	scanner.active = active
+	return true
+}
+
+// IsActive returns true if the scan is in progress
+func (scanner *Scanner) IsActive() bool {
+	scanner.Lock()
+	defer scanner.Unlock()
+	return scanner.active
+}
+
+// Stop aborts the scan in progress and makes
+// any further Scan() calls fail
+func (scanner *Scanner) Stop() {
+	scanner.Lock()
+	defer scanner.Unlock()
+	select {
+	case <-scanner.quit:
+	default:
+		close(scanner.quit)
+	}
+}
+
+// Scan probes the devices in the specified address ranges.
+// It returns an error if another scan is in progress or
+// if the scanner was stopped.
+func (scanner *Scanner) Scan(ranges []AddressRange) ([]*InventoryEntry, error) {
+	if !scanner.setActive(true) {
+		return nil, fmt.Errorf("scan is already in progress")
+	}
+	defer scanner.setActive(false)
+
+	entries := make(map[uint16]*InventoryEntry)
+	for _, r := range ranges {
+		for deviceID := int(r.FromDevice); deviceID <= int(r.ToDevice); deviceID++ {
+			if !scanner.probe(r.SubnetID, uint8(deviceID), entries) {
+				return nil, fmt.Errorf("scan aborted")
+			}
+		}
+	}
+
+	result := make([]*InventoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		_, entry.Supported = smartbusDeviceModelTypes[entry.DeviceType]
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return deviceKey(result[i].SubnetID, result[i].DeviceID) <
+			deviceKey(result[j].SubnetID, result[j].DeviceID)
+	})
+	return result, nil
+}
+
+func (scanner *Scanner) probe(subnetID uint8, deviceID uint8, entries map[uint16]*InventoryEntry) bool {
+	if subnetID == BROADCAST_SUBNET || deviceID == BROADCAST_DEVICE ||
+		(subnetID == scanner.ep.SubnetID && deviceID == scanner.ep.DeviceID) {
+		return true
+	}
+	smartDev := scanner.ep.GetSmartbusDevice(subnetID, deviceID)
+	smartDev.ReadMACAddress()
+	timer := scanner.timerFunc(scanner.timeout)
+	for n := scanner.retries; ; {
+		select {
+		case <-scanner.quit:
+			timer.Stop()
+			return false
+		case <-timer.GetChannel():
+			if n == 0 {
+				return true
+			}
+			n--
+			smartDev.ReadMACAddress()
+			timer = scanner.timerFunc(scanner.timeout)
+		case smartbusMsg := <-scanner.messages:
+			header := &smartbusMsg.Header
+			if scanner.record(smartbusMsg, entries) &&
+				header.OrigSubnetID == subnetID && header.OrigDeviceID == deviceID {
+				timer.Stop()
+				return true
+			}
+		}
+	}
+}
+
+// record adds the message to the inventory. It returns true
+// if the message is a response to the probe
+func (scanner *Scanner) record(smartbusMsg *SmartbusMessage, entries map[uint16]*InventoryEntry) bool {
+	header := &smartbusMsg.Header
+	if header.OrigSubnetID == scanner.ep.SubnetID && header.OrigDeviceID == scanner.ep.DeviceID {
+		return false
+	}
+	key := deviceKey(header.OrigSubnetID, header.OrigDeviceID)
+	entry, found := entries[key]
+	if !found {
+		entry = &InventoryEntry{
+			SubnetID: header.OrigSubnetID,
+			DeviceID: header.OrigDeviceID,
+			Opcodes:  []uint16{},
+		}
+		entries[key] = entry
+	}
+	entry.DeviceType = header.OrigDeviceType
+	msg := smartbusMsg.Message.(Message)
+	entry.addOpcode(msg.Opcode())
+
+	response, ok := msg.(*ReadMACAddressResponse)
+	if !ok {
+		return false
+	}
+	macParts := make([]string, len(response.MAC))
+	for i, v := range response.MAC {
+		macParts[i] = fmt.Sprintf("%02x", v)
+	}
+	entry.MAC = strings.Join(macParts, ":")
+	entry.Remark = formatRemark(response.Remark)
+	return true
+}
+
+// formatRemark returns the remark as text with the NUL padding
+// trimmed. The remarks that are not printable ASCII text are
+// formatted as hex bytes.
+func formatRemark(remark []uint8) string {
+	text := strings.TrimRight(string(remark), "\x00")
+	for i := 0; i < len(text); i++ {
+		if text[i] < 0x20 || text[i] > 0x7e {
+			return formatHexBytes(remark)
+		}
+	}
+	return text
+}
+
+func WriteInventoryJSON(writer io.Writer, entries []*InventoryEntry) error {
+	bs, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(bs, '\n'))
+	return err
+}
+
+func WriteInventoryCSV(writer io.Writer, entries []*InventoryEntry) error {
+	w := csv.NewWriter(writer)
+	w.Write([]string{"subnet", "device", "deviceType", "mac", "remark", "opcodes", "supported"})
+	for _, entry := range entries {
+		opcodes := make([]string, len(entry.Opcodes))
+		for i, opcode := range entry.Opcodes {
+			opcodes[i] = fmt.Sprintf("0x%04x", opcode)
+		}
+		w.Write([]string{
+			strconv.Itoa(int(entry.SubnetID)),
+			strconv.Itoa(int(entry.DeviceID)),
+			fmt.Sprintf("0x%04x", entry.DeviceType),
+			entry.MAC,
+			entry.Remark,
+			strings.Join(opcodes, " "),
+			strconv.FormatBool(entry.Supported),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// WriteInventory writes the inventory in the specified
+// format ("json" or "csv")
+func WriteInventory(writer io.Writer, entries []*InventoryEntry, format string) error {
+	switch format {
+	case "json":
+		return WriteInventoryJSON(writer, entries)
+	case "csv":
+		return WriteInventoryCSV(writer, entries)
+	default:
+		return fmt.Errorf("unknown inventory format %q", format)
+	}
+}
+
+func writeInventoryFile(path string, entries []*InventoryEntry, format string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = WriteInventory(f, entries, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,79 @@
+package smartbus
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var sampleInventory = []*InventoryEntry{
+	{
+		SubnetID:   SAMPLE_SUBNET,
+		DeviceID:   SAMPLE_DDP_DEVICE_ID,
+		DeviceType: SAMPLE_DDP_DEVICE_TYPE,
+		MAC:        "53:03:00:00:00:00:30:c3",
+		Remark:     "20 42 42",
+		Opcodes:    []uint16{0xe3e5, 0xf004},
+		Supported:  true,
+	},
+	{
+		SubnetID:   SAMPLE_SUBNET,
+		DeviceID:   40,
+		DeviceType: 0x1111,
+		Opcodes:    []uint16{0x0284},
+	},
+}
+
+func TestWriteInventoryCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteInventory(&buf, sampleInventory, "csv"); err != nil {
+		t.Fatalf("WriteInventory(): %s", err)
+	}
+	assert.Equal(t,
+		"subnet,device,deviceType,mac,remark,opcodes,supported\n"+
+			"1,20,0x0095,53:03:00:00:00:00:30:c3,20 42 42,0xe3e5 0xf004,true\n"+
+			"1,40,0x1111,,,0x0284,false\n",
+		buf.String())
+}
+
+func TestWriteInventoryJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteInventory(&buf, sampleInventory[1:], "json"); err != nil {
+		t.Fatalf("WriteInventory(): %s", err)
+	}
+	assert.Equal(t,
+		"[\n"+
+			"  {\n"+
+			"    \"subnet\": 1,\n"+
+			"    \"device\": 40,\n"+
+			"    \"deviceType\": 4369,\n"+
+			"    \"mac\": \"\",\n"+
+			"    \"remark\": \"\",\n"+
+			"    \"opcodes\": [\n"+
+			"      644\n"+
+			"    ],\n"+
+			"    \"supported\": false\n"+
+			"  }\n"+
+			"]\n",
+		buf.String())
+
+	if err := WriteInventory(&buf, sampleInventory, "xml"); err == nil {
+		t.Errorf("WriteInventory() didn't fail for unknown format")
+	}
+}
+
+func TestFormatRemark(t *testing.T) {
+	for _, item := range []struct {
+		remark   []uint8
+		expected string
+	}{
+		{[]uint8("DDP"), "DDP"},
+		{[]uint8{'Z', 'B', 0, 0, 0}, "ZB"},
+		{[]uint8{}, ""},
+		{[]uint8{0, 0}, ""},
+		{[]uint8{0x20, 0x42, 0xc3}, "20 42 c3"},
+		{[]uint8{'Z', 0, 'B'}, "5a 00 42"},
+	} {
+		assert.Equal(t, item.expected, formatRemark(item.remark), "remark %v", item.remark)
+	}
+}
@@ -0,0 +1,176 @@
+package smartbus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	SIM_DEVICE_ZONEBEAST = "zonebeast"
+	SIM_DEVICE_HMIX12    = "hmix12"
+	SIM_DEVICE_DDP       = "ddp"
+	SIM_DEVICE_8IN1      = "8in1"
+)
+
+// SimButtonConfig specifies the assignment of a DDP button
+// (numbered from 1) to a relay channel. Level defaults to 100.
+type SimButtonConfig struct {
+	ButtonNo  int   `json:"button"`
+	SubnetID  uint8 `json:"subnet"`
+	DeviceID  uint8 `json:"device"`
+	ChannelNo uint8 `json:"channel"`
+	Level     uint8 `json:"level"`
+}
+
+// SimSensorConfig specifies the initial state of an 8-in-1 sensor
+type SimSensorConfig struct {
+	Temperature int    `json:"temperature"`
+	Illuminance uint16 `json:"illuminance"`
+	Movement    bool   `json:"movement"`
+	DryContact1 bool   `json:"dryContact1"`
+	DryContact2 bool   `json:"dryContact2"`
+}
+
+// SimDeviceConfig specifies an emulated device. Type is one
+// of "zonebeast", "hmix12", "ddp" or "8in1". Channels and
+// Temperatures (in degrees Celsius) are used for ZoneBeast,
+// Buttons for DDP and Sensor for 8-in-1 sensors. Remark is
+// returned in ReadMACAddressResponse.
+type SimDeviceConfig struct {
+	Type         string            `json:"type"`
+	SubnetID     uint8             `json:"subnet"`
+	DeviceID     uint8             `json:"device"`
+	Remark       string            `json:"remark"`
+	Channels     int               `json:"channels"`
+	Temperatures []int8            `json:"temperatures"`
+	Buttons      []SimButtonConfig `json:"buttons"`
+	Sensor       SimSensorConfig   `json:"sensor"`
+}
+
+// SimulatorConfig specifies the devices on the simulated bus.
+// StatusInterval is the interval between the status broadcasts
+// in milliseconds, zero disables them.
+type SimulatorConfig struct {
+	StatusInterval int               `json:"statusInterval"`
+	Devices        []SimDeviceConfig `json:"devices"`
+}
+
+func NewSimulatorConfig() *SimulatorConfig {
+	return &SimulatorConfig{StatusInterval: 1000}
+}
+
+// LoadSimulatorConfig reads the simulator config file
+func LoadSimulatorConfig(path string) (*SimulatorConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := NewSimulatorConfig()
+	if err := decodeStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+// Validate checks the config and returns an error
+// listing all of the problems found
+func (config *SimulatorConfig) Validate() error {
+	problems := make([]string, 0)
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if config.StatusInterval < 0 {
+		problem("bad statusInterval: %d", config.StatusInterval)
+	}
+	seen := make(map[uint16]bool)
+	for i, dc := range config.Devices {
+		key := deviceKey(dc.SubnetID, dc.DeviceID)
+		switch {
+		case dc.SubnetID == BROADCAST_SUBNET || dc.DeviceID == BROADCAST_DEVICE:
+			problem("devices[%d]: broadcast address %d:%d", i, dc.SubnetID, dc.DeviceID)
+		case seen[key]:
+			problem("devices[%d]: duplicate address %d:%d", i, dc.SubnetID, dc.DeviceID)
+		}
+		seen[key] = true
+		if len(dc.Remark) >= 64 {
+			problem("devices[%d]: remark too long", i)
+		}
+		switch dc.Type {
+		case SIM_DEVICE_ZONEBEAST:
+			if dc.Channels < 0 || dc.Channels > 255 {
+				problem("devices[%d]: bad channels: %d", i, dc.Channels)
+			}
+		case SIM_DEVICE_HMIX12, SIM_DEVICE_8IN1:
+		case SIM_DEVICE_DDP:
+			for j, bc := range dc.Buttons {
+				if bc.ButtonNo < 1 || bc.ButtonNo > PANEL_BUTTON_COUNT {
+					problem("devices[%d].buttons[%d]: bad button: %d", i, j, bc.ButtonNo)
+				}
+			}
+		default:
+			problem("devices[%d]: unknown device type %q", i, dc.Type)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (dc *SimDeviceConfig) makeDevice() SimulatedDevice {
+	var dev SimulatedDevice
+	var base *SimulatedDeviceBase
+	switch dc.Type {
+	case SIM_DEVICE_ZONEBEAST:
+		channels := dc.Channels
+		if channels == 0 {
+			channels = DEFAULT_ZONEBEAST_CHANNELS
+		}
+		relay := NewSimulatedZoneBeast(channels, append([]int8(nil), dc.Temperatures...))
+		dev, base = relay, &relay.SimulatedDeviceBase
+	case SIM_DEVICE_HMIX12:
+		relay := NewSimulatedHmix12()
+		dev, base = relay, &relay.SimulatedDeviceBase
+	case SIM_DEVICE_DDP:
+		panel := NewSimulatedPanel()
+		for _, bc := range dc.Buttons {
+			level := bc.Level
+			if level == 0 {
+				level = LIGHT_LEVEL_ON
+			}
+			panel.SetButton(bc.ButtonNo, SimulatedPanelButton{
+				Mode:      "SingleOnOff",
+				Command:   BUTTON_COMMAND_SINGLE_CHANNEL_LIGHTING_CONTROL,
+				SubnetID:  bc.SubnetID,
+				DeviceID:  bc.DeviceID,
+				ChannelNo: bc.ChannelNo,
+				Level:     level,
+			})
+		}
+		dev, base = panel, &panel.SimulatedDeviceBase
+	case SIM_DEVICE_8IN1:
+		sensor := NewSimulatedSensor8in1(SimulatedSensorState(dc.Sensor))
+		dev, base = sensor, &sensor.SimulatedDeviceBase
+	default:
+		panic("unknown simulated device type " + dc.Type)
+	}
+	base.Remark = []uint8(dc.Remark)
+	return dev
+}
+
+// NewConfiguredSimulatedBus creates a simulated bus
+// with the devices specified in the config
+func NewConfiguredSimulatedBus(config *SimulatorConfig) *SimulatedBus {
+	bus := NewSimulatedBus()
+	for i := range config.Devices {
+		dc := &config.Devices[i]
+		bus.AddDevice(dc.SubnetID, dc.DeviceID, dc.makeDevice())
+	}
+	return bus
+}
@@ -0,0 +1,488 @@
+package smartbus
+
+import (
+	"fmt"
+	"github.com/contactless/wbgo"
+	"sync"
+)
+
+const (
+	SIM_PORT_QUEUE_SIZE = 256
+
+	ZONEBEAST_DEVICE_TYPE   = 0x139c
+	DDP_DEVICE_TYPE         = 0x0095
+	HMIX12_DEVICE_TYPE      = 0x0257
+	SENSOR_8IN1_DEVICE_TYPE = 0x0149
+
+	DEFAULT_ZONEBEAST_CHANNELS = 4
+	HMIX12_CHANNELS            = 12
+)
+
+// SimulatedDevice is an emulated device hosted by SimulatedBus.
+// The device receives the messages addressed to it via
+// On<MessageType>(msg, header) methods.
+type SimulatedDevice interface {
+	DeviceType() uint16
+	attach(ep *SmartbusEndpoint)
+}
+
+// statusBroadcaster is implemented by the devices that
+// send their status at regular intervals
+type statusBroadcaster interface {
+	broadcastStatus()
+}
+
+// simPort is a SmartbusIO that's connected to a SimulatedBus.
+// A message sent via the port is delivered to all of the other
+// ports of the bus. Loopback ports also receive their own
+// messages, which is needed for the devices' port so that
+// the devices can talk to each other.
+type simPort struct {
+	bus      *SimulatedBus
+	readCh   chan *SmartbusMessage
+	loopback bool
+	stopped  bool
+}
+
+func (port *simPort) Start() chan *SmartbusMessage {
+	return port.readCh
+}
+
+func (port *simPort) Send(msg SmartbusMessage) {
+	port.bus.deliver(port, msg)
+}
+
+func (port *simPort) Stop() {
+	port.bus.removePort(port)
+}
+
+// SimulatedBus is an in-process Smart-Bus segment with emulated
+// devices on it. The driver or any other client accesses the bus
+// via SmartbusIO returned by NewIO(), or an existing SmartbusIO
+// (e.g. a TCP connection) may be attached to the bus.
+// The devices should be added before the clients start
+// sending messages.
+type SimulatedBus struct {
+	sync.Mutex
+	ports   []*simPort
+	devConn *SmartbusConnection
+	devices []SimulatedDevice
+}
+
+func NewSimulatedBus() *SimulatedBus {
+	bus := &SimulatedBus{ports: make([]*simPort, 0, 16)}
+	bus.devConn = NewSmartbusConnection(bus.newPort(true))
+	return bus
+}
+
+func (bus *SimulatedBus) newPort(loopback bool) *simPort {
+	bus.Lock()
+	defer bus.Unlock()
+	port := &simPort{
+		bus:      bus,
+		readCh:   make(chan *SmartbusMessage, SIM_PORT_QUEUE_SIZE),
+		loopback: loopback,
+	}
+	bus.ports = append(bus.ports, port)
+	return port
+}
+
+func (bus *SimulatedBus) removePort(port *simPort) {
+	bus.Lock()
+	defer bus.Unlock()
+	if port.stopped {
+		return
+	}
+	port.stopped = true
+	for i, p := range bus.ports {
+		if p == port {
+			bus.ports = append(bus.ports[:i], bus.ports[i+1:]...)
+			break
+		}
+	}
+	close(port.readCh)
+}
+
+func (bus *SimulatedBus) deliver(from *simPort, msg SmartbusMessage) {
+	// the message goes through encoding and parsing
+	// just like it would on the real bus, so each of
+	// the receivers gets its own copy
+	parsed, err := ParseFrame(EncodeFrame(msg))
+	if err != nil {
+		wbgo.Error.Printf("simulator: failed to parse the message: %s", err)
+		return
+	}
+	bus.Lock()
+	defer bus.Unlock()
+	if from.stopped {
+		return
+	}
+	for _, port := range bus.ports {
+		if port == from && !port.loopback {
+			continue
+		}
+		m := *parsed
+		select {
+		case port.readCh <- &m:
+		default:
+			wbgo.Warn.Printf("simulator: port queue overflow, message dropped")
+		}
+	}
+}
+
+// NewIO returns a new SmartbusIO connected to the bus
+func (bus *SimulatedBus) NewIO() SmartbusIO {
+	return bus.newPort(false)
+}
+
+// Attach connects an existing SmartbusIO to the bus. The SmartbusIO
+// is stopped when it's disconnected or the bus is closed.
+func (bus *SimulatedBus) Attach(smartbusIO SmartbusIO) {
+	port := bus.newPort(false)
+	ch := smartbusIO.Start()
+	go func() {
+		for msg := range ch {
+			port.Send(*msg)
+		}
+		port.Stop()
+	}()
+	go func() {
+		for msg := range port.readCh {
+			smartbusIO.Send(*msg)
+		}
+		smartbusIO.Stop()
+	}()
+}
+
+// AddDevice places the device on the bus at the specified address
+func (bus *SimulatedBus) AddDevice(subnetID uint8, deviceID uint8, dev SimulatedDevice) {
+	bus.Lock()
+	defer bus.Unlock()
+	ep := bus.devConn.MakeSmartbusEndpoint(subnetID, deviceID, dev.DeviceType())
+	dev.attach(ep)
+	ep.Observe(dev)
+	bus.devices = append(bus.devices, dev)
+}
+
+// BroadcastStatus makes the devices that send their status
+// periodically (e.g. ZoneBeast) broadcast it
+func (bus *SimulatedBus) BroadcastStatus() {
+	bus.Lock()
+	devices := append([]SimulatedDevice(nil), bus.devices...)
+	bus.Unlock()
+	for _, dev := range devices {
+		if broadcaster, ok := dev.(statusBroadcaster); ok {
+			broadcaster.broadcastStatus()
+		}
+	}
+}
+
+// Close disconnects all of the clients from the bus
+func (bus *SimulatedBus) Close() {
+	bus.Lock()
+	ports := append([]*simPort(nil), bus.ports...)
+	bus.Unlock()
+	for _, port := range ports {
+		port.Stop()
+	}
+}
+
+// SimulatedDeviceBase provides the functionality
+// common to all of the emulated devices
+type SimulatedDeviceBase struct {
+	sync.Mutex
+	ep     *SmartbusEndpoint
+	MAC    [8]uint8
+	Remark []uint8
+}
+
+func (dev *SimulatedDeviceBase) attach(ep *SmartbusEndpoint) {
+	dev.ep = ep
+	var zeroMAC [8]uint8
+	if dev.MAC == zeroMAC {
+		dev.MAC = [8]uint8{0x53, 0x03, 0x00, 0x00, 0x00, 0x00, ep.SubnetID, ep.DeviceID}
+	}
+}
+
+// send sends the message to the specified device.
+// The endpoint's device map is not used here because
+// it's not safe for concurrent use.
+func (dev *SimulatedDeviceBase) send(subnetID uint8, deviceID uint8, msg Message) {
+	dev.ep.Send(SmartbusMessage{
+		MessageHeader{TargetSubnetID: subnetID, TargetDeviceID: deviceID},
+		msg,
+	})
+}
+
+func (dev *SimulatedDeviceBase) reply(header *MessageHeader, msg Message) {
+	dev.send(header.OrigSubnetID, header.OrigDeviceID, msg)
+}
+
+func (dev *SimulatedDeviceBase) broadcast(msg Message) {
+	dev.send(BROADCAST_SUBNET, BROADCAST_DEVICE, msg)
+}
+
+func (dev *SimulatedDeviceBase) OnReadMACAddress(msg *ReadMACAddress, header *MessageHeader) {
+	dev.reply(header, &ReadMACAddressResponse{dev.MAC, dev.Remark})
+}
+
+// SimulatedRelay emulates ZoneBeast and HMix12 relay devices
+type SimulatedRelay struct {
+	SimulatedDeviceBase
+	deviceType   uint16
+	levels       []uint8
+	temperatures []int8
+}
+
+// NewSimulatedZoneBeast creates an emulated ZoneBeast with the
+// specified number of channels and temperature sensors.
+// The temperatures are specified in degrees Celsius.
+func NewSimulatedZoneBeast(channels int, temperatures []int8) *SimulatedRelay {
+	return &SimulatedRelay{
+		deviceType:   ZONEBEAST_DEVICE_TYPE,
+		levels:       make([]uint8, channels),
+		temperatures: temperatures,
+	}
+}
+
+func NewSimulatedHmix12() *SimulatedRelay {
+	return &SimulatedRelay{
+		deviceType: HMIX12_DEVICE_TYPE,
+		levels:     make([]uint8, HMIX12_CHANNELS),
+	}
+}
+
+func (dev *SimulatedRelay) DeviceType() uint16 { return dev.deviceType }
+
+func (dev *SimulatedRelay) channelStatus() []bool {
+	status := make([]bool, len(dev.levels))
+	for i, level := range dev.levels {
+		status[i] = level > 0
+	}
+	return status
+}
+
+// ChannelStatus returns the current channel status
+func (dev *SimulatedRelay) ChannelStatus() []bool {
+	dev.Lock()
+	defer dev.Unlock()
+	return dev.channelStatus()
+}
+
+// SetTemperature sets the value of the specified
+// temperature sensor (numbered from 1)
+func (dev *SimulatedRelay) SetTemperature(n int, value int8) {
+	dev.Lock()
+	defer dev.Unlock()
+	if n >= 1 && n <= len(dev.temperatures) {
+		dev.temperatures[n-1] = value
+	}
+}
+
+func (dev *SimulatedRelay) OnSingleChannelControlCommand(msg *SingleChannelControlCommand, header *MessageHeader) {
+	dev.Lock()
+	// like the real device, the response carries
+	// pre-command channel status
+	status := dev.channelStatus()
+	success := msg.ChannelNo >= 1 && int(msg.ChannelNo) <= len(dev.levels)
+	if success {
+		dev.levels[msg.ChannelNo-1] = msg.Level
+	}
+	dev.Unlock()
+	dev.broadcast(&SingleChannelControlResponse{msg.ChannelNo, success, msg.Level, status})
+}
+
+func (dev *SimulatedRelay) OnQueryChannelStatuses(msg *QueryChannelStatuses, header *MessageHeader) {
+	dev.Lock()
+	levels := append([]uint8(nil), dev.levels...)
+	dev.Unlock()
+	dev.reply(header, &QueryChannelStatusesResponse{levels})
+}
+
+func (dev *SimulatedRelay) OnReadTemperatureValues(msg *ReadTemperatureValues, header *MessageHeader) {
+	dev.Lock()
+	values := make([]int8, len(dev.temperatures))
+	for i, v := range dev.temperatures {
+		if msg.UseCelsius {
+			values[i] = v
+		} else {
+			values[i] = int8(int(v)*9/5 + 32)
+		}
+	}
+	dev.Unlock()
+	dev.reply(header, &ReadTemperatureValuesResponse{msg.UseCelsius, values})
+}
+
+func (dev *SimulatedRelay) broadcastStatus() {
+	if dev.deviceType != ZONEBEAST_DEVICE_TYPE {
+		return
+	}
+	dev.broadcast(&ZoneBeastBroadcast{[]uint8{0}, dev.ChannelStatus()})
+}
+
+// SimulatedPanelButton is an assignment of a DDP panel button
+type SimulatedPanelButton struct {
+	Mode      string
+	Command   uint8
+	SubnetID  uint8
+	DeviceID  uint8
+	ChannelNo uint8
+	Level     uint8
+	Duration  uint16
+}
+
+// SimulatedPanel emulates a DDP panel
+type SimulatedPanel struct {
+	SimulatedDeviceBase
+	buttons [PANEL_BUTTON_COUNT]SimulatedPanelButton
+	pressed [PANEL_BUTTON_COUNT]bool
+}
+
+func NewSimulatedPanel() *SimulatedPanel {
+	panel := &SimulatedPanel{}
+	for i := range panel.buttons {
+		panel.buttons[i].Mode = "Invalid"
+	}
+	return panel
+}
+
+func (dev *SimulatedPanel) DeviceType() uint16 { return DDP_DEVICE_TYPE }
+
+// SetButton sets the assignment of the button (numbered from 1)
+func (dev *SimulatedPanel) SetButton(buttonNo int, button SimulatedPanelButton) error {
+	if buttonNo < 1 || buttonNo > PANEL_BUTTON_COUNT {
+		return fmt.Errorf("bad button number %d", buttonNo)
+	}
+	dev.Lock()
+	defer dev.Unlock()
+	dev.buttons[buttonNo-1] = button
+	return nil
+}
+
+// Button returns the assignment of the button (numbered from 1)
+func (dev *SimulatedPanel) Button(buttonNo int) SimulatedPanelButton {
+	dev.Lock()
+	defer dev.Unlock()
+	return dev.buttons[buttonNo-1]
+}
+
+// PressButton emulates a button press. For the buttons assigned
+// to single channel lighting control, the target channel is
+// toggled.
+func (dev *SimulatedPanel) PressButton(buttonNo int) error {
+	if buttonNo < 1 || buttonNo > PANEL_BUTTON_COUNT {
+		return fmt.Errorf("bad button number %d", buttonNo)
+	}
+	dev.Lock()
+	button := dev.buttons[buttonNo-1]
+	if button.Mode == "Invalid" || button.Command != BUTTON_COMMAND_SINGLE_CHANNEL_LIGHTING_CONTROL {
+		dev.Unlock()
+		return fmt.Errorf("button %d is not assigned", buttonNo)
+	}
+	dev.pressed[buttonNo-1] = !dev.pressed[buttonNo-1]
+	level := uint8(LIGHT_LEVEL_OFF)
+	if dev.pressed[buttonNo-1] {
+		level = button.Level
+	}
+	dev.Unlock()
+	dev.send(button.SubnetID, button.DeviceID,
+		&SingleChannelControlCommand{button.ChannelNo, level, button.Duration})
+	return nil
+}
+
+func (dev *SimulatedPanel) OnQueryPanelButtonAssignment(msg *QueryPanelButtonAssignment, header *MessageHeader) {
+	if msg.ButtonNo < 1 || msg.ButtonNo > PANEL_BUTTON_COUNT {
+		wbgo.Warn.Printf("simulator: bad button number %d in QueryPanelButtonAssignment", msg.ButtonNo)
+		return
+	}
+	dev.Lock()
+	button := dev.buttons[msg.ButtonNo-1]
+	dev.Unlock()
+	command := button.Command
+	if button.Mode == "Invalid" {
+		command = BUTTON_COMMAND_INVALID
+	}
+	dev.reply(header, &QueryPanelButtonAssignmentResponse{
+		msg.ButtonNo, msg.FunctionNo, command,
+		button.SubnetID, button.DeviceID,
+		button.ChannelNo, button.Level, button.Duration,
+	})
+}
+
+func (dev *SimulatedPanel) OnAssignPanelButton(msg *AssignPanelButton, header *MessageHeader) {
+	if msg.ButtonNo < 1 || msg.ButtonNo > PANEL_BUTTON_COUNT {
+		wbgo.Warn.Printf("simulator: bad button number %d in AssignPanelButton", msg.ButtonNo)
+		return
+	}
+	dev.Lock()
+	button := &dev.buttons[msg.ButtonNo-1]
+	button.Command = msg.Command
+	button.SubnetID = msg.CommandSubnetID
+	button.DeviceID = msg.CommandDeviceID
+	button.ChannelNo = msg.ChannelNo
+	button.Level = msg.Level
+	button.Duration = msg.Duration
+	dev.Unlock()
+	dev.reply(header, &AssignPanelButtonResponse{msg.ButtonNo, msg.FunctionNo})
+}
+
+func (dev *SimulatedPanel) OnSetPanelButtonModes(msg *SetPanelButtonModes, header *MessageHeader) {
+	dev.Lock()
+	for i, mode := range msg.Modes {
+		dev.buttons[i].Mode = mode
+	}
+	dev.Unlock()
+	dev.reply(header, &SetPanelButtonModesResponse{true})
+}
+
+// SimulatedSensorState is the state of an emulated 8-in-1 sensor
+type SimulatedSensorState struct {
+	Temperature int
+	Illuminance uint16
+	Movement    bool
+	DryContact1 bool
+	DryContact2 bool
+}
+
+// SimulatedSensor8in1 emulates an 8-in-1 multisensor
+type SimulatedSensor8in1 struct {
+	SimulatedDeviceBase
+	state SimulatedSensorState
+}
+
+func NewSimulatedSensor8in1(state SimulatedSensorState) *SimulatedSensor8in1 {
+	return &SimulatedSensor8in1{state: state}
+}
+
+func (dev *SimulatedSensor8in1) DeviceType() uint16 { return SENSOR_8IN1_DEVICE_TYPE }
+
+func (dev *SimulatedSensor8in1) State() SimulatedSensorState {
+	dev.Lock()
+	defer dev.Unlock()
+	return dev.state
+}
+
+// SetState changes the sensor state and broadcasts it
+func (dev *SimulatedSensor8in1) SetState(state SimulatedSensorState) {
+	dev.Lock()
+	dev.state = state
+	dev.Unlock()
+	dev.broadcastStatus()
+}
+
+func (dev *SimulatedSensor8in1) OnReadSensorStatus(msg *ReadSensorStatus, header *MessageHeader) {
+	state := dev.State()
+	dev.reply(header, &ReadSensorStatusResponse{
+		true,
+		state.Temperature, state.Illuminance, state.Movement,
+		state.DryContact1, state.DryContact2, 0, 0,
+	})
+}
+
+func (dev *SimulatedSensor8in1) broadcastStatus() {
+	state := dev.State()
+	dev.broadcast(&SensorStatusBroadcast{
+		state.Temperature, state.Illuminance, state.Movement,
+		state.DryContact1, state.DryContact2, 0, 0,
+	})
+}
@@ -0,0 +1,182 @@
+package smartbus
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	SAMPLE_HMIX12_DEVICE_ID = 0x1e
+	SAMPLE_SENSOR_DEVICE_ID = 0x28
+)
+
+func TestSimulatedBus(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	bus := NewSimulatedBus()
+	defer bus.Close()
+	zoneBeast := NewSimulatedZoneBeast(4, []int8{22})
+	bus.AddDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, zoneBeast)
+	panel := NewSimulatedPanel()
+	panel.Remark = []uint8("DDP")
+	bus.AddDevice(SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID, panel)
+	bus.AddDevice(SAMPLE_SUBNET, SAMPLE_HMIX12_DEVICE_ID, NewSimulatedHmix12())
+	bus.AddDevice(SAMPLE_SUBNET, SAMPLE_SENSOR_DEVICE_ID, NewSimulatedSensor8in1(
+		SimulatedSensorState{Temperature: 23, Illuminance: 300, Movement: true}))
+
+	handler := NewFakeHandler(t)
+	conn := NewSmartbusConnection(bus.NewIO())
+	defer conn.Close()
+	ep := conn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	ep.Observe(handler)
+	relayDev := ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID)
+	ddpDev := ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID)
+
+	ep.GetBroadcastDevice().ReadMACAddress()
+	handler.Verify(
+		"01/1c (type 139c) -> 03/fe: <ReadMACAddressResponse 53:03:00:00:00:00:01:1c []>",
+		"01/14 (type 0095) -> 03/fe: <ReadMACAddressResponse 53:03:00:00:00:00:01:14 [44 44 50]>",
+		"01/1e (type 0257) -> 03/fe: <ReadMACAddressResponse 53:03:00:00:00:00:01:1e []>",
+		"01/28 (type 0149) -> 03/fe: <ReadMACAddressResponse 53:03:00:00:00:00:01:28 []>",
+	)
+
+	relayDev.SingleChannelControl(2, LIGHT_LEVEL_ON, 0)
+	// the response carries pre-command channel status
+	handler.Verify("01/1c (type 139c) -> ff/ff: <SingleChannelControlResponse 2/true/100/---->")
+	relayDev.SingleChannelControl(5, LIGHT_LEVEL_ON, 0)
+	handler.Verify("01/1c (type 139c) -> ff/ff: <SingleChannelControlResponse 5/false/100/-x-->")
+
+	bus.BroadcastStatus()
+	handler.Verify(
+		"01/1c (type 139c) -> ff/ff: <ZoneBeastBroadcast [0]/-x-->",
+		"01/28 (type 0149) -> ff/ff: <SensorStatusBroadcast 23/300/true/false/false>",
+	)
+
+	relayDev.ReadTemperatureValues(true)
+	handler.Verify("01/1c (type 139c) -> 03/fe: <ReadTemperatureValuesResponse Celsius 22>")
+	relayDev.ReadTemperatureValues(false)
+	handler.Verify("01/1c (type 139c) -> 03/fe: <ReadTemperatureValuesResponse Fahrenheit 71>")
+
+	ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_HMIX12_DEVICE_ID).QueryChannelStatuses(0)
+	handler.Verify("01/1e (type 0257) -> 03/fe: <QueryChannelStatusesResponse [0 0 0 0 0 0 0 0 0 0 0 0]>")
+
+	ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_SENSOR_DEVICE_ID).ReadSensorStatus()
+	handler.Verify("01/28 (type 0149) -> 03/fe: <ReadSensorStatusResponse true 23/300/true/false/false>")
+
+	ddpDev.QueryPanelButtonAssignment(1, 1)
+	handler.Verify("01/14 (type 0095) -> 03/fe: <QueryPanelButtonAssignmentResponse 1/1/00/00/00/0/0/0>")
+	if err := panel.PressButton(1); err == nil {
+		t.Errorf("no error for pressing an unassigned button")
+	}
+
+	var modes [PANEL_BUTTON_COUNT]string
+	for i := range modes {
+		modes[i] = "Invalid"
+	}
+	modes[0] = "SingleOnOff"
+	ddpDev.SetPanelButtonModes(modes)
+	handler.Verify("01/14 (type 0095) -> 03/fe: <SetPanelButtonModesResponse true>")
+	ddpDev.AssignPanelButton(1, 1, BUTTON_COMMAND_SINGLE_CHANNEL_LIGHTING_CONTROL,
+		SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, 3, LIGHT_LEVEL_ON, 0)
+	handler.Verify("01/14 (type 0095) -> 03/fe: <AssignPanelButtonResponse 1/1>")
+	ddpDev.QueryPanelButtonAssignment(1, 1)
+	handler.Verify("01/14 (type 0095) -> 03/fe: <QueryPanelButtonAssignmentResponse 1/1/59/01/1c/3/100/0>")
+
+	// the button press goes to the simulated ZoneBeast
+	if err := panel.PressButton(1); err != nil {
+		t.Fatalf("PressButton(): %s", err)
+	}
+	handler.Verify("01/1c (type 139c) -> ff/ff: <SingleChannelControlResponse 3/true/100/-x-->")
+	if status := formatChannelStatus(zoneBeast.ChannelStatus()); status != "-xx-" {
+		t.Errorf("bad channel status %q", status)
+	}
+}
+
+func TestSimulatedBusAttach(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	bus := NewSimulatedBus()
+	bus.AddDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, NewSimulatedZoneBeast(4, nil))
+
+	// attach a client via another simulated bus
+	// to make sure that disconnection is handled
+	clientBus := NewSimulatedBus()
+	bus.Attach(clientBus.NewIO())
+	handler := NewFakeHandler(t)
+	conn := NewSmartbusConnection(clientBus.NewIO())
+	ep := conn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	ep.Observe(handler)
+
+	ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID).SingleChannelControl(1, LIGHT_LEVEL_ON, 0)
+	handler.Verify("01/1c (type 139c) -> ff/ff: <SingleChannelControlResponse 1/true/100/---->")
+
+	conn.Close()
+	bus.Close()
+	clientBus.Close()
+}
+
+func TestLoadSimulatorConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartbus-sim")
+	if err != nil {
+		t.Fatalf("TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sim.conf")
+
+	ioutil.WriteFile(path, []byte(`{
+		"devices": [
+			{"type": "zonebeast", "subnet": 1, "device": 28, "temperatures": [22]},
+			{"type": "ddp", "subnet": 1, "device": 20, "remark": "DDP",
+			 "buttons": [{"button": 2, "subnet": 1, "device": 28, "channel": 1}]},
+			{"type": "hmix12", "subnet": 1, "device": 30},
+			{"type": "8in1", "subnet": 1, "device": 40, "sensor": {"temperature": 23}}
+		]
+	}`), 0644)
+	config, err := LoadSimulatorConfig(path)
+	if err != nil {
+		t.Fatalf("LoadSimulatorConfig(): %s", err)
+	}
+	if config.StatusInterval != 1000 || len(config.Devices) != 4 {
+		t.Errorf("bad config: %#v", config)
+	}
+	panel := config.Devices[1].makeDevice().(*SimulatedPanel)
+	if button := panel.Button(2); button.Command != BUTTON_COMMAND_SINGLE_CHANNEL_LIGHTING_CONTROL ||
+		button.DeviceID != 28 || button.ChannelNo != 1 || button.Level != LIGHT_LEVEL_ON {
+		t.Errorf("bad button assignment: %#v", button)
+	}
+	if string(panel.Remark) != "DDP" {
+		t.Errorf("bad remark %q", panel.Remark)
+	}
+	relay := config.Devices[0].makeDevice().(*SimulatedRelay)
+	if len(relay.ChannelStatus()) != DEFAULT_ZONEBEAST_CHANNELS {
+		t.Errorf("bad default channel count")
+	}
+
+	ioutil.WriteFile(path, []byte(`{
+		"devices": [
+			{"type": "foo", "subnet": 1, "device": 28},
+			{"type": "zonebeast", "subnet": 1, "device": 28},
+			{"type": "ddp", "subnet": 1, "device": 255, "buttons": [{"button": 17}]}
+		]
+	}`), 0644)
+	_, err = LoadSimulatorConfig(path)
+	if err == nil {
+		t.Fatalf("no error for a bad config")
+	}
+	for _, expected := range []string{
+		`devices[0]: unknown device type "foo"`,
+		"devices[1]: duplicate address 1:28",
+		"devices[2]: broadcast address 1:255",
+		"devices[2].buttons[0]: bad button: 17",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error message %q doesn't contain %q", err.Error(), expected)
+		}
+	}
+}
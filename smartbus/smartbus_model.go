@@ -1,49 +1,167 @@
 package smartbus
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/contactless/wbgo"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// the defaults, may be overridden in the config file
 const (
-	// FIXME: make these configurable?
 	NUM_VIRTUAL_RELAYS  = 15
 	REQUEST_QUEUE_SIZE  = 16
 	REQUEST_NUM_RETRIES = 20
 	REQUEST_TIMEOUT     = 500 * time.Millisecond
+	// the minimum interval between the requests,
+	// a bit more than 16 bytes at 9600 baud
+	REQUEST_MIN_INTERVAL = 20 * time.Millisecond
+
+	DEFAULT_MAX_MISSED_POLLS   = 3
+	DEFAULT_DISCOVERY_INTERVAL = 10 * time.Minute
 )
 
-type Request struct {
-	name           string
-	expectedOpcode uint16
-	thunk          func()
-}
+// the time to wait for the retained values of
+// the virtual relays after the driver start
+const RELAY_RESTORE_TIMEOUT = 5 * time.Second
 
-func newRequest(name string, expectedResponse Message, thunk func()) *Request {
-	return &Request{name, expectedResponse.Opcode(), thunk}
+type Request struct {
+	name             string
+	subnetID         uint8
+	deviceID         uint8
+	expectedResponse Message
+	thunk            func()
+	onDone           func(success bool)
+	priority         int
+	coalescingKey    string
+}
+
+// newRequest makes a request to the specified device. The key
+// fields of expectedResponse (see responseKey()) must be set
+// to the values that are expected in the response. The request
+// has normal priority and no coalescing key. The request fails
+// if the response reports a failure (see responseSucceeded()).
+func newRequest(name string, smartDev *SmartbusDevice, expectedResponse Message, thunk func()) *Request {
+	return &Request{
+		name:             name,
+		subnetID:         smartDev.SubnetID,
+		deviceID:         smartDev.DeviceID,
+		expectedResponse: expectedResponse,
+		thunk:            thunk,
+		priority:         QUEUE_PRIORITY_NORMAL,
+	}
 }
 
 func (request *Request) Run() {
 	request.thunk()
 }
 
-func (request *Request) IsResponse(msg Message) bool {
-	return msg.Opcode() == request.expectedOpcode
+// IsResponse returns true if the message is the expected
+// response sent by the target device of the request. If the
+// expected response has key fields, they must match, too.
+func (request *Request) IsResponse(msg Message, header *MessageHeader) bool {
+	return matchResponse(msg, header, request.subnetID, request.deviceID,
+		request.expectedResponse.Opcode(), responseKey(request.expectedResponse))
+}
+
+// matchResponse returns true if the message has the specified
+// opcode and is sent by the specified device (any device if the
+// address is a broadcast one). If expectedKey isn't empty, the
+// key fields of the message must match it (see responseKey()).
+func matchResponse(msg Message, header *MessageHeader, subnetID uint8, deviceID uint8, opcode uint16, expectedKey string) bool {
+	if msg.Opcode() != opcode {
+		return false
+	}
+	if subnetID != BROADCAST_SUBNET && subnetID != header.OrigSubnetID ||
+		deviceID != BROADCAST_DEVICE && deviceID != header.OrigDeviceID {
+		return false
+	}
+	return expectedKey == "" || responseKey(msg) == expectedKey
+}
+
+// responseKey returns the fields of the response that identify
+// the request it's sent for, such as the channel number, or
+// an empty string if the message has no such fields (raw
+// messages included)
+func responseKey(msg Message) string {
+	switch msg := msg.(type) {
+	case *SingleChannelControlResponse:
+		return fmt.Sprintf("%d", msg.ChannelNo)
+	case *QueryPanelButtonAssignmentResponse:
+		return fmt.Sprintf("%d/%d", msg.ButtonNo, msg.FunctionNo)
+	case *AssignPanelButtonResponse:
+		return fmt.Sprintf("%d/%d", msg.ButtonNo, msg.FunctionNo)
+	}
+	return ""
+}
+
+// responseSucceeded returns false if the response
+// reports that the request has failed
+func responseSucceeded(msg Message) bool {
+	switch msg := msg.(type) {
+	case *SingleChannelControlResponse:
+		return msg.Success
+	}
+	return true
+}
+
+// requestKey returns the fields of the request that must be
+// matched by the key fields of the response (see responseKey())
+func requestKey(msg Message) string {
+	switch msg := msg.(type) {
+	case *SingleChannelControlCommand:
+		return fmt.Sprintf("%d", msg.ChannelNo)
+	case *QueryPanelButtonAssignment:
+		return fmt.Sprintf("%d/%d", msg.ButtonNo, msg.FunctionNo)
+	case *AssignPanelButton:
+		return fmt.Sprintf("%d/%d", msg.ButtonNo, msg.FunctionNo)
+	}
+	return ""
 }
 
 func (request *Request) Name() string {
 	return request.name
 }
 
+func (request *Request) Target() (uint8, uint8) {
+	return request.subnetID, request.deviceID
+}
+
+func (request *Request) Priority() int {
+	return request.priority
+}
+
+func (request *Request) CoalescingKey() string {
+	return request.coalescingKey
+}
+
+// Done reports the success of the request, which fails if
+// there's no response or the response reports a failure
+func (request *Request) Done(response *SmartbusMessage) {
+	if request.onDone != nil {
+		request.onDone(response != nil && responseSucceeded(response.Message.(Message)))
+	}
+}
+
 type Connector func() (SmartbusIO, error)
 
 type RealDeviceModel interface {
 	wbgo.LocalDeviceModel
 	Type() uint16
 	Poll()
+	SetNameAndTitle(name, title string)
+	IsOnline() bool
+	LastSeen() time.Time
+	markSeen()
+	markUnconfirmed()
+	beforePoll(maxMissedPolls int)
+	saveState(state *DeviceState)
+	restoreState(state *DeviceState)
 }
 
 type DeviceConstructor func(model *SmartbusModel, smartDev *SmartbusDevice) RealDeviceModel
@@ -54,9 +172,19 @@ func RegisterDeviceModelType(construct DeviceConstructor) {
 	smartbusDeviceModelTypes[construct(nil, nil).Type()] = construct
 }
 
+// VirtualRelayDevice holds the virtual relays. The relays can be
+// switched from the bus as well as via MQTT, and their values are
+// restored from the retained MQTT messages upon driver restart
+// (see restoreRelay()). onChange, if set, is called when a relay
+// is switched via MQTT so that the change can be announced on
+// the bus.
 type VirtualRelayDevice struct {
 	wbgo.DeviceBase
-	channelStatus [NUM_VIRTUAL_RELAYS]bool
+	channelStatus []bool
+	// restoring is set for the relays that haven't been
+	// switched since the start and thus may be restored
+	restoring []bool
+	onChange  func(channelNo int)
 }
 
 func (dm *VirtualRelayDevice) Publish() {
@@ -66,15 +194,16 @@ func (dm *VirtualRelayDevice) Publish() {
 			v = "1"
 		}
 		controlName := fmt.Sprintf("VirtualRelay%d", i+1)
-		dm.Observer.OnNewControl(dm, controlName, "switch", v, true, -1, true)
+		dm.Observer.OnNewControl(dm, controlName, "switch", v, false, -1, true)
 	}
 }
 
 func (dm *VirtualRelayDevice) SetRelayOn(channelNo int, on bool) {
-	if channelNo < 1 || channelNo > NUM_VIRTUAL_RELAYS {
+	if channelNo < 1 || channelNo > len(dm.channelStatus) {
 		wbgo.Warn.Printf("invalid virtual relay channel %d", channelNo)
 		return
 	}
+	dm.restoring[channelNo-1] = false
 	if dm.channelStatus[channelNo-1] == on {
 		return
 	}
@@ -88,31 +217,161 @@ func (dm *VirtualRelayDevice) SetRelayOn(channelNo int, on bool) {
 }
 
 func (dm *VirtualRelayDevice) RelayStatus() []bool {
-	return dm.channelStatus[:]
+	return dm.channelStatus
+}
+
+func (dm *VirtualRelayDevice) RelayCount() int {
+	return len(dm.channelStatus)
+}
+
+// relayChannel returns the channel number of the relay
+// control or 0 if the control name is invalid
+func (dm *VirtualRelayDevice) relayChannel(name string) int {
+	channelNo, err := strconv.Atoi(strings.TrimPrefix(name, "VirtualRelay"))
+	if err != nil || channelNo < 1 || channelNo > len(dm.channelStatus) {
+		wbgo.Warn.Printf("bad virtual relay control name: %s", name)
+		return 0
+	}
+	return channelNo
+}
+
+// restoreRelay sets the relay to the value retained by the
+// broker. Only the first retained value of each relay is used,
+// and the relays switched since the start are not restored.
+// As the retained value is replaced by the default one upon
+// Publish(), the restored value is published again.
+// The change is not announced on the bus. restoreRelay
+// returns true when there are no relays left to restore.
+func (dm *VirtualRelayDevice) restoreRelay(name, value string) bool {
+	if channelNo := dm.relayChannel(name); channelNo != 0 && dm.restoring[channelNo-1] {
+		dm.restoring[channelNo-1] = false
+		if on := value == "1"; dm.channelStatus[channelNo-1] != on {
+			wbgo.Debug.Printf("restoring %s/%s: %s", dm.Name(), name, value)
+			dm.channelStatus[channelNo-1] = on
+			dm.Observer.OnValue(dm, name, boolValue(on))
+		}
+	}
+	for _, restoring := range dm.restoring {
+		if restoring {
+			return false
+		}
+	}
+	return true
 }
 
 func (dm *VirtualRelayDevice) AcceptValue(name, value string) {
-	// FIXME: support retained values for virtual relays
+	dm.restoreRelay(name, value)
 }
 
 func (dm *VirtualRelayDevice) AcceptOnValue(name, value string) bool {
-	// virtual relays cannot be changed
-	return false
+	channelNo := dm.relayChannel(name)
+	if channelNo == 0 {
+		return false
+	}
+	dm.restoring[channelNo-1] = false
+	on := value == "1"
+	if dm.channelStatus[channelNo-1] != on {
+		dm.channelStatus[channelNo-1] = on
+		if dm.onChange != nil {
+			dm.onChange(channelNo)
+		}
+	}
+	return true
 }
 
 func (dm *VirtualRelayDevice) IsVirtual() bool {
 	return true
 }
 
-func NewVirtualRelayDevice() *VirtualRelayDevice {
-	r := &VirtualRelayDevice{}
+func NewVirtualRelayDevice(count int) *VirtualRelayDevice {
+	r := &VirtualRelayDevice{
+		channelStatus: make([]bool, count),
+		restoring:     make([]bool, count),
+	}
+	for i := range r.restoring {
+		r.restoring[i] = true
+	}
 	r.DevName = "sbusvrelay"
 	r.DevTitle = "Smartbus Virtual Relays"
 	return r
 }
 
+// DriverDevice is a virtual device that reflects
+// the state of the driver itself. It also provides
+// raw command channel for sending arbitrary messages
+// and a button that starts the bus scan.
+type DriverDevice struct {
+	wbgo.DeviceBase
+	connected    bool
+	onRawCommand func(value string)
+	onScan       func()
+	onRediscover func()
+}
+
+func (dm *DriverDevice) Publish(connected bool) {
+	dm.connected = connected
+	dm.Observer.OnNewControl(dm, "Connected", "switch", boolValue(connected), true, -1, true)
+	dm.Observer.OnNewControl(dm, "Raw Command", "text", "", false, -1, false)
+	dm.Observer.OnNewControl(dm, "Raw Response", "text", "", true, -1, false)
+	dm.Observer.OnNewControl(dm, "Scan", "pushbutton", "0", false, -1, false)
+	dm.Observer.OnNewControl(dm, "Scan Result", "text", "", true, -1, false)
+	dm.Observer.OnNewControl(dm, "Rediscover", "pushbutton", "0", false, -1, false)
+}
+
+func (dm *DriverDevice) SetRawResponse(value string) {
+	dm.Observer.OnValue(dm, "Raw Response", value)
+}
+
+func (dm *DriverDevice) SetScanResult(value string) {
+	dm.Observer.OnValue(dm, "Scan Result", value)
+}
+
+func (dm *DriverDevice) SetConnected(connected bool) {
+	if dm.connected == connected {
+		return
+	}
+	dm.connected = connected
+	dm.Observer.OnValue(dm, "Connected", boolValue(connected))
+}
+
+func (dm *DriverDevice) AcceptValue(name, value string) {
+	// ignore retained values
+}
+
+func (dm *DriverDevice) AcceptOnValue(name, value string) bool {
+	switch {
+	case name == "Raw Command" && dm.onRawCommand != nil:
+		dm.onRawCommand(value)
+		return true
+	case name == "Scan" && dm.onScan != nil:
+		dm.onScan()
+	case name == "Rediscover" && dm.onRediscover != nil:
+		dm.onRediscover()
+	}
+	return false
+}
+
+func (dm *DriverDevice) IsVirtual() bool {
+	return true
+}
+
+func NewDriverDevice(onRawCommand func(value string), onScan func(), onRediscover func()) *DriverDevice {
+	r := &DriverDevice{onRawCommand: onRawCommand, onScan: onScan, onRediscover: onRediscover}
+	r.DevName = "sbusdriver"
+	r.DevTitle = "Smart-Bus Driver"
+	return r
+}
+
+func boolValue(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
 type SmartbusModel struct {
 	wbgo.ModelBase
+	config        *BusConfig
 	queue         *MessageQueue
 	connector     Connector
 	deviceMap     map[uint16]RealDeviceModel
@@ -121,96 +380,520 @@ type SmartbusModel struct {
 	deviceType    uint16
 	conn          *SmartbusConnection
 	ep            *SmartbusEndpoint
+	linkIO        *ReconnectingIO
 	virtualRelays *VirtualRelayDevice
+	virtualDevs   []*VirtualDevice
+	driverDev     *DriverDevice
+	stats         *LinkStats
+	statsDev      *StatsDevice
 	broadcastDev  *SmartbusDevice
 	timerFunc     TimerFunc
+	rawMutex      sync.Mutex
+	pendingRaw    map[uint16]*RawCommand
+	mirror        *TrafficMirror
+	scanner       *Scanner
+	client        wbgo.MQTTClient
+	quitDiscovery chan struct{}
+	quitRestore   chan struct{}
+	savedState    *BusState
 }
 
 func NewSmartbusModel(connector Connector, subnetID uint8,
-	deviceID uint8, deviceType uint16, timerFunc TimerFunc) (model *SmartbusModel) {
+	deviceID uint8, deviceType uint16, timerFunc TimerFunc) *SmartbusModel {
+	config := NewBusConfig()
+	config.SubnetID = subnetID
+	config.DeviceID = deviceID
+	config.DeviceType = deviceType
+	return NewConfiguredSmartbusModel(connector, config, timerFunc)
+}
+
+func NewConfiguredSmartbusModel(connector Connector, config *BusConfig,
+	timerFunc TimerFunc) (model *SmartbusModel) {
 	model = &SmartbusModel{
+		config: config,
 		queue: NewMessageQueue(
-			timerFunc, REQUEST_TIMEOUT, REQUEST_NUM_RETRIES, REQUEST_QUEUE_SIZE),
+			timerFunc, config.requestTimeout(), config.Queue.Retries, config.Queue.Size),
 		connector:     connector,
-		subnetID:      subnetID,
-		deviceID:      deviceID,
-		deviceType:    deviceType,
+		subnetID:      config.SubnetID,
+		deviceID:      config.DeviceID,
+		deviceType:    config.DeviceType,
 		deviceMap:     make(map[uint16]RealDeviceModel),
-		virtualRelays: NewVirtualRelayDevice(),
+		pendingRaw:    make(map[uint16]*RawCommand),
+		virtualRelays: NewVirtualRelayDevice(config.VirtualRelays),
 		timerFunc:     timerFunc,
 	}
+	model.driverDev = NewDriverDevice(model.handleRawCommand, model.handleScan, model.rediscover)
+	model.virtualRelays.DevName = model.qualifiedName(model.virtualRelays.DevName)
+	model.virtualRelays.DevTitle = model.qualifiedTitle(model.virtualRelays.DevTitle)
+	for i := range config.VirtualDevices {
+		model.virtualDevs = append(model.virtualDevs, newVirtualDevice(model, &config.VirtualDevices[i]))
+	}
+	model.driverDev.DevName = model.qualifiedName(model.driverDev.DevName)
+	model.driverDev.DevTitle = model.qualifiedTitle(model.driverDev.DevTitle)
+	model.queue.SetMinInterval(config.requestMinInterval())
+	if config.Statistics {
+		model.stats = NewLinkStats()
+		model.statsDev = NewStatsDevice()
+		model.statsDev.DevName = model.qualifiedName(model.statsDev.DevName)
+		model.statsDev.DevTitle = model.qualifiedTitle(model.statsDev.DevTitle)
+		model.queue.SetLinkStats(model.stats)
+	}
 	return
 }
 
+// qualifiedName prepends the bus name, if any, to the device name
+// so that the devices on different buses don't collide
+func (model *SmartbusModel) qualifiedName(name string) string {
+	if model.config.Name == "" {
+		return name
+	}
+	return model.config.Name + "_" + name
+}
+
+func (model *SmartbusModel) qualifiedTitle(title string) string {
+	if model.config.Name == "" {
+		return title
+	}
+	return fmt.Sprintf("%s (%s)", title, model.config.Name)
+}
+
 func (model *SmartbusModel) SetTimerFunc(timerFunc TimerFunc) {
 	model.timerFunc = timerFunc
 }
 
-func (model *SmartbusModel) Start() error {
-	smartbusIO, err := model.connector()
-	if err != nil {
-		return err
+// SetMQTTClient sets MQTT client to be used for bus traffic
+// mirroring and for publishing the errors of the controls
+// of offline devices. Must be called before Start().
+func (model *SmartbusModel) SetMQTTClient(client wbgo.MQTTClient) {
+	model.client = client
+	if model.config.Mirror.Enabled {
+		model.mirror = NewTrafficMirror(&model.config.Mirror, model.config.mirrorTopic(), client)
 	}
-	model.conn = NewSmartbusConnection(smartbusIO)
+}
+
+// LinkStats returns the link statistics or nil if
+// the statistics are not enabled in the config
+func (model *SmartbusModel) LinkStats() *LinkStats {
+	return model.stats
+}
+
+// TrafficMirror returns the bus traffic mirror or nil
+// if the mirroring is not enabled
+func (model *SmartbusModel) TrafficMirror() *TrafficMirror {
+	return model.mirror
+}
+
+func (model *SmartbusModel) Start() error {
+	// the first connection attempt is made synchronously here,
+	// a failed attempt is retried in background
+	model.linkIO = NewReconnectingIO(model.connector, model.timerFunc, model.onLinkStateChange)
+	model.conn = NewSmartbusConnection(model.linkIO)
 	model.ep = model.conn.MakeSmartbusEndpoint(model.subnetID, model.deviceID, model.deviceType)
+	model.ep.SetRequestQueue(model.queue)
+	if model.stats != nil {
+		// the frames are counted before they're handled
+		model.stats.Attach(model.ep)
+	}
 	model.ep.Observe(model)
+	emulator := &relayEmulator{
+		model:  model,
+		ep:     model.ep,
+		remark: []uint8(model.config.Remark),
+		relays: model.virtualRelays,
+	}
+	model.ep.Observe(emulator)
+	model.virtualRelays.onChange = emulator.announce
 	model.ep.Observe(NewMessageDumper("MESSAGE FOR US"))
 	model.ep.AddInputSniffer(NewMessageDumper("NOT FOR US"))
 	model.ep.AddOutputSniffer(NewMessageDumper("OUTGOING"))
+	if model.mirror != nil {
+		model.mirror.Attach(model.ep)
+	}
+	model.scanner = NewScanner(model.ep, model.timerFunc,
+		model.config.scanTimeout(), model.config.Scan.Retries)
 	model.broadcastDev = model.ep.GetBroadcastDevice()
 	model.Observer.OnNewDevice(model.virtualRelays)
+	model.quitRestore = make(chan struct{})
+	model.restoreRelays(model.virtualRelays)
 	model.virtualRelays.Publish()
+	for _, vdev := range model.virtualDevs {
+		vdev.attach(model.conn)
+		model.Observer.OnNewDevice(vdev.relays)
+		model.restoreRelays(vdev.relays)
+		vdev.relays.Publish()
+	}
+	model.Observer.OnNewDevice(model.driverDev)
+	model.driverDev.Publish(model.linkIO.IsConnected())
+	if model.statsDev != nil {
+		model.Observer.OnNewDevice(model.statsDev)
+		model.statsDev.Publish(model.statsValues())
+	}
+	if model.config.StateFile != "" {
+		model.restoreDevices()
+	}
 	model.queue.Start()
-	model.broadcastDev.ReadMACAddress() // discover devices
-	return err
+	if model.linkIO.IsConnected() {
+		model.broadcastDev.ReadMACAddress() // discover devices
+	}
+	if model.timerFunc != nil && model.config.Discovery.Interval > 0 {
+		model.quitDiscovery = make(chan struct{})
+		go model.runDiscovery(model.config.discoveryInterval(), model.quitDiscovery)
+	}
+	return nil
+}
+
+// runDiscovery periodically rediscovers the devices
+// until the quit channel is closed
+func (model *SmartbusModel) runDiscovery(interval time.Duration, quit chan struct{}) {
+	for {
+		timer := model.timerFunc(interval)
+		select {
+		case <-quit:
+			timer.Stop()
+			return
+		case <-timer.GetChannel():
+			model.Observer.CallSync(model.rediscover)
+		}
+	}
+}
+
+// rediscover sends a broadcast ReadMACAddress query and
+// also probes the known addresses that are silent, i.e. the
+// configured devices that weren't seen yet and the devices
+// that went offline. Some of the devices may miss the
+// broadcast query because of collisions on the bus.
+func (model *SmartbusModel) rediscover() {
+	wbgo.Debug.Printf("rediscovering devices")
+	model.broadcastDev.ReadMACAddress()
+	for _, key := range model.silentDevices() {
+		model.ep.GetSmartbusDevice(uint8(key>>8), uint8(key)).ReadMACAddress()
+	}
+}
+
+func (model *SmartbusModel) silentDevices() []uint16 {
+	keys := make([]uint16, 0)
+	for _, dc := range model.config.Devices {
+		key := deviceKey(dc.SubnetID, dc.DeviceID)
+		if _, found := model.deviceMap[key]; !found && !dc.Disabled {
+			keys = append(keys, key)
+		}
+	}
+	offline := make([]int, 0)
+	for key, dev := range model.deviceMap {
+		if !dev.IsOnline() {
+			offline = append(offline, int(key))
+		}
+	}
+	sort.Ints(offline)
+	for _, key := range offline {
+		keys = append(keys, uint16(key))
+	}
+	return keys
+}
+
+func (model *SmartbusModel) onLinkStateChange(connected bool) {
+	model.Observer.CallSync(func() {
+		model.driverDev.SetConnected(connected)
+		if connected {
+			wbgo.Warn.Printf("Smart-Bus connection restored, rediscovering devices")
+			model.rediscover()
+		}
+	})
 }
 
 func (model *SmartbusModel) Stop() {
+	if model.quitDiscovery != nil {
+		close(model.quitDiscovery)
+		model.quitDiscovery = nil
+	}
+	if model.quitRestore != nil {
+		close(model.quitRestore)
+		model.quitRestore = nil
+	}
+	model.scanner.Stop()
 	model.queue.Stop()
+	if model.config.StateFile != "" {
+		model.saveStateIfChanged()
+	}
 	model.conn.Close()
 }
 
 func (model *SmartbusModel) Poll() {
 	for _, dev := range model.deviceMap {
+		dev.beforePoll(model.config.MaxMissedPolls)
 		dev.Poll()
 	}
+	if model.statsDev != nil {
+		model.statsDev.Update(model.statsValues())
+	}
+	if model.config.StateFile != "" {
+		model.saveStateIfChanged()
+	}
+}
+
+func (model *SmartbusModel) statsValues() map[string]string {
+	values := model.stats.Values()
+	values[STATS_QUEUE_DEPTH] = strconv.Itoa(model.queue.Depth())
+	return values
 }
 
-func (model *SmartbusModel) enqueueRequest(name string, expectedResponse Message, thunk func()) {
-	model.queue.Enqueue(newRequest(name, expectedResponse, thunk))
+// enqueueRequest queues the request. onDone, if not nil,
+// is invoked on the driver goroutine when the request
+// completes or fails after all the retries. If the request
+// cannot be queued, onDone(false) is invoked right away
+// and the error is returned.
+func (model *SmartbusModel) enqueueRequest(request *Request, onDone func(success bool)) error {
+	if onDone != nil {
+		request.onDone = func(success bool) {
+			model.Observer.CallSync(func() {
+				onDone(success)
+			})
+		}
+	}
+	err := model.queue.Enqueue(request)
+	if err != nil {
+		wbgo.Error.Printf("failed to enqueue %s: %s", request.name, err)
+		if onDone != nil {
+			onDone(false)
+		}
+	}
+	return err
 }
 
 func (model *SmartbusModel) ensureDevice(header *MessageHeader) RealDeviceModel {
-	deviceKey := (uint16(header.OrigSubnetID) << 8) + uint16(header.OrigDeviceID)
-	var dev, found = model.deviceMap[deviceKey]
+	var dev, found = model.deviceMap[deviceKey(header.OrigSubnetID, header.OrigDeviceID)]
 	if found {
 		return dev
 	}
+	dev = model.newDevice(header.OrigSubnetID, header.OrigDeviceID, header.OrigDeviceType)
+	if dev != nil {
+		model.Observer.OnNewDevice(dev)
+	}
+	return dev
+}
 
-	construct, found := smartbusDeviceModelTypes[header.OrigDeviceType]
+// newDevice creates the device model and adds it to the device
+// map. nil is returned if the device is disabled in the config
+// or its type is not supported.
+func (model *SmartbusModel) newDevice(subnetID uint8, deviceID uint8, deviceType uint16) RealDeviceModel {
+	devConfig := model.config.deviceConfig(subnetID, deviceID)
+	if devConfig != nil {
+		if devConfig.Disabled {
+			return nil
+		}
+		if devConfig.DeviceType != 0 {
+			deviceType = devConfig.DeviceType
+		}
+	}
+
+	construct, found := smartbusDeviceModelTypes[deviceType]
 	if !found {
 		wbgo.Debug.Printf("unrecognized device type %04x @ %d:%d",
-			header.OrigDeviceType, header.OrigSubnetID, header.OrigDeviceID)
+			deviceType, subnetID, deviceID)
 		return nil
 	}
 
-	smartDev := model.ep.GetSmartbusDevice(header.OrigSubnetID, header.OrigDeviceID)
-	dev = construct(model, smartDev)
-	model.deviceMap[deviceKey] = dev
+	smartDev := model.ep.GetSmartbusDevice(subnetID, deviceID)
+	dev := construct(model, smartDev)
+	if devConfig != nil {
+		dev.SetNameAndTitle(devConfig.Name, devConfig.Title)
+	}
+	model.deviceMap[deviceKey(subnetID, deviceID)] = dev
 	wbgo.Debug.Printf("NEW DEVICE: %#v (name: %v)\n", dev, dev.Name())
-	model.Observer.OnNewDevice(dev)
 	return dev
 }
 
+func (model *SmartbusModel) handleRawCommand(value string) {
+	cmd, err := ParseRawCommand([]byte(value))
+	var msg Message
+	if err == nil {
+		msg, err = cmd.Message()
+	}
+	if err != nil {
+		wbgo.Error.Printf("bad raw command %s: %s", value, err)
+		model.driverDev.SetRawResponse(rawErrorResponse(err))
+		return
+	}
+
+	smartDev := model.ep.GetSmartbusDevice(*cmd.SubnetID, *cmd.DeviceID)
+	if cmd.Response == nil {
+		smartDev.Send(msg)
+		return
+	}
+
+	// the queue runs the requests to the same device one by
+	// one, so there's at most one pending raw command per device
+	key := deviceKey(*cmd.SubnetID, *cmd.DeviceID)
+	expectedResponse := &RawMessage{RawOpcode: uint16(*cmd.Response)}
+	request := newRequest("RawCommand", smartDev, expectedResponse, func() {
+		model.rawMutex.Lock()
+		model.pendingRaw[key] = cmd
+		model.rawMutex.Unlock()
+		smartDev.Send(msg)
+	})
+	request.priority = QUEUE_PRIORITY_USER
+	err = model.enqueueRequest(request, func(success bool) {
+		if !success {
+			model.rawCommandFailed(key, cmd)
+		}
+	})
+	if err != nil {
+		model.driverDev.SetRawResponse(rawErrorResponse(err))
+	}
+}
+
+// rawCommandFailed publishes an error response if no response
+// was received for the raw command. Nothing is done if the
+// command is no longer pending, e.g. the next command for the
+// same device is already being executed.
+func (model *SmartbusModel) rawCommandFailed(key uint16, cmd *RawCommand) {
+	model.rawMutex.Lock()
+	pending := model.pendingRaw[key] == cmd
+	if pending {
+		delete(model.pendingRaw, key)
+	}
+	model.rawMutex.Unlock()
+	if pending {
+		model.driverDev.SetRawResponse(rawErrorResponse(errors.New("no response")))
+	}
+}
+
+// handleScan starts the bus scan in background. The resulting
+// inventory is published as "Scan Result" and, if specified
+// in the config, written to the inventory file.
+func (model *SmartbusModel) handleScan() {
+	if model.scanner.IsActive() {
+		wbgo.Warn.Printf("bus scan is already in progress")
+		return
+	}
+	wbgo.Warn.Printf("starting bus scan")
+	go func() {
+		entries, err := model.scanner.Scan(model.config.scanAddresses())
+		if err != nil {
+			wbgo.Error.Printf("bus scan failed: %s", err)
+			return
+		}
+		wbgo.Warn.Printf("bus scan finished, %d device(s) found", len(entries))
+		if model.config.Scan.Output != "" {
+			if err := writeInventoryFile(model.config.Scan.Output, entries, model.config.Scan.Format); err != nil {
+				wbgo.Error.Printf("failed to write the inventory: %s", err)
+			}
+		}
+		bs, err := json.Marshal(entries)
+		if err != nil {
+			// shouldn't happen
+			panic(fmt.Sprintf("failed to marshal the inventory: %s", err))
+		}
+		model.Observer.CallSync(func() {
+			model.driverDev.SetScanResult(string(bs))
+		})
+	}()
+}
+
+// checkRawResponse publishes the message if it's the response
+// to one of the raw commands being executed. The commands sent
+// to the device itself take precedence over the broadcast ones.
+func (model *SmartbusModel) checkRawResponse(msg Message, header *MessageHeader) {
+	keys := []uint16{
+		deviceKey(header.OrigSubnetID, header.OrigDeviceID),
+		deviceKey(header.OrigSubnetID, BROADCAST_DEVICE),
+		deviceKey(BROADCAST_SUBNET, header.OrigDeviceID),
+		deviceKey(BROADCAST_SUBNET, BROADCAST_DEVICE),
+	}
+	model.rawMutex.Lock()
+	var cmd *RawCommand
+	for _, key := range keys {
+		if pending := model.pendingRaw[key]; pending != nil && pending.IsResponse(msg, header) {
+			cmd = pending
+			delete(model.pendingRaw, key)
+			break
+		}
+	}
+	model.rawMutex.Unlock()
+	if cmd == nil {
+		return
+	}
+	if resp, err := NewRawResponse(msg, header); err != nil {
+		wbgo.Error.Printf("failed to encode raw response: %s", err)
+		model.driverDev.SetRawResponse(rawErrorResponse(err))
+	} else {
+		model.driverDev.SetRawResponse(resp.String())
+	}
+}
+
 func (model *SmartbusModel) OnAnything(msg Message, header *MessageHeader) {
 	model.Observer.CallSync(func() {
+		model.queue.HandleReceivedMessage(msg, header)
+		model.checkRawResponse(msg, header)
 		dev := model.ensureDevice(header)
 		if dev != nil {
+			dev.markSeen()
 			wbgo.Visit(dev, msg, "On")
 		}
 	})
 }
 
+// restoreRelays subscribes to the values of the virtual relays
+// retained by the broker so that the relays are restored upon
+// driver restart. Must be called before the relays are published.
+// The subscription is removed when all the relays are restored
+// or after RELAY_RESTORE_TIMEOUT, whichever comes first.
+func (model *SmartbusModel) restoreRelays(relays *VirtualRelayDevice) {
+	if model.client == nil || relays.RelayCount() == 0 {
+		return
+	}
+	topic := fmt.Sprintf("/devices/%s/controls/+", relays.Name())
+	restored := make(chan struct{})
+	var once sync.Once
+	model.client.Subscribe(func(msg wbgo.MQTTMessage) {
+		if !msg.Retained {
+			return
+		}
+		name := msg.Topic[strings.LastIndex(msg.Topic, "/")+1:]
+		model.Observer.CallSync(func() {
+			if relays.restoreRelay(name, msg.Payload) {
+				once.Do(func() { close(restored) })
+			}
+		})
+	}, topic)
+
+	// the client must not be waited for while it's running
+	// the handler, so the subscription is removed by
+	// a separate goroutine
+	timer := model.newTimer(RELAY_RESTORE_TIMEOUT)
+	go func(quit chan struct{}) {
+		select {
+		case <-quit:
+			timer.Stop()
+			return
+		case <-restored:
+			timer.Stop()
+		case <-timer.GetChannel():
+		}
+		model.client.Unsubscribe(topic)
+	}(model.quitRestore)
+}
+
+// newTimer makes a timer using the timer function of the
+// model, or a real timer if there's no timer function
+func (model *SmartbusModel) newTimer(d time.Duration) wbgo.Timer {
+	if model.timerFunc == nil {
+		return wbgo.NewRealTimer(d)
+	}
+	return model.timerFunc(d)
+}
+
+// publishControlError sets the error meta of the control,
+// an empty value clears the error
+func (model *SmartbusModel) publishControlError(devName, controlName, value string) {
+	if model.client == nil {
+		return
+	}
+	model.client.Publish(wbgo.MQTTMessage{
+		fmt.Sprintf("/devices/%s/controls/%s/meta/error", devName, controlName),
+		value, 1, true})
+}
+
 func (model *SmartbusModel) SetVirtualRelayOn(channelNo int, on bool) {
 	model.virtualRelays.SetRelayOn(channelNo, on)
 }
@@ -222,21 +905,157 @@ func (model *SmartbusModel) VirtualRelayStatus() []bool {
 type DeviceModelBase struct {
 	nameBase  string
 	titleBase string
+	name      string
+	title     string
 	model     *SmartbusModel
 	smartDev  *SmartbusDevice
 	Observer  wbgo.DeviceObserver
+	// unpolled is set for the devices that aren't polled
+	// and thus cannot be tracked as online or offline
+	unpolled    bool
+	controls    []string
+	lastSeen    time.Time
+	pollPending bool
+	missedPolls int
+	offline     bool
+	unconfirmed bool
+	// writeErrors holds the controls for which
+	// the last command has failed
+	writeErrors map[string]bool
 }
 
 func (dm *DeviceModelBase) Name() string {
-	return fmt.Sprintf("%s%d_%d", dm.nameBase, dm.smartDev.SubnetID, dm.smartDev.DeviceID)
+	if dm.name != "" {
+		return dm.name
+	}
+	return dm.model.qualifiedName(
+		fmt.Sprintf("%s%d_%d", dm.nameBase, dm.smartDev.SubnetID, dm.smartDev.DeviceID))
 }
 
 func (dm *DeviceModelBase) Title() string {
-	return fmt.Sprintf("%s %d:%d", dm.titleBase, dm.smartDev.SubnetID, dm.smartDev.DeviceID)
+	if dm.title != "" {
+		return dm.title
+	}
+	return dm.model.qualifiedTitle(
+		fmt.Sprintf("%s %d:%d", dm.titleBase, dm.smartDev.SubnetID, dm.smartDev.DeviceID))
+}
+
+// SetNameAndTitle overrides the default device name and title.
+// Empty values are ignored.
+func (dm *DeviceModelBase) SetNameAndTitle(name, title string) {
+	dm.name = name
+	dm.title = title
 }
 
 func (dev *DeviceModelBase) Observe(observer wbgo.DeviceObserver) {
-	dev.Observer = observer
+	dev.Observer = &controlTracker{observer, dev}
+}
+
+// IsOnline returns false if the device didn't answer
+// the specified number of polls in a row
+func (dev *DeviceModelBase) IsOnline() bool {
+	return !dev.offline
+}
+
+// LastSeen returns the time when the last message
+// was received from the device
+func (dev *DeviceModelBase) LastSeen() time.Time {
+	return dev.lastSeen
+}
+
+func (dev *DeviceModelBase) markSeen() {
+	dev.lastSeen = time.Now()
+	dev.pollPending = false
+	dev.missedPolls = 0
+	switch {
+	case dev.unconfirmed:
+		wbgo.Debug.Printf("device %s confirmed", dev.Name())
+		dev.unconfirmed = false
+		dev.setOffline(false)
+	case dev.offline:
+		wbgo.Warn.Printf("device %s is back online", dev.Name())
+		dev.setOffline(false)
+	}
+}
+
+// markUnconfirmed marks the device that was restored from the
+// state file as offline until anything is received from it
+func (dev *DeviceModelBase) markUnconfirmed() {
+	dev.unconfirmed = true
+	dev.offline = true
+}
+
+// saveState fills in the device specific part of the state
+func (dev *DeviceModelBase) saveState(state *DeviceState) {}
+
+// restoreState recreates the controls of the device
+// using the state loaded from the state file
+func (dev *DeviceModelBase) restoreState(state *DeviceState) {}
+
+// beforePoll counts the previous poll as missed if nothing
+// was received from the device since it was made
+func (dev *DeviceModelBase) beforePoll(maxMissedPolls int) {
+	if dev.unpolled || maxMissedPolls <= 0 {
+		return
+	}
+	if dev.pollPending {
+		dev.missedPolls++
+		if !dev.offline && dev.missedPolls >= maxMissedPolls {
+			wbgo.Warn.Printf("device %s is offline (%d polls missed)", dev.Name(), dev.missedPolls)
+			dev.setOffline(true)
+		}
+	}
+	dev.pollPending = true
+}
+
+func (dev *DeviceModelBase) setOffline(offline bool) {
+	dev.offline = offline
+	for _, name := range dev.controls {
+		dev.publishError(name)
+	}
+}
+
+// setWriteError sets or clears the write error of the control
+func (dev *DeviceModelBase) setWriteError(controlName string, failed bool) {
+	if dev.writeErrors[controlName] == failed {
+		return
+	}
+	if failed {
+		if dev.writeErrors == nil {
+			dev.writeErrors = make(map[string]bool)
+		}
+		dev.writeErrors[controlName] = true
+	} else {
+		delete(dev.writeErrors, controlName)
+	}
+	dev.publishError(controlName)
+}
+
+func (dev *DeviceModelBase) publishError(controlName string) {
+	value := ""
+	if dev.offline {
+		value = "r"
+	}
+	if dev.writeErrors[controlName] {
+		value += "w"
+	}
+	dev.model.publishControlError(dev.Name(), controlName, value)
+}
+
+// controlTracker keeps the list of the device controls
+// so that the errors can be published for them
+type controlTracker struct {
+	wbgo.DeviceObserver
+	dev *DeviceModelBase
+}
+
+func (tracker *controlTracker) OnNewControl(dev wbgo.LocalDeviceModel, name, paramType, value string, readOnly bool, max float64, retain bool) string {
+	tracker.dev.controls = append(tracker.dev.controls, name)
+	r := tracker.DeviceObserver.OnNewControl(dev, name, paramType, value, readOnly, max, retain)
+	if tracker.dev.offline {
+		tracker.dev.publishError(name)
+	}
+	return r
 }
 
 func (dev *DeviceModelBase) AcceptValue(name, value string) {
@@ -254,6 +1073,10 @@ type ZoneBeastDeviceModel struct {
 	channelStatus []bool
 	skipBroadcast bool
 	numTemps      int
+	// the numbers of channels and temperature sensors restored
+	// from the state file, kept until the device reports them
+	restoredChannels int
+	restoredTemps    int
 }
 
 func NewZoneBeastDeviceModel(model *SmartbusModel, smartDev *SmartbusDevice) RealDeviceModel {
@@ -267,6 +1090,8 @@ func NewZoneBeastDeviceModel(model *SmartbusModel, smartDev *SmartbusDevice) Rea
 		make([]bool, 0, 100),
 		false,
 		0,
+		0,
+		0,
 	}
 }
 
@@ -289,11 +1114,19 @@ func (dm *ZoneBeastDeviceModel) AcceptOnValue(name, value string) bool {
 		level = LIGHT_LEVEL_ON
 	}
 
-	dm.model.enqueueRequest(
-		"SingleChannelControl", &SingleChannelControlResponse{},
+	request := newRequest(
+		"SingleChannelControl", dm.smartDev,
+		&SingleChannelControlResponse{ChannelNo: uint8(channelNo)},
 		func() {
 			dm.smartDev.SingleChannelControl(uint8(channelNo), level, 0)
 		})
+	// only the last value matters if the channel
+	// is switched several times in a row
+	request.priority = QUEUE_PRIORITY_USER
+	request.coalescingKey = name
+	dm.model.enqueueRequest(request, func(success bool) {
+		dm.setWriteError(name, !success)
+	})
 
 	// No need to echo the value back.
 	// It will be echoed after the device response
@@ -301,7 +1134,6 @@ func (dm *ZoneBeastDeviceModel) AcceptOnValue(name, value string) bool {
 }
 
 func (dm *ZoneBeastDeviceModel) OnSingleChannelControlResponse(msg *SingleChannelControlResponse) {
-	dm.model.queue.HandleReceivedMessage(msg)
 	if !msg.Success {
 		wbgo.Error.Printf("ERROR: unsuccessful SingleChannelControlCommand")
 		return
@@ -328,6 +1160,25 @@ func (dm *ZoneBeastDeviceModel) OnReadTemperatureValuesResponse(msg *ReadTempera
 	}
 }
 
+func (dm *ZoneBeastDeviceModel) saveState(state *DeviceState) {
+	state.Channels = len(dm.channelStatus)
+	if state.Channels < dm.restoredChannels {
+		state.Channels = dm.restoredChannels
+	}
+	state.Temperatures = dm.numTemps
+	if state.Temperatures < dm.restoredTemps {
+		state.Temperatures = dm.restoredTemps
+	}
+}
+
+func (dm *ZoneBeastDeviceModel) restoreState(state *DeviceState) {
+	// the actual values are not known until the device responds,
+	// so the controls are created then. Publishing placeholder
+	// values would overwrite the values retained by the broker.
+	dm.restoredChannels = state.Channels
+	dm.restoredTemps = state.Temperatures
+}
+
 func (dm *ZoneBeastDeviceModel) updateSingleChannel(n int, isOn bool) {
 	if n >= len(dm.channelStatus) {
 		wbgo.Error.Printf("SmartbusModelDevice.updateSingleChannel(): bad channel number: %d", n)
@@ -387,6 +1238,7 @@ type DDPDeviceModel struct {
 	isNew                     bool
 	pendingAssignmentButtonNo int
 	pendingAssignment         int
+	prevAssignment            int
 }
 
 func NewDDPDeviceModel(model *SmartbusModel, smartDev *SmartbusDevice) RealDeviceModel {
@@ -396,12 +1248,14 @@ func NewDDPDeviceModel(model *SmartbusModel, smartDev *SmartbusDevice) RealDevic
 			titleBase: "DDP",
 			model:     model,
 			smartDev:  smartDev,
+			unpolled:  true,
 		},
 		make([]bool, PANEL_BUTTON_COUNT),
 		make([]int, PANEL_BUTTON_COUNT),
 		true,
 		-1,
 		-1,
+		-1,
 	}
 }
 
@@ -427,6 +1281,27 @@ func (dm *DDPDeviceModel) OnQueryModules(msg *QueryModules) {
 	dm.queryButtons()
 }
 
+func (dm *DDPDeviceModel) saveState(state *DeviceState) {
+	for _, isReceived := range dm.buttonAssignmentReceived {
+		if !isReceived {
+			return
+		}
+	}
+	state.Buttons = append([]int(nil), dm.buttonAssignment...)
+}
+
+func (dm *DDPDeviceModel) restoreState(state *DeviceState) {
+	if len(state.Buttons) != PANEL_BUTTON_COUNT {
+		return
+	}
+	// the buttons are queried again when the panel responds
+	for i, v := range state.Buttons {
+		dm.buttonAssignment[i] = v
+		dm.buttonAssignmentReceived[i] = true
+		dm.Observer.OnNewControl(dm, ddpControlName(uint8(i+1)), "text", strconv.Itoa(v), false, -1, true)
+	}
+}
+
 func (dm *DDPDeviceModel) queryButtons() {
 	if dm.isNew {
 		dm.isNew = false
@@ -436,17 +1311,24 @@ func (dm *DDPDeviceModel) queryButtons() {
 
 func (dm *DDPDeviceModel) queryButton(n uint8) {
 	wbgo.Debug.Printf("queryButton(): %d", n)
-	dm.model.enqueueRequest(
-		"QueryPanelButtonAssignment",
-		&QueryPanelButtonAssignmentResponse{},
+	request := newRequest(
+		"QueryPanelButtonAssignment", dm.smartDev,
+		&QueryPanelButtonAssignmentResponse{ButtonNo: n, FunctionNo: 1},
 		func() {
 			wbgo.Debug.Printf("queryButton() thunk: %d", n)
 			dm.smartDev.QueryPanelButtonAssignment(n, 1)
 		})
+	request.priority = QUEUE_PRIORITY_BACKGROUND
+	dm.model.enqueueRequest(request, func(success bool) {
+		if !success {
+			// query the buttons again when the panel
+			// shows up on the bus
+			dm.isNew = true
+		}
+	})
 }
 
 func (dm *DDPDeviceModel) OnQueryPanelButtonAssignmentResponse(msg *QueryPanelButtonAssignmentResponse) {
-	dm.model.queue.HandleReceivedMessage(msg)
 	// FunctionNo = 1 because we're only querying the first function
 	// in the list currently (multiple functions may be needed for CombinationOn mode etc.)
 	if msg.ButtonNo == 0 || msg.ButtonNo > PANEL_BUTTON_COUNT || msg.FunctionNo != 1 {
@@ -478,15 +1360,15 @@ func (dm *DDPDeviceModel) OnQueryPanelButtonAssignmentResponse(msg *QueryPanelBu
 }
 
 func (dm *DDPDeviceModel) OnSetPanelButtonModesResponse(msg *SetPanelButtonModesResponse) {
-	// FIXME
-	dm.model.queue.HandleReceivedMessage(msg)
 	if dm.pendingAssignmentButtonNo <= 0 {
 		wbgo.Error.Printf("SetPanelButtonModesResponse without pending assignment")
 		return
 	}
 
-	dm.model.enqueueRequest(
-		"AssignPanelButton", &AssignPanelButtonResponse{}, func() {
+	request := newRequest(
+		"AssignPanelButton", dm.smartDev,
+		&AssignPanelButtonResponse{ButtonNo: uint8(dm.pendingAssignmentButtonNo), FunctionNo: 1},
+		func() {
 			dm.smartDev.AssignPanelButton(
 				uint8(dm.pendingAssignmentButtonNo),
 				1,
@@ -497,25 +1379,42 @@ func (dm *DDPDeviceModel) OnSetPanelButtonModesResponse(msg *SetPanelButtonModes
 				100,
 				0)
 		})
+	request.priority = QUEUE_PRIORITY_USER
+	dm.model.enqueueRequest(request, dm.assignmentDone)
 }
 
 func (dm *DDPDeviceModel) OnAssignPanelButtonResponse(msg *AssignPanelButtonResponse) {
-	dm.model.queue.HandleReceivedMessage(msg)
 	if dm.pendingAssignmentButtonNo >= 0 &&
 		int(msg.ButtonNo) == dm.pendingAssignmentButtonNo &&
 		msg.FunctionNo == 1 {
 		dm.Observer.OnValue(dm, ddpControlName(msg.ButtonNo),
 			strconv.Itoa(dm.pendingAssignment))
+		dm.setWriteError(ddpControlName(msg.ButtonNo), false)
 	} else {
 		wbgo.Error.Printf("mismatched AssignPanelButtonResponse: %v/%v (pending %d)",
 			msg.ButtonNo, msg.FunctionNo, dm.pendingAssignmentButtonNo)
 		return
 	}
-	// FIXME: reset these upon failed command (all retries failed)
 	dm.pendingAssignmentButtonNo = -1
 	dm.pendingAssignment = -1
 }
 
+// assignmentDone rolls back the pending button assignment
+// if the panel didn't respond to either SetPanelButtonModes
+// or AssignPanelButton command. Successful assignment is
+// handled by OnAssignPanelButtonResponse.
+func (dm *DDPDeviceModel) assignmentDone(success bool) {
+	if success || dm.pendingAssignmentButtonNo <= 0 {
+		return
+	}
+	controlName := ddpControlName(uint8(dm.pendingAssignmentButtonNo))
+	wbgo.Error.Printf("failed to assign %s of %s", controlName, dm.Name())
+	dm.buttonAssignment[dm.pendingAssignmentButtonNo-1] = dm.prevAssignment
+	dm.pendingAssignmentButtonNo = -1
+	dm.pendingAssignment = -1
+	dm.setWriteError(controlName, true)
+}
+
 func (dm *DDPDeviceModel) OnSingleChannelControlCommand(msg *SingleChannelControlCommand) {
 	dm.model.SetVirtualRelayOn(int(msg.ChannelNo), msg.Level > 0)
 	// Note that we can't guarantee here that the response reaches
@@ -549,7 +1448,8 @@ func (dm *DDPDeviceModel) AcceptOnValue(name, value string) bool {
 	buttonNo := (pageNo-1)*4 + pageButtonNo
 
 	newAssignment, err := strconv.Atoi(value)
-	if err != nil || newAssignment <= 0 || newAssignment > NUM_VIRTUAL_RELAYS {
+	numRelays := dm.model.virtualRelays.RelayCount()
+	if err != nil || newAssignment <= 0 || newAssignment > numRelays {
 		wbgo.Error.Printf("bad button assignment value: %s", value)
 		return false
 	}
@@ -565,25 +1465,28 @@ func (dm *DDPDeviceModel) AcceptOnValue(name, value string) bool {
 	var modes [PANEL_BUTTON_COUNT]string
 	for i, assignment := range dm.buttonAssignment {
 		if buttonNo == i+1 {
+			dm.prevAssignment = assignment
 			assignment = newAssignment
 			dm.buttonAssignment[i] = newAssignment
 		}
-		if assignment <= 0 || assignment > NUM_VIRTUAL_RELAYS {
+		if assignment <= 0 || assignment > numRelays {
 			modes[i] = "Invalid"
 		} else {
 			modes[i] = "SingleOnOff"
 		}
 	}
 
-	dm.model.enqueueRequest(
-		"SetPanelButtonModes",
+	dm.pendingAssignmentButtonNo = buttonNo
+	dm.pendingAssignment = newAssignment
+
+	request := newRequest(
+		"SetPanelButtonModes", dm.smartDev,
 		&SetPanelButtonModesResponse{},
 		func() {
 			dm.smartDev.SetPanelButtonModes(modes)
 		})
-
-	dm.pendingAssignmentButtonNo = buttonNo
-	dm.pendingAssignment = newAssignment
+	request.priority = QUEUE_PRIORITY_USER
+	dm.model.enqueueRequest(request, dm.assignmentDone)
 
 	return false
 }
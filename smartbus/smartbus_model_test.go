@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"github.com/contactless/wbgo"
 	"github.com/contactless/wbgo/testutils"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -19,6 +22,7 @@ type SmartbusDriverSuiteBase struct {
 	*testutils.FakeMQTTFixture
 	client    *testutils.FakeMQTTClient
 	driver    *wbgo.Driver
+	config    *BusConfig
 	model     *SmartbusModel
 	handler   *FakeHandler
 	conn      *SmartbusConnection
@@ -32,6 +36,15 @@ func (s *SmartbusDriverSuiteBase) T() *testing.T {
 func (s *SmartbusDriverSuiteBase) SetupTest() {
 	s.Suite.SetupTest()
 	s.FakeMQTTFixture = testutils.NewFakeMQTTFixture(s.T())
+	s.config = NewBusConfig()
+	s.config.SubnetID = SAMPLE_APP_SUBNET
+	s.config.DeviceID = SAMPLE_APP_DEVICE_ID
+	s.config.DeviceType = SAMPLE_APP_DEVICE_TYPE
+	s.config.Statistics = false
+	s.config.Discovery.Interval = 0
+	// the interval between the requests would
+	// make the queue use extra fake timers
+	s.config.Queue.Interval = 0
 }
 
 func (s *SmartbusDriverSuiteBase) Start(useTimer bool) {
@@ -43,12 +56,14 @@ func (s *SmartbusDriverSuiteBase) Start(useTimer bool) {
 		s.FakeTimerFixture = nil
 	}
 	p, r := net.Pipe()
-	s.model = NewSmartbusModel(func() (SmartbusIO, error) {
+	s.model = NewConfiguredSmartbusModel(func() (SmartbusIO, error) {
 		return NewStreamIO(p, nil), nil
-	}, SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE, timerFunc)
+	}, s.config, timerFunc)
 	s.client = s.Broker.MakeClient("tst")
 	s.client.Start()
-	s.driver = wbgo.NewDriver(s.model, s.Broker.MakeClient("driver"))
+	driverClient := s.Broker.MakeClient("driver")
+	s.model.SetMQTTClient(driverClient)
+	s.driver = wbgo.NewDriver(s.model, driverClient)
 	s.driver.SetAutoPoll(false)
 
 	s.handler = NewFakeHandler(s.T())
@@ -58,9 +73,17 @@ func (s *SmartbusDriverSuiteBase) Start(useTimer bool) {
 func (s *SmartbusDriverSuiteBase) TearDownTest() {
 	s.driver.Stop()
 	s.conn.Close()
-	s.Verify(
-		"stop: driver",
-	)
+	if s.FakeTimerFixture != nil {
+		// the relay restore timer is stopped asynchronously
+		s.VerifyUnordered(
+			"timer.Stop(): 1",
+			"stop: driver",
+		)
+	} else {
+		s.Verify(
+			"stop: driver",
+		)
+	}
 	s.Suite.TearDownTest()
 }
 
@@ -69,19 +92,56 @@ func (s *SmartbusDriverSuiteBase) VerifyVirtualRelays() {
 	expected = append(
 		expected,
 		"driver -> /devices/sbusvrelay/meta/name: [Smartbus Virtual Relays] (QoS 1, retained)")
-	for i := 1; i <= NUM_VIRTUAL_RELAYS; i++ {
+	if s.config.VirtualRelays > 0 {
+		expected = append(expected, "Subscribe -- driver: /devices/sbusvrelay/controls/+")
+		if s.FakeTimerFixture != nil {
+			expected = append(expected, fmt.Sprintf(
+				"new fake timer: 1, %d", RELAY_RESTORE_TIMEOUT/time.Millisecond))
+		}
+	}
+	for i := 1; i <= s.config.VirtualRelays; i++ {
 		path := fmt.Sprintf("/devices/sbusvrelay/controls/VirtualRelay%d", i)
 		expected = append(
 			expected,
 			fmt.Sprintf("driver -> %s/meta/type: [switch] (QoS 1, retained)", path),
-			fmt.Sprintf("driver -> %s/meta/readonly: [1] (QoS 1, retained)", path),
 			fmt.Sprintf("driver -> %s/meta/order: [%d] (QoS 1, retained)", path, i),
 			fmt.Sprintf("driver -> %s: [0] (QoS 1, retained)", path),
+			fmt.Sprintf("Subscribe -- driver: %s/on", path),
 		)
 	}
 	s.Verify(expected...)
 }
 
+func (s *SmartbusDriverSuiteBase) VerifyDriverDevice() {
+	s.Verify(
+		"driver -> /devices/sbusdriver/meta/name: [Smart-Bus Driver] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Connected/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Connected/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Connected/meta/order: [1] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Connected: [1] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Raw Command/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Raw Command/meta/order: [2] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Raw Command: [] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/sbusdriver/controls/Raw Command/on",
+		"driver -> /devices/sbusdriver/controls/Raw Response/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Raw Response/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Raw Response/meta/order: [3] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Raw Response: [] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Scan/meta/type: [pushbutton] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Scan/meta/order: [4] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Scan: [0] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/sbusdriver/controls/Scan/on",
+		"driver -> /devices/sbusdriver/controls/Scan Result/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Scan Result/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Scan Result/meta/order: [5] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Scan Result: [] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Rediscover/meta/type: [pushbutton] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Rediscover/meta/order: [6] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Rediscover: [0] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/sbusdriver/controls/Rediscover/on",
+	)
+}
+
 type DDPSuite struct {
 	SmartbusDriverSuiteBase
 	ddpEp       *SmartbusEndpoint
@@ -97,6 +157,11 @@ func (s *DDPSuite) Start(useTimer bool) {
 
 	s.driver.Start()
 	s.VerifyVirtualRelays()
+	s.VerifyDriverDevice()
+	if useTimer {
+		// number the request timers from 1
+		s.ResetTimerIndex()
+	}
 	s.detectIt()
 	s.verifyQueryingButtons(useTimer)
 }
@@ -112,7 +177,7 @@ func (s *DDPSuite) detectIt() {
 			0x20, 0x42, 0x42,
 		})
 	s.Verify(
-		"driver -> /devices/ddp0114/meta/name: [DDP 01:14] (QoS 1, retained)")
+		"driver -> /devices/ddp1_20/meta/name: [DDP 1:20] (QoS 1, retained)")
 }
 
 func (s *DDPSuite) verifyQueryingButtons(useTimer bool) {
@@ -133,7 +198,7 @@ func (s *DDPSuite) verifyQueryingButtons(useTimer bool) {
 				SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID,
 				uint8(assignment), 100, 0)
 		}
-		path := fmt.Sprintf("/devices/ddp0114/controls/Page%dButton%d",
+		path := fmt.Sprintf("/devices/ddp1_20/controls/Page%dButton%d",
 			(i-1)/4+1, (i-1)%4+1)
 		items := []interface{}{
 			fmt.Sprintf("driver -> %s/meta/type: [text] (QoS 1, retained)", path),
@@ -158,13 +223,14 @@ func (s *DDPSuite) verifyQueryingButtons(useTimer bool) {
 func (s *DDPSuite) TestSmartbusDriverDDPHandling() {
 	s.Start(false)
 
-	// second QueryModules shouldn't cause anything
+	// second QueryModules shouldn't cause button querying,
+	// the driver just answers it like a relay module does
 	s.ddpToAppDev.QueryModules()
-	s.handler.Verify()
+	s.handler.Verify("03/fe (type fffe) -> 01/14: <QueryModulesResponse 03/fe/02/15/00/00>")
 	s.Verify()
 
 	s.client.Publish(
-		wbgo.MQTTMessage{"/devices/ddp0114/controls/Page1Button2/on", "10", 1, false})
+		wbgo.MQTTMessage{"/devices/ddp1_20/controls/Page1Button2/on", "10", 1, false})
 
 	s.handler.Verify("03/fe (type fffe) -> 01/14: " +
 		"<SetPanelButtonModes " +
@@ -173,10 +239,10 @@ func (s *DDPSuite) TestSmartbusDriverDDPHandling() {
 		"3/1:Invalid,3/2:Invalid,3/3:SingleOnOff,3/4:SingleOnOff," +
 		"4/1:SingleOnOff,4/2:SingleOnOff,4/3:SingleOnOff,4/4:SingleOnOff>")
 	s.ddpToAppDev.SetPanelButtonModesResponse(true)
-	s.Verify("tst -> /devices/ddp0114/controls/Page1Button2/on: [10] (QoS 1)")
+	s.Verify("tst -> /devices/ddp1_20/controls/Page1Button2/on: [10] (QoS 1)")
 	s.handler.Verify("03/fe (type fffe) -> 01/14: <AssignPanelButton 2/1/59/03/fe/10/100/0/0>")
 	s.ddpToAppDev.AssignPanelButtonResponse(2, 1)
-	s.Verify("driver -> /devices/ddp0114/controls/Page1Button2: [10] (QoS 1, retained)")
+	s.Verify("driver -> /devices/ddp1_20/controls/Page1Button2: [10] (QoS 1, retained)")
 
 	s.ddpToAppDev.SingleChannelControl(10, LIGHT_LEVEL_ON, 0)
 	s.handler.Verify("03/fe (type fffe) -> 01/14: " +
@@ -207,12 +273,101 @@ func (s *DDPSuite) TestSmartbusDriverDDPHandling() {
 		"driver -> /devices/sbusvrelay/controls/VirtualRelay10: [0] (QoS 1, retained)")
 }
 
+func (s *DDPSuite) TestWritableVirtualRelays() {
+	s.Start(false)
+
+	// the change is announced on the bus so the panels can update their LEDs
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/sbusvrelay/controls/VirtualRelay3/on", "1", 1, false})
+	s.Verify(
+		"tst -> /devices/sbusvrelay/controls/VirtualRelay3/on: [1] (QoS 1)",
+		"driver -> /devices/sbusvrelay/controls/VirtualRelay3: [1] (QoS 1, retained)")
+	s.handler.Verify("03/fe (type fffe) -> ff/ff: " +
+		"<SingleChannelControlResponse 3/true/100/--x------------>")
+
+	// the retained value is restored and published back, as it was
+	// replaced by the default one, but it's not announced on the bus
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/sbusvrelay/controls/VirtualRelay5", "1", 1, true})
+	s.Verify(
+		"tst -> /devices/sbusvrelay/controls/VirtualRelay5: [1] (QoS 1, retained)",
+		"driver -> /devices/sbusvrelay/controls/VirtualRelay5: [1] (QoS 1, retained)")
+	s.handler.Verify()
+
+	// the relays switched since the start are not restored
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/sbusvrelay/controls/VirtualRelay3", "0", 1, true})
+	s.Verify(
+		"tst -> /devices/sbusvrelay/controls/VirtualRelay3: [0] (QoS 1, retained)")
+
+	// only the first retained value is restored,
+	// even if it matches the current one
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/sbusvrelay/controls/VirtualRelay6", "0", 1, true})
+	s.Verify(
+		"tst -> /devices/sbusvrelay/controls/VirtualRelay6: [0] (QoS 1, retained)")
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/sbusvrelay/controls/VirtualRelay6", "1", 1, true})
+	s.Verify(
+		"tst -> /devices/sbusvrelay/controls/VirtualRelay6: [1] (QoS 1, retained)")
+
+	s.ddpToAppDev.QueryChannelStatuses(0)
+	s.handler.Verify("03/fe (type fffe) -> 01/14: " +
+		"<QueryChannelStatusesResponse [0 0 100 0 100 0 0 0 0 0 0 0 0 0 0]>")
+
+	// writing the same value again doesn't cause anything
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/sbusvrelay/controls/VirtualRelay3/on", "1", 1, false})
+	s.Verify(
+		"tst -> /devices/sbusvrelay/controls/VirtualRelay3/on: [1] (QoS 1)",
+		"driver -> /devices/sbusvrelay/controls/VirtualRelay3: [1] (QoS 1, retained)")
+	s.handler.Verify()
+}
+
+func (s *DDPSuite) TestDriverAnswersQueries() {
+	s.Start(false)
+
+	s.ddpToAppDev.ReadMACAddress()
+	s.handler.Verify("03/fe (type fffe) -> 01/14: " +
+		"<ReadMACAddressResponse 53:03:00:00:00:00:03:fe [77 62 2d 6d 71 74 74 2d 73 6d 61 72 74 62 75 73]>")
+
+	s.ddpToAppDev.SingleChannelControl(2, LIGHT_LEVEL_ON, 0)
+	s.handler.Verify("03/fe (type fffe) -> 01/14: " +
+		"<SingleChannelControlResponse 2/true/100/-x------------->")
+	s.Verify(
+		"driver -> /devices/sbusvrelay/controls/VirtualRelay2: [1] (QoS 1, retained)")
+
+	s.ddpToAppDev.QueryChannelStatuses(0)
+	s.handler.Verify("03/fe (type fffe) -> 01/14: " +
+		"<QueryChannelStatusesResponse [0 100 0 0 0 0 0 0 0 0 0 0 0 0 0]>")
+	s.Verify()
+}
+
+func (s *DDPSuite) TestDriverIgnoresOwnQueries() {
+	s.Start(false)
+
+	// the UDP transport receives the driver's own broadcasts
+	selfEp := s.conn.MakeSmartbusEndpoint(
+		SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	selfEp.Observe(s.handler)
+	selfToAllDev := selfEp.GetBroadcastDevice()
+	selfToAllDev.ReadMACAddress()
+	selfToAllDev.QueryModules()
+	selfToAllDev.QueryChannelStatuses(0)
+
+	// the queries from the other devices are still answered
+	s.ddpToAppDev.QueryChannelStatuses(0)
+	s.handler.Verify("03/fe (type fffe) -> 01/14: " +
+		"<QueryChannelStatusesResponse [0 0 0 0 0 0 0 0 0 0 0 0 0 0 0]>")
+	s.Verify()
+}
+
 func (s *DDPSuite) TestSmartbusDriverDDPCommandQueue() {
 	s.Start(true)
 
 	s.client.Publish(
-		wbgo.MQTTMessage{"/devices/ddp0114/controls/Page1Button2/on", "10", 1, false})
-	s.Verify("tst -> /devices/ddp0114/controls/Page1Button2/on: [10] (QoS 1)")
+		wbgo.MQTTMessage{"/devices/ddp1_20/controls/Page1Button2/on", "10", 1, false})
+	s.Verify("tst -> /devices/ddp1_20/controls/Page1Button2/on: [10] (QoS 1)")
 	s.handler.Verify("03/fe (type fffe) -> 01/14: " +
 		"<SetPanelButtonModes " +
 		"1/1:Invalid,1/2:SingleOnOff,1/3:Invalid,1/4:Invalid," +
@@ -241,7 +396,49 @@ func (s *DDPSuite) TestSmartbusDriverDDPCommandQueue() {
 	s.ddpToAppDev.AssignPanelButtonResponse(2, 1)
 	s.VerifyUnordered(
 		"timer.Stop(): 3",
-		"driver -> /devices/ddp0114/controls/Page1Button2: [10] (QoS 1, retained)")
+		"driver -> /devices/ddp1_20/controls/Page1Button2: [10] (QoS 1, retained)")
+}
+
+func (s *DDPSuite) TestDDPAssignmentFailure() {
+	s.config.Queue.Retries = 0
+	s.Start(true)
+
+	modes := "03/fe (type fffe) -> 01/14: " +
+		"<SetPanelButtonModes " +
+		"1/1:Invalid,1/2:SingleOnOff,1/3:Invalid,1/4:Invalid," +
+		"2/1:Invalid,2/2:Invalid,2/3:Invalid,2/4:Invalid," +
+		"3/1:Invalid,3/2:Invalid,3/3:SingleOnOff,3/4:SingleOnOff," +
+		"4/1:SingleOnOff,4/2:SingleOnOff,4/3:SingleOnOff,4/4:SingleOnOff>"
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/ddp1_20/controls/Page1Button2/on", "10", 1, false})
+	s.Verify("tst -> /devices/ddp1_20/controls/Page1Button2/on: [10] (QoS 1)")
+	s.handler.Verify(modes)
+	s.Verify(fmt.Sprintf("new fake timer: 1, %d", REQUEST_TIMEOUT_MS))
+
+	// the panel doesn't respond, the assignment is rolled back
+	s.FireTimer(1, s.AdvanceTime(1000))
+	s.Verify(
+		"timer.fire(): 1",
+		"driver -> /devices/ddp1_20/controls/Page1Button2/meta/error: [w] (QoS 1, retained)",
+	)
+	s.EnsureGotErrors()
+
+	// the button can be assigned again
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/ddp1_20/controls/Page1Button2/on", "10", 1, false})
+	s.Verify("tst -> /devices/ddp1_20/controls/Page1Button2/on: [10] (QoS 1)")
+	s.handler.Verify(modes)
+	s.Verify(fmt.Sprintf("new fake timer: 2, %d", REQUEST_TIMEOUT_MS))
+	s.ddpToAppDev.SetPanelButtonModesResponse(true)
+	s.Verify("timer.Stop(): 2")
+	s.handler.Verify("03/fe (type fffe) -> 01/14: <AssignPanelButton 2/1/59/03/fe/10/100/0/0>")
+	s.Verify(fmt.Sprintf("new fake timer: 3, %d", REQUEST_TIMEOUT_MS))
+	s.ddpToAppDev.AssignPanelButtonResponse(2, 1)
+	s.VerifyUnordered(
+		"timer.Stop(): 3",
+		"driver -> /devices/ddp1_20/controls/Page1Button2: [10] (QoS 1, retained)",
+		"driver -> /devices/ddp1_20/controls/Page1Button2/meta/error: [] (QoS 1, retained)",
+	)
 }
 
 type ZoneBeastSuite struct {
@@ -263,6 +460,11 @@ func (s *ZoneBeastSuite) Start(useTimer bool) {
 
 	s.driver.Start()
 	s.VerifyVirtualRelays()
+	s.VerifyDriverDevice()
+	if useTimer {
+		// number the request timers from 1
+		s.ResetTimerIndex()
+	}
 	s.detectIt()
 	s.firstBroadcast()
 	return
@@ -277,32 +479,32 @@ func (s *ZoneBeastSuite) detectIt() {
 		},
 		[]uint8{})
 	s.Verify(
-		"driver -> /devices/zonebeast011c/meta/name: [Zone Beast 01:1c] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/meta/name: [Zone Beast 1:28] (QoS 1, retained)",
 	)
 }
 
 func (s *ZoneBeastSuite) firstBroadcast() {
 	s.relayToAllDev.ZoneBeastBroadcast([]byte{0}, parseChannelStatus("---x"))
 	s.Verify(
-		"driver -> /devices/zonebeast011c/controls/Channel 1/meta/type: [switch] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Channel 1/meta/order: [1] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Channel 1: [0] (QoS 1, retained)",
-		"Subscribe -- driver: /devices/zonebeast011c/controls/Channel 1/on",
+		"driver -> /devices/zonebeast1_28/controls/Channel 1/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 1/meta/order: [1] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 1: [0] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/zonebeast1_28/controls/Channel 1/on",
 
-		"driver -> /devices/zonebeast011c/controls/Channel 2/meta/type: [switch] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Channel 2/meta/order: [2] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Channel 2: [0] (QoS 1, retained)",
-		"Subscribe -- driver: /devices/zonebeast011c/controls/Channel 2/on",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2/meta/order: [2] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2: [0] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/zonebeast1_28/controls/Channel 2/on",
 
-		"driver -> /devices/zonebeast011c/controls/Channel 3/meta/type: [switch] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Channel 3/meta/order: [3] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Channel 3: [0] (QoS 1, retained)",
-		"Subscribe -- driver: /devices/zonebeast011c/controls/Channel 3/on",
+		"driver -> /devices/zonebeast1_28/controls/Channel 3/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 3/meta/order: [3] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 3: [0] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/zonebeast1_28/controls/Channel 3/on",
 
-		"driver -> /devices/zonebeast011c/controls/Channel 4/meta/type: [switch] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Channel 4/meta/order: [4] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Channel 4: [1] (QoS 1, retained)",
-		"Subscribe -- driver: /devices/zonebeast011c/controls/Channel 4/on",
+		"driver -> /devices/zonebeast1_28/controls/Channel 4/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 4/meta/order: [4] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 4: [1] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/zonebeast1_28/controls/Channel 4/on",
 	)
 }
 
@@ -311,57 +513,90 @@ func (s *ZoneBeastSuite) TestSmartbusDriverZoneBeastHandling() {
 
 	s.relayToAllDev.ZoneBeastBroadcast([]byte{0}, parseChannelStatus("x---"))
 	s.Verify(
-		"driver -> /devices/zonebeast011c/controls/Channel 1: [1] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Channel 4: [0] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 1: [1] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 4: [0] (QoS 1, retained)",
 	)
 
 	s.client.Publish(
-		wbgo.MQTTMessage{"/devices/zonebeast011c/controls/Channel 2/on", "1", 1, false})
+		wbgo.MQTTMessage{"/devices/zonebeast1_28/controls/Channel 2/on", "1", 1, false})
 	// note that SingleChannelControlResponse carries pre-command channel status
 	s.handler.Verify(
 		"03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 2/100/0>")
 	s.relayToAllDev.SingleChannelControlResponse(2, true, LIGHT_LEVEL_ON, parseChannelStatus("x---"))
 	s.Verify(
-		"tst -> /devices/zonebeast011c/controls/Channel 2/on: [1] (QoS 1)",
-		"driver -> /devices/zonebeast011c/controls/Channel 2: [1] (QoS 1, retained)",
+		"tst -> /devices/zonebeast1_28/controls/Channel 2/on: [1] (QoS 1)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2: [1] (QoS 1, retained)",
 	)
 
 	s.client.Publish(
-		wbgo.MQTTMessage{"/devices/zonebeast011c/controls/Channel 1/on", "0", 1, false})
+		wbgo.MQTTMessage{"/devices/zonebeast1_28/controls/Channel 1/on", "0", 1, false})
 	s.handler.Verify(
 		"03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 1/0/0>")
 	s.relayToAllDev.SingleChannelControlResponse(1, true, LIGHT_LEVEL_OFF, parseChannelStatus("xx--"))
 	s.relayToAllDev.ZoneBeastBroadcast([]byte{0}, parseChannelStatus("x---")) // outdated response -- must be ignored
 	s.Verify(
-		"tst -> /devices/zonebeast011c/controls/Channel 1/on: [0] (QoS 1)",
-		"driver -> /devices/zonebeast011c/controls/Channel 1: [0] (QoS 1, retained)",
+		"tst -> /devices/zonebeast1_28/controls/Channel 1/on: [0] (QoS 1)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 1: [0] (QoS 1, retained)",
 	)
 
 	s.driver.Poll()
 	s.handler.Verify("03/fe (type fffe) -> 01/1c: <ReadTemperatureValues Celsius>")
 	s.relayToAllDev.ReadTemperatureValuesResponse(true, []int8{22})
 	s.Verify(
-		"driver -> /devices/zonebeast011c/controls/Temp 1/meta/type: [temperature] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Temp 1/meta/readonly: [1] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Temp 1/meta/order: [5] (QoS 1, retained)",
-		"driver -> /devices/zonebeast011c/controls/Temp 1: [22] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Temp 1/meta/type: [temperature] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Temp 1/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Temp 1/meta/order: [5] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Temp 1: [22] (QoS 1, retained)",
 	)
 
 	s.driver.Poll()
 	s.handler.Verify("03/fe (type fffe) -> 01/1c: <ReadTemperatureValues Celsius>")
 	s.relayToAllDev.ReadTemperatureValuesResponse(true, []int8{-2})
 	s.Verify(
-		"driver -> /devices/zonebeast011c/controls/Temp 1: [-2] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Temp 1: [-2] (QoS 1, retained)",
 	)
 }
 
+func (s *ZoneBeastSuite) TestZoneBeastOffline() {
+	s.config.MaxMissedPolls = 2
+	s.Start(false)
+
+	// the first poll is not answered, but it's not missed yet
+	for i := 0; i < 2; i++ {
+		s.driver.Poll()
+		s.handler.Verify("03/fe (type fffe) -> 01/1c: <ReadTemperatureValues Celsius>")
+		s.VerifyEmpty()
+	}
+
+	s.driver.Poll()
+	s.handler.Verify("03/fe (type fffe) -> 01/1c: <ReadTemperatureValues Celsius>")
+	s.Verify(
+		"driver -> /devices/zonebeast1_28/controls/Channel 1/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 3/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 4/meta/error: [r] (QoS 1, retained)",
+	)
+	s.False(s.model.deviceMap[deviceKey(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID)].IsOnline())
+
+	// the errors are cleared when the device shows up again
+	s.relayToAllDev.ZoneBeastBroadcast([]byte{0}, parseChannelStatus("---x"))
+	s.Verify(
+		"driver -> /devices/zonebeast1_28/controls/Channel 1/meta/error: [] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2/meta/error: [] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 3/meta/error: [] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 4/meta/error: [] (QoS 1, retained)",
+	)
+	s.True(s.model.deviceMap[deviceKey(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID)].IsOnline())
+	s.EnsureGotWarnings()
+}
+
 func (s *ZoneBeastSuite) TestSmartbusDriverZoneBeastCommandQueue() {
 	s.Start(true)
 
 	s.client.Publish(
-		wbgo.MQTTMessage{"/devices/zonebeast011c/controls/Channel 2/on", "1", 1, false})
+		wbgo.MQTTMessage{"/devices/zonebeast1_28/controls/Channel 2/on", "1", 1, false})
 	s.Verify(
-		"tst -> /devices/zonebeast011c/controls/Channel 2/on: [1] (QoS 1)",
+		"tst -> /devices/zonebeast1_28/controls/Channel 2/on: [1] (QoS 1)",
 	)
 	s.handler.Verify(
 		"03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 2/100/0>")
@@ -378,16 +613,833 @@ func (s *ZoneBeastSuite) TestSmartbusDriverZoneBeastCommandQueue() {
 	)
 	s.EnsureGotWarnings()
 
+	// the response for another channel doesn't complete the request
+	s.relayToAllDev.SingleChannelControlResponse(3, true, LIGHT_LEVEL_ON, parseChannelStatus("x---"))
+	s.Verify("driver -> /devices/zonebeast1_28/controls/Channel 3: [1] (QoS 1, retained)")
+
 	// note that SingleChannelControlResponse carries pre-command channel status
-	s.relayToAllDev.SingleChannelControlResponse(2, true, LIGHT_LEVEL_ON, parseChannelStatus("x---"))
+	s.relayToAllDev.SingleChannelControlResponse(2, true, LIGHT_LEVEL_ON, parseChannelStatus("x-x-"))
 	s.VerifyUnordered(
 		"timer.Stop(): 2",
-		"driver -> /devices/zonebeast011c/controls/Channel 2: [1] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2: [1] (QoS 1, retained)",
+	)
+}
+
+func (s *ZoneBeastSuite) TestZoneBeastCommandFailure() {
+	s.config.Queue.Retries = 0
+	s.Start(true)
+
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/zonebeast1_28/controls/Channel 3/on", "1", 1, false})
+	s.Verify(
+		"tst -> /devices/zonebeast1_28/controls/Channel 3/on: [1] (QoS 1)",
+	)
+	s.handler.Verify(
+		"03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 3/100/0>")
+	s.Verify(
+		fmt.Sprintf("new fake timer: 1, %d", REQUEST_TIMEOUT_MS),
+	)
+
+	// no response, the write error is published
+	s.FireTimer(1, s.AdvanceTime(1000))
+	s.Verify(
+		"timer.fire(): 1",
+		"driver -> /devices/zonebeast1_28/controls/Channel 3/meta/error: [w] (QoS 1, retained)",
+	)
+	s.EnsureGotErrors()
+
+	// the error is cleared after a successful attempt
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/zonebeast1_28/controls/Channel 3/on", "1", 1, false})
+	s.Verify(
+		"tst -> /devices/zonebeast1_28/controls/Channel 3/on: [1] (QoS 1)",
+	)
+	s.handler.Verify(
+		"03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 3/100/0>")
+	s.Verify(
+		fmt.Sprintf("new fake timer: 2, %d", REQUEST_TIMEOUT_MS),
+	)
+	s.relayToAllDev.SingleChannelControlResponse(3, true, LIGHT_LEVEL_ON, parseChannelStatus("x---"))
+	s.VerifyUnordered(
+		"timer.Stop(): 2",
+		"driver -> /devices/zonebeast1_28/controls/Channel 3: [1] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 3/meta/error: [] (QoS 1, retained)",
+	)
+}
+
+func (s *ZoneBeastSuite) TestZoneBeastCommandRejected() {
+	s.Start(true)
+
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/zonebeast1_28/controls/Channel 3/on", "1", 1, false})
+	s.Verify(
+		"tst -> /devices/zonebeast1_28/controls/Channel 3/on: [1] (QoS 1)",
+	)
+	s.handler.Verify(
+		"03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 3/100/0>")
+	s.Verify(
+		fmt.Sprintf("new fake timer: 1, %d", REQUEST_TIMEOUT_MS),
+	)
+
+	// the device reports the failure, the write error is published
+	s.relayToAllDev.SingleChannelControlResponse(3, false, LIGHT_LEVEL_ON, parseChannelStatus("----"))
+	s.VerifyUnordered(
+		"timer.Stop(): 1",
+		"driver -> /devices/zonebeast1_28/controls/Channel 3/meta/error: [w] (QoS 1, retained)",
+	)
+	s.EnsureGotErrors()
+}
+
+func (s *ZoneBeastSuite) TestRawCommandFailure() {
+	s.config.Queue.Retries = 0
+	s.Start(true)
+
+	cmd := `{"subnet": 1, "device": 28, "opcode": "SingleChannelControlCommand", ` +
+		`"fields": {"ChannelNo": 2, "Level": 100}, "response": "0x0032"}`
+	s.client.Publish(wbgo.MQTTMessage{"/devices/sbusdriver/controls/Raw Command/on", cmd, 1, false})
+	s.handler.Verify(
+		"03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 2/100/0>")
+	s.VerifyUnordered(
+		"tst -> /devices/sbusdriver/controls/Raw Command/on: ["+cmd+"] (QoS 1)",
+		"driver -> /devices/sbusdriver/controls/Raw Command: ["+cmd+"] (QoS 1, retained)",
+		fmt.Sprintf("new fake timer: 1, %d", REQUEST_TIMEOUT_MS),
+	)
+
+	s.FireTimer(1, s.AdvanceTime(1000))
+	s.Verify(
+		"timer.fire(): 1",
+		"driver -> /devices/sbusdriver/controls/Raw Response: "+
+			`[{"error":"no response"}] (QoS 1, retained)`,
+	)
+	s.EnsureGotErrors()
+}
+
+func (s *ZoneBeastSuite) TestConcurrentRawCommands() {
+	s.config.Queue.Retries = 0
+	s.Start(true)
+
+	// the commands to different devices run at the same time
+	cmd1 := `{"subnet": 1, "device": 40, "opcode": "ReadMACAddress", "response": "ReadMACAddressResponse"}`
+	s.client.Publish(wbgo.MQTTMessage{"/devices/sbusdriver/controls/Raw Command/on", cmd1, 1, false})
+	s.VerifyUnordered(
+		"tst -> /devices/sbusdriver/controls/Raw Command/on: ["+cmd1+"] (QoS 1)",
+		"driver -> /devices/sbusdriver/controls/Raw Command: ["+cmd1+"] (QoS 1, retained)",
+		fmt.Sprintf("new fake timer: 1, %d", REQUEST_TIMEOUT_MS),
+	)
+	cmd2 := `{"subnet": 1, "device": 28, "opcode": "SingleChannelControlCommand", ` +
+		`"fields": {"ChannelNo": 2, "Level": 100}, "response": "0x0032"}`
+	s.client.Publish(wbgo.MQTTMessage{"/devices/sbusdriver/controls/Raw Command/on", cmd2, 1, false})
+	s.handler.Verify(
+		"03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 2/100/0>")
+	s.VerifyUnordered(
+		"tst -> /devices/sbusdriver/controls/Raw Command/on: ["+cmd2+"] (QoS 1)",
+		"driver -> /devices/sbusdriver/controls/Raw Command: ["+cmd2+"] (QoS 1, retained)",
+		fmt.Sprintf("new fake timer: 2, %d", REQUEST_TIMEOUT_MS),
+	)
+
+	// the failure of the first command doesn't
+	// affect the second one
+	s.FireTimer(1, s.AdvanceTime(1000))
+	s.Verify(
+		"timer.fire(): 1",
+		"driver -> /devices/sbusdriver/controls/Raw Response: "+
+			`[{"error":"no response"}] (QoS 1, retained)`,
+	)
+	s.EnsureGotErrors()
+
+	s.relayToAllDev.SingleChannelControlResponse(2, true, LIGHT_LEVEL_ON, parseChannelStatus("---x"))
+	s.VerifyUnordered(
+		"timer.Stop(): 2",
+		"driver -> /devices/sbusdriver/controls/Raw Response: "+
+			`[{"subnet":1,"device":28,"deviceType":5020,"opcode":50,`+
+			`"message":"SingleChannelControlResponse",`+
+			`"fields":{"ChannelNo":2,"Success":true,"Level":100,"ChannelStatus":[false,false,false,true]}}]`+
+			" (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2: [1] (QoS 1, retained)",
+	)
+}
+
+func (s *ZoneBeastSuite) TestRawCommand() {
+	s.Start(true)
+
+	cmd := `{"subnet": 1, "device": 28, "opcode": "SingleChannelControlCommand", ` +
+		`"fields": {"ChannelNo": 2, "Level": 100}, "response": "0x0032"}`
+	s.client.Publish(wbgo.MQTTMessage{"/devices/sbusdriver/controls/Raw Command/on", cmd, 1, false})
+	s.handler.Verify(
+		"03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 2/100/0>")
+	s.VerifyUnordered(
+		"tst -> /devices/sbusdriver/controls/Raw Command/on: ["+cmd+"] (QoS 1)",
+		"driver -> /devices/sbusdriver/controls/Raw Command: ["+cmd+"] (QoS 1, retained)",
+		fmt.Sprintf("new fake timer: 1, %d", REQUEST_TIMEOUT_MS),
+	)
+
+	s.relayToAllDev.SingleChannelControlResponse(2, true, LIGHT_LEVEL_ON, parseChannelStatus("---x"))
+	s.VerifyUnordered(
+		"timer.Stop(): 1",
+		"driver -> /devices/sbusdriver/controls/Raw Response: "+
+			`[{"subnet":1,"device":28,"deviceType":5020,"opcode":50,`+
+			`"message":"SingleChannelControlResponse",`+
+			`"fields":{"ChannelNo":2,"Success":true,"Level":100,"ChannelStatus":[false,false,false,true]}}]`+
+			" (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2: [1] (QoS 1, retained)",
+	)
+
+	// raw payload, no response expected
+	cmd = `{"subnet": 1, "device": 28, "opcode": 644, "payload": "01 14 53"}`
+	s.client.Publish(wbgo.MQTTMessage{"/devices/sbusdriver/controls/Raw Command/on", cmd, 1, false})
+	s.handler.Verify("03/fe (type fffe) -> 01/1c: <RawMessage 0284 [01 14 53]>")
+	s.Verify(
+		"tst -> /devices/sbusdriver/controls/Raw Command/on: ["+cmd+"] (QoS 1)",
+		"driver -> /devices/sbusdriver/controls/Raw Command: ["+cmd+"] (QoS 1, retained)",
+	)
+
+	cmd = `{"subnet": 1, "device": 28, "opcode": 644, "fields": {"Foo": 1}}`
+	s.client.Publish(wbgo.MQTTMessage{"/devices/sbusdriver/controls/Raw Command/on", cmd, 1, false})
+	s.Verify(
+		"tst -> /devices/sbusdriver/controls/Raw Command/on: ["+cmd+"] (QoS 1)",
+		"driver -> /devices/sbusdriver/controls/Raw Response: "+
+			`[{"error":"opcode 0284 is not recognized, use payload instead of fields"}]`+
+			" (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Raw Command: ["+cmd+"] (QoS 1, retained)",
+	)
+	s.EnsureGotErrors()
+	s.handler.Verify()
+}
+
+type DeviceConfigSuite struct {
+	SmartbusDriverSuiteBase
+}
+
+func (s *DeviceConfigSuite) startWithRelay(devConfig DeviceConfig) *SmartbusDevice {
+	s.config.VirtualRelays = 2
+	s.config.Devices = []DeviceConfig{devConfig}
+	s.Start(false)
+	relayEp := s.conn.MakeSmartbusEndpoint(
+		SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, SAMPLE_RELAY_DEVICE_TYPE)
+	relayEp.Observe(s.handler)
+	s.driver.Start()
+	s.VerifyVirtualRelays()
+	s.VerifyDriverDevice()
+	s.handler.Verify("03/fe (type fffe) -> ff/ff: <ReadMACAddress>")
+	return relayEp.GetSmartbusDevice(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID)
+}
+
+func (s *DeviceConfigSuite) TestRenamedDevice() {
+	relayToAppDev := s.startWithRelay(DeviceConfig{
+		SubnetID: SAMPLE_SUBNET,
+		DeviceID: SAMPLE_RELAY_DEVICE_ID,
+		Name:     "hall_relay",
+		Title:    "Hall Relay",
+	})
+	relayToAppDev.ReadMACAddressResponse([8]byte{}, []uint8{})
+	s.Verify("driver -> /devices/hall_relay/meta/name: [Hall Relay] (QoS 1, retained)")
+}
+
+func (s *DeviceConfigSuite) TestDisabledDevice() {
+	relayToAppDev := s.startWithRelay(DeviceConfig{
+		SubnetID: SAMPLE_SUBNET,
+		DeviceID: SAMPLE_RELAY_DEVICE_ID,
+		Disabled: true,
+	})
+	relayToAppDev.ReadMACAddressResponse([8]byte{}, []uint8{})
+	s.handler.Verify()
+	s.Verify()
+}
+
+type VirtualDeviceSuite struct {
+	SmartbusDriverSuiteBase
+}
+
+func (s *VirtualDeviceSuite) TestVirtualDevice() {
+	s.config.VirtualRelays = 2
+	s.config.VirtualDevices = []VirtualDeviceConfig{
+		{
+			SubnetID: SAMPLE_SUBNET,
+			DeviceID: 0x64,
+			Channels: 2,
+			Remark:   "floor1",
+		},
+	}
+	s.Start(false)
+	ddpEp := s.conn.MakeSmartbusEndpoint(
+		SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID, SAMPLE_DDP_DEVICE_TYPE)
+	ddpEp.Observe(s.handler)
+	ddpToVirtualDev := ddpEp.GetSmartbusDevice(SAMPLE_SUBNET, 0x64)
+	s.driver.Start()
+	s.VerifyVirtualRelays()
+	s.Verify(
+		"driver -> /devices/sbusvrelay1_100/meta/name: [Smartbus Virtual Relays 1:100] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/sbusvrelay1_100/controls/+",
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay1/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay1/meta/order: [1] (QoS 1, retained)",
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay1: [0] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/sbusvrelay1_100/controls/VirtualRelay1/on",
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay2/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay2/meta/order: [2] (QoS 1, retained)",
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay2: [0] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/sbusvrelay1_100/controls/VirtualRelay2/on",
+	)
+	s.VerifyDriverDevice()
+	s.handler.Verify("03/fe (type fffe) -> ff/ff: <ReadMACAddress>")
+
+	ddpToVirtualDev.ReadMACAddress()
+	s.handler.Verify("01/64 (type fffe) -> 01/14: " +
+		"<ReadMACAddressResponse 53:03:00:00:00:00:01:64 [66 6c 6f 6f 72 31]>")
+
+	ddpToVirtualDev.SingleChannelControl(2, LIGHT_LEVEL_ON, 0)
+	s.handler.Verify("01/64 (type fffe) -> 01/14: <SingleChannelControlResponse 2/true/100/-x>")
+	s.Verify(
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay2: [1] (QoS 1, retained)")
+
+	ddpToVirtualDev.SingleChannelControl(3, LIGHT_LEVEL_ON, 0)
+	s.handler.Verify("01/64 (type fffe) -> 01/14: <SingleChannelControlResponse 3/false/100/-x>")
+	s.Verify()
+
+	ddpToVirtualDev.QueryChannelStatuses(0)
+	s.handler.Verify("01/64 (type fffe) -> 01/14: <QueryChannelStatusesResponse [0 100]>")
+	ddpToVirtualDev.QueryModules()
+	s.handler.Verify("01/64 (type fffe) -> 01/14: <QueryModulesResponse 01/64/02/2/00/00>")
+	s.Verify()
+
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/sbusvrelay1_100/controls/VirtualRelay1/on", "1", 1, false})
+	s.Verify(
+		"tst -> /devices/sbusvrelay1_100/controls/VirtualRelay1/on: [1] (QoS 1)",
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay1: [1] (QoS 1, retained)")
+	s.handler.Verify("01/64 (type fffe) -> ff/ff: <SingleChannelControlResponse 1/true/100/xx>")
+}
+
+type MultiBusSuite struct {
+	testutils.Suite
+	*testutils.FakeMQTTFixture
+	driver  *wbgo.Driver
+	handler *FakeHandler
+	conns   []*SmartbusConnection
+}
+
+func (s *MultiBusSuite) SetupTest() {
+	s.Suite.SetupTest()
+	s.FakeMQTTFixture = testutils.NewFakeMQTTFixture(s.T())
+	s.handler = NewFakeHandler(s.T())
+}
+
+func (s *MultiBusSuite) TearDownTest() {
+	s.driver.Stop()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.Verify("stop: driver")
+	s.Suite.TearDownTest()
+}
+
+func (s *MultiBusSuite) TestSameAddressOnTwoBuses() {
+	busNames := []string{"trunk_a", "trunk_b"}
+	models := make([]*SmartbusModel, len(busNames))
+	relayToAppDevs := make([]*SmartbusDevice, len(busNames))
+	for i, busName := range busNames {
+		config := NewBusConfig()
+		config.Name = busName
+		config.SubnetID = SAMPLE_APP_SUBNET
+		config.DeviceID = SAMPLE_APP_DEVICE_ID
+		config.DeviceType = SAMPLE_APP_DEVICE_TYPE
+		config.VirtualRelays = 1
+		config.Statistics = false
+		config.Discovery.Interval = 0
+		p, r := net.Pipe()
+		models[i] = NewConfiguredSmartbusModel(func() (SmartbusIO, error) {
+			return NewStreamIO(p, nil), nil
+		}, config, nil)
+		conn := NewSmartbusConnection(NewStreamIO(r, nil))
+		s.conns = append(s.conns, conn)
+		relayEp := conn.MakeSmartbusEndpoint(
+			SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, SAMPLE_RELAY_DEVICE_TYPE)
+		relayEp.Observe(s.handler)
+		relayToAppDevs[i] = relayEp.GetSmartbusDevice(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID)
+	}
+	s.driver = wbgo.NewDriver(NewMultiBusModel(models...), s.Broker.MakeClient("driver"))
+	s.driver.SetAutoPoll(false)
+	s.driver.Start()
+
+	for _, busName := range busNames {
+		s.Verify(
+			fmt.Sprintf("driver -> /devices/%s_sbusvrelay/meta/name: [Smartbus Virtual Relays (%s)] (QoS 1, retained)", busName, busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusvrelay/controls/VirtualRelay1/meta/type: [switch] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusvrelay/controls/VirtualRelay1/meta/order: [1] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusvrelay/controls/VirtualRelay1: [0] (QoS 1, retained)", busName),
+			fmt.Sprintf("Subscribe -- driver: /devices/%s_sbusvrelay/controls/VirtualRelay1/on", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/meta/name: [Smart-Bus Driver (%s)] (QoS 1, retained)", busName, busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Connected/meta/type: [switch] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Connected/meta/readonly: [1] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Connected/meta/order: [1] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Connected: [1] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Raw Command/meta/type: [text] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Raw Command/meta/order: [2] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Raw Command: [] (QoS 1, retained)", busName),
+			fmt.Sprintf("Subscribe -- driver: /devices/%s_sbusdriver/controls/Raw Command/on", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Raw Response/meta/type: [text] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Raw Response/meta/readonly: [1] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Raw Response/meta/order: [3] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Raw Response: [] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Scan/meta/type: [pushbutton] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Scan/meta/order: [4] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Scan: [0] (QoS 1, retained)", busName),
+			fmt.Sprintf("Subscribe -- driver: /devices/%s_sbusdriver/controls/Scan/on", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Scan Result/meta/type: [text] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Scan Result/meta/readonly: [1] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Scan Result/meta/order: [5] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Scan Result: [] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Rediscover/meta/type: [pushbutton] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Rediscover/meta/order: [6] (QoS 1, retained)", busName),
+			fmt.Sprintf("driver -> /devices/%s_sbusdriver/controls/Rediscover: [0] (QoS 1, retained)", busName),
+			fmt.Sprintf("Subscribe -- driver: /devices/%s_sbusdriver/controls/Rediscover/on", busName),
+		)
+		s.handler.Verify("03/fe (type fffe) -> ff/ff: <ReadMACAddress>")
+	}
+
+	for i, busName := range busNames {
+		relayToAppDevs[i].ReadMACAddressResponse([8]byte{}, []uint8{})
+		s.Verify(fmt.Sprintf(
+			"driver -> /devices/%s_zonebeast1_28/meta/name: [Zone Beast 1:28 (%s)] (QoS 1, retained)",
+			busName, busName))
+	}
+}
+
+type MirrorSuite struct {
+	SmartbusDriverSuiteBase
+}
+
+func (s *MirrorSuite) TestTrafficMirror() {
+	s.config.Mirror = MirrorConfig{
+		Enabled: true,
+		Addresses: []AddressRange{
+			{SubnetID: SAMPLE_SUBNET, FromDevice: SAMPLE_RELAY_DEVICE_ID, ToDevice: SAMPLE_RELAY_DEVICE_ID},
+		},
+		Opcodes: []OpcodeSpec{0xf004, 0x0031, 0x0284},
+	}
+	s.Start(false)
+	s.model.TrafficMirror().SetTimeFunc(func() time.Time {
+		return time.Date(2015, 1, 25, 9, 9, 20, 0, time.UTC)
+	})
+	relayEp := s.conn.MakeSmartbusEndpoint(
+		SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, SAMPLE_RELAY_DEVICE_TYPE)
+	relayEp.Observe(s.handler)
+
+	// the broadcast query doesn't match the address filter
+	s.driver.Start()
+	s.VerifyVirtualRelays()
+	s.VerifyDriverDevice()
+	s.handler.Verify("03/fe (type fffe) -> ff/ff: <ReadMACAddress>")
+
+	relayEp.GetSmartbusDevice(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID).
+		ReadMACAddressResponse([8]byte{}, []uint8{})
+	s.VerifyUnordered(
+		"driver -> /devices/zonebeast1_28/meta/name: [Zone Beast 1:28] (QoS 1, retained)",
+		`driver -> /smartbus/traffic: [{"time":"2015-01-25T09:09:20Z","direction":"in",`+
+			`"message":{"opcode":61444,"type":"ReadMACAddressResponse",`+
+			`"header":{"origSubnet":1,"origDevice":28,"origDeviceType":5020,"targetSubnet":3,"targetDevice":254},`+
+			`"fields":{"MAC":[0,0,0,0,0,0,0,0],"Remark":""}}}] (QoS 0)`,
+	)
+
+	// the message that's not for us
+	relayEp.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID).SingleChannelControl(1, 100, 0)
+	s.Verify(
+		`driver -> /smartbus/traffic: [{"time":"2015-01-25T09:09:20Z","direction":"other",` +
+			`"message":{"opcode":49,"type":"SingleChannelControlCommand",` +
+			`"header":{"origSubnet":1,"origDevice":28,"origDeviceType":5020,"targetSubnet":1,"targetDevice":20},` +
+			`"fields":{"ChannelNo":1,"Level":100,"Duration":0}}}] (QoS 0)`,
+	)
+
+	// the message that doesn't match the opcode filter
+	relayEp.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID).ReadTemperatureValues(true)
+	s.VerifyEmpty()
+
+	// outgoing message
+	cmd := `{"subnet": 1, "device": 28, "opcode": 644, "payload": "01 14"}`
+	s.client.Publish(wbgo.MQTTMessage{"/devices/sbusdriver/controls/Raw Command/on", cmd, 1, false})
+	s.handler.Verify("03/fe (type fffe) -> 01/1c: <RawMessage 0284 [01 14]>")
+	s.VerifyUnordered(
+		"tst -> /devices/sbusdriver/controls/Raw Command/on: ["+cmd+"] (QoS 1)",
+		`driver -> /smartbus/traffic: [{"time":"2015-01-25T09:09:20Z","direction":"out",`+
+			`"message":{"opcode":644,"type":"RawMessage",`+
+			`"header":{"origSubnet":3,"origDevice":254,"origDeviceType":65534,"targetSubnet":1,"targetDevice":28},`+
+			`"fields":{"Payload":"01 14"}}}] (QoS 0)`,
+		"driver -> /devices/sbusdriver/controls/Raw Command: ["+cmd+"] (QoS 1, retained)",
+	)
+}
+
+func (s *MirrorSuite) TestVirtualDeviceTraffic() {
+	s.config.Mirror = MirrorConfig{
+		Enabled: true,
+		Addresses: []AddressRange{
+			{SubnetID: SAMPLE_SUBNET, FromDevice: 0x64, ToDevice: 0x64},
+		},
+		Opcodes: []OpcodeSpec{0xf004},
+	}
+	s.config.VirtualDevices = []VirtualDeviceConfig{
+		{
+			SubnetID: SAMPLE_SUBNET,
+			DeviceID: 0x64,
+			Channels: 1,
+		},
+	}
+	s.Start(false)
+	s.model.TrafficMirror().SetTimeFunc(func() time.Time {
+		return time.Date(2015, 1, 25, 9, 9, 20, 0, time.UTC)
+	})
+	ddpEp := s.conn.MakeSmartbusEndpoint(
+		SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID, SAMPLE_DDP_DEVICE_TYPE)
+	ddpEp.Observe(s.handler)
+
+	s.driver.Start()
+	s.VerifyVirtualRelays()
+	s.Verify(
+		"driver -> /devices/sbusvrelay1_100/meta/name: [Smartbus Virtual Relays 1:100] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/sbusvrelay1_100/controls/+",
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay1/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay1/meta/order: [1] (QoS 1, retained)",
+		"driver -> /devices/sbusvrelay1_100/controls/VirtualRelay1: [0] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/sbusvrelay1_100/controls/VirtualRelay1/on",
+	)
+	s.VerifyDriverDevice()
+	s.handler.Verify("03/fe (type fffe) -> ff/ff: <ReadMACAddress>")
+
+	// the replies of the virtual device are mirrored
+	ddpEp.GetSmartbusDevice(SAMPLE_SUBNET, 0x64).ReadMACAddress()
+	s.handler.Verify("01/64 (type fffe) -> 01/14: " +
+		"<ReadMACAddressResponse 53:03:00:00:00:00:01:64 []>")
+	s.Verify(
+		`driver -> /smartbus/traffic: [{"time":"2015-01-25T09:09:20Z","direction":"out",` +
+			`"message":{"opcode":61444,"type":"ReadMACAddressResponse",` +
+			`"header":{"origSubnet":1,"origDevice":100,"origDeviceType":65534,"targetSubnet":1,"targetDevice":20},` +
+			`"fields":{"MAC":[83,3,0,0,0,0,1,100],"Remark":""}}}] (QoS 0)`,
+	)
+}
+
+type ScanSuite struct {
+	SmartbusDriverSuiteBase
+}
+
+func (s *ScanSuite) TestScan() {
+	s.config.VirtualRelays = 1
+	s.config.Scan.Addresses = []AddressRange{
+		{SubnetID: SAMPLE_SUBNET, FromDevice: 27, ToDevice: SAMPLE_RELAY_DEVICE_ID},
+	}
+	s.config.Scan.Retries = 0
+	s.Start(true)
+	relayEp := s.conn.MakeSmartbusEndpoint(
+		SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, SAMPLE_RELAY_DEVICE_TYPE)
+	relayEp.AddInputSniffer(s.handler)
+	relayEp.Observe(s.handler)
+	s.driver.Start()
+	s.VerifyVirtualRelays()
+	s.VerifyDriverDevice()
+	s.ResetTimerIndex()
+	s.handler.Verify("03/fe (type fffe) -> ff/ff: <ReadMACAddress>")
+
+	s.client.Publish(wbgo.MQTTMessage{"/devices/sbusdriver/controls/Scan/on", "1", 1, false})
+	s.handler.Verify("03/fe (type fffe) -> 01/1b: <ReadMACAddress>")
+	s.Verify(
+		"tst -> /devices/sbusdriver/controls/Scan/on: [1] (QoS 1)",
+		fmt.Sprintf("new fake timer: 1, %d", int(DEFAULT_SCAN_TIMEOUT/time.Millisecond)),
+	)
+
+	// no response from 1:27
+	s.FireTimer(1, s.AdvanceTime(DEFAULT_SCAN_TIMEOUT))
+	s.handler.Verify("03/fe (type fffe) -> 01/1c: <ReadMACAddress>")
+	s.Verify(
+		"timer.fire(): 1",
+		fmt.Sprintf("new fake timer: 2, %d", int(DEFAULT_SCAN_TIMEOUT/time.Millisecond)),
+	)
+
+	relayEp.GetSmartbusDevice(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID).ReadMACAddressResponse(
+		[8]uint8{0x53, 0x03, 0x00, 0x00, 0x00, 0x00, 0x30, 0xc3}, []uint8{'Z', 'B', 0, 0})
+	s.VerifyUnordered(
+		"timer.Stop(): 2",
+		"driver -> /devices/zonebeast1_28/meta/name: [Zone Beast 1:28] (QoS 1, retained)",
+		"driver -> /devices/sbusdriver/controls/Scan Result: "+
+			`[[{"subnet":1,"device":28,"deviceType":5020,"mac":"53:03:00:00:00:00:30:c3",`+
+			`"remark":"ZB","opcodes":[61444],"supported":true}]] (QoS 1, retained)`,
+	)
+	s.EnsureGotWarnings()
+}
+
+type DiscoverySuite struct {
+	SmartbusDriverSuiteBase
+}
+
+func (s *DiscoverySuite) TearDownTest() {
+	s.driver.Stop()
+	s.conn.Close()
+	// the discovery and relay restore timers
+	// are stopped asynchronously
+	s.VerifyUnordered(
+		"timer.Stop(): 1",
+		"timer.Stop(): 3",
+		"stop: driver",
+	)
+	s.Suite.TearDownTest()
+}
+
+func (s *DiscoverySuite) TestRediscovery() {
+	s.config.VirtualRelays = 1
+	s.config.Discovery.Interval = 60000
+	s.config.Devices = []DeviceConfig{
+		{SubnetID: SAMPLE_SUBNET, DeviceID: SAMPLE_RELAY_DEVICE_ID},
+		{SubnetID: SAMPLE_SUBNET, DeviceID: 30},
+		{SubnetID: SAMPLE_SUBNET, DeviceID: 31, Disabled: true},
+	}
+	s.Start(true)
+	relayEp := s.conn.MakeSmartbusEndpoint(
+		SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, SAMPLE_RELAY_DEVICE_TYPE)
+	relayEp.AddInputSniffer(s.handler)
+	relayEp.Observe(s.handler)
+	s.driver.Start()
+	s.VerifyVirtualRelays()
+	s.VerifyDriverDevice()
+	s.Verify("new fake timer: 2, 60000")
+	s.handler.Verify("03/fe (type fffe) -> ff/ff: <ReadMACAddress>")
+
+	// the configured devices that weren't seen are probed
+	s.client.Publish(wbgo.MQTTMessage{"/devices/sbusdriver/controls/Rediscover/on", "1", 1, false})
+	s.handler.Verify(
+		"03/fe (type fffe) -> ff/ff: <ReadMACAddress>",
+		"03/fe (type fffe) -> 01/1c: <ReadMACAddress>",
+		"03/fe (type fffe) -> 01/1e: <ReadMACAddress>",
+	)
+	s.Verify("tst -> /devices/sbusdriver/controls/Rediscover/on: [1] (QoS 1)")
+
+	relayEp.GetSmartbusDevice(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID).
+		ReadMACAddressResponse([8]byte{}, []uint8{})
+	s.Verify("driver -> /devices/zonebeast1_28/meta/name: [Zone Beast 1:28] (QoS 1, retained)")
+
+	// periodic rediscovery
+	s.FireTimer(2, s.AdvanceTime(60*time.Second))
+	s.handler.Verify(
+		"03/fe (type fffe) -> ff/ff: <ReadMACAddress>",
+		"03/fe (type fffe) -> 01/1e: <ReadMACAddress>",
+	)
+	s.Verify(
+		"timer.fire(): 2",
+		"new fake timer: 3, 60000",
+	)
+}
+
+type RelayRestoreSuite struct {
+	SmartbusDriverSuiteBase
+}
+
+func (s *RelayRestoreSuite) TearDownTest() {
+	s.driver.Stop()
+	s.conn.Close()
+	s.Verify("stop: driver")
+	s.Suite.TearDownTest()
+}
+
+func (s *RelayRestoreSuite) TestRestoreTimeout() {
+	s.config.VirtualRelays = 1
+	s.Start(true)
+	s.driver.Start()
+	s.VerifyVirtualRelays()
+	s.VerifyDriverDevice()
+
+	// the values retained by the broker are expected
+	// to arrive shortly after the subscription
+	s.FireTimer(1, s.AdvanceTime(RELAY_RESTORE_TIMEOUT))
+	s.Verify(
+		"timer.fire(): 1",
+		"Unsubscribe -- driver: /devices/sbusvrelay/controls/+",
+	)
+
+	s.client.Publish(
+		wbgo.MQTTMessage{"/devices/sbusvrelay/controls/VirtualRelay1", "1", 1, true})
+	s.Verify(
+		"tst -> /devices/sbusvrelay/controls/VirtualRelay1: [1] (QoS 1, retained)")
+}
+
+type StateSuite struct {
+	SmartbusDriverSuiteBase
+	dir string
+}
+
+func (s *StateSuite) SetupTest() {
+	s.SmartbusDriverSuiteBase.SetupTest()
+	var err error
+	if s.dir, err = ioutil.TempDir("", "smartbus-state"); err != nil {
+		s.T().Fatalf("TempDir(): %s", err)
+	}
+	s.config.VirtualRelays = 1
+	s.config.StateFile = filepath.Join(s.dir, "state", "state.json")
+}
+
+func (s *StateSuite) TearDownTest() {
+	s.SmartbusDriverSuiteBase.TearDownTest()
+	os.RemoveAll(s.dir)
+}
+
+func (s *StateSuite) startWithRelay() *SmartbusEndpoint {
+	s.Start(false)
+	relayEp := s.conn.MakeSmartbusEndpoint(
+		SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, SAMPLE_RELAY_DEVICE_TYPE)
+	relayEp.Observe(s.handler)
+	s.driver.Start()
+	s.VerifyVirtualRelays()
+	s.VerifyDriverDevice()
+	return relayEp
+}
+
+func (s *StateSuite) TestSaveState() {
+	relayEp := s.startWithRelay()
+	s.handler.Verify("03/fe (type fffe) -> ff/ff: <ReadMACAddress>")
+	relayToAllDev := relayEp.GetBroadcastDevice()
+	relayToAllDev.ZoneBeastBroadcast([]byte{0}, parseChannelStatus("-x"))
+	s.Verify(
+		"driver -> /devices/zonebeast1_28/meta/name: [Zone Beast 1:28] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 1/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 1/meta/order: [1] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 1: [0] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/zonebeast1_28/controls/Channel 1/on",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2/meta/order: [2] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 2: [1] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/zonebeast1_28/controls/Channel 2/on",
+	)
+
+	s.driver.Poll()
+	s.handler.Verify("03/fe (type fffe) -> 01/1c: <ReadTemperatureValues Celsius>")
+	state, err := LoadBusState(s.config.StateFile)
+	s.Require().NoError(err)
+	s.Equal([]DeviceState{
+		{SubnetID: SAMPLE_SUBNET, DeviceID: SAMPLE_RELAY_DEVICE_ID,
+			DeviceType: SAMPLE_RELAY_DEVICE_TYPE, Channels: 2},
+	}, state.Devices)
+
+	relayToAllDev.ReadTemperatureValuesResponse(true, []int8{22})
+	s.Verify(
+		"driver -> /devices/zonebeast1_28/controls/Temp 1/meta/type: [temperature] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Temp 1/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Temp 1/meta/order: [3] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Temp 1: [22] (QoS 1, retained)",
+	)
+	s.driver.Poll()
+	s.handler.Verify("03/fe (type fffe) -> 01/1c: <ReadTemperatureValues Celsius>")
+	state, err = LoadBusState(s.config.StateFile)
+	s.Require().NoError(err)
+	s.Equal(1, state.Devices[0].Temperatures)
+}
+
+func (s *StateSuite) TestRestoreState() {
+	buttons := make([]int, PANEL_BUTTON_COUNT)
+	for i := range buttons {
+		buttons[i] = -1
+	}
+	buttons[0] = 1
+	s.Require().NoError(SaveBusState(s.config.StateFile, &BusState{
+		Devices: []DeviceState{
+			{SubnetID: SAMPLE_SUBNET, DeviceID: SAMPLE_DDP_DEVICE_ID,
+				DeviceType: SAMPLE_DDP_DEVICE_TYPE, Buttons: buttons},
+			{SubnetID: SAMPLE_SUBNET, DeviceID: SAMPLE_RELAY_DEVICE_ID,
+				DeviceType: SAMPLE_RELAY_DEVICE_TYPE, Channels: 1, Temperatures: 1},
+		},
+	}))
+	relayEp := s.startWithRelay()
+	expected := []interface{}{
+		"driver -> /devices/ddp1_20/meta/name: [DDP 1:20] (QoS 1, retained)",
+	}
+	for i, v := range buttons {
+		path := "/devices/ddp1_20/controls/" + ddpControlName(uint8(i+1))
+		expected = append(expected,
+			fmt.Sprintf("driver -> %s/meta/type: [text] (QoS 1, retained)", path),
+			fmt.Sprintf("driver -> %s/meta/order: [%d] (QoS 1, retained)", path, i+1),
+			fmt.Sprintf("driver -> %s: [%d] (QoS 1, retained)", path, v),
+			fmt.Sprintf("Subscribe -- driver: %s/on", path),
+			fmt.Sprintf("driver -> %s/meta/error: [r] (QoS 1, retained)", path),
+		)
+	}
+	s.Verify(expected...)
+	// the controls are not created until the device responds,
+	// so the values retained by the broker are not overwritten
+	s.Verify(
+		"driver -> /devices/zonebeast1_28/meta/name: [Zone Beast 1:28] (QoS 1, retained)",
+	)
+	s.handler.Verify("03/fe (type fffe) -> ff/ff: <ReadMACAddress>")
+
+	// the device is confirmed when it responds
+	relayEp.GetBroadcastDevice().ZoneBeastBroadcast([]byte{0}, parseChannelStatus("x"))
+	s.Verify(
+		"driver -> /devices/zonebeast1_28/controls/Channel 1/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 1/meta/order: [1] (QoS 1, retained)",
+		"driver -> /devices/zonebeast1_28/controls/Channel 1: [1] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/zonebeast1_28/controls/Channel 1/on",
+	)
+
+	// the restored numbers of channels and sensors
+	// are kept until the device reports them
+	s.driver.Poll()
+	s.handler.Verify("03/fe (type fffe) -> 01/1c: <ReadTemperatureValues Celsius>")
+	state, err := LoadBusState(s.config.StateFile)
+	s.Require().NoError(err)
+	s.Equal(1, state.Devices[1].Channels)
+	s.Equal(1, state.Devices[1].Temperatures)
+}
+
+type StatsSuite struct {
+	SmartbusDriverSuiteBase
+}
+
+func (s *StatsSuite) TestLinkStatistics() {
+	s.config.VirtualRelays = 1
+	s.config.Statistics = true
+	s.Start(false)
+	relayEp := s.conn.MakeSmartbusEndpoint(
+		SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, SAMPLE_RELAY_DEVICE_TYPE)
+	relayEp.Observe(s.handler)
+
+	s.driver.Start()
+	s.VerifyVirtualRelays()
+	s.VerifyDriverDevice()
+	expected := []interface{}{
+		"driver -> /devices/sbusstats/meta/name: [Smart-Bus Statistics] (QoS 1, retained)",
+	}
+	for _, name := range statsCounterNames {
+		expected = append(expected,
+			fmt.Sprintf("driver -> /devices/sbusstats/controls/%s/meta/type: [value] (QoS 1, retained)", name),
+			fmt.Sprintf("driver -> /devices/sbusstats/controls/%s/meta/readonly: [1] (QoS 1, retained)", name),
+			fmt.Sprintf("driver -> /devices/sbusstats/controls/%s/meta/order: [%d] (QoS 1, retained)", name, len(expected)/4+1),
+			fmt.Sprintf("driver -> /devices/sbusstats/controls/%s: [0] (QoS 1, retained)", name))
+	}
+	expected = append(expected,
+		"driver -> /devices/sbusstats/controls/Queue Depth/meta/type: [value] (QoS 1, retained)",
+		"driver -> /devices/sbusstats/controls/Queue Depth/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sbusstats/controls/Queue Depth/meta/order: [10] (QoS 1, retained)",
+		"driver -> /devices/sbusstats/controls/Queue Depth: [0] (QoS 1, retained)")
+	for _, name := range statsBreakdownNames {
+		expected = append(expected,
+			fmt.Sprintf("driver -> /devices/sbusstats/controls/%s/meta/type: [text] (QoS 1, retained)", name),
+			fmt.Sprintf("driver -> /devices/sbusstats/controls/%s/meta/readonly: [1] (QoS 1, retained)", name),
+			fmt.Sprintf("driver -> /devices/sbusstats/controls/%s/meta/order: [%d] (QoS 1, retained)", name, len(expected)/4+1),
+			fmt.Sprintf("driver -> /devices/sbusstats/controls/%s: [{}] (QoS 1, retained)", name))
+	}
+	s.Verify(expected...)
+	s.handler.Verify("03/fe (type fffe) -> ff/ff: <ReadMACAddress>")
+
+	relayEp.GetSmartbusDevice(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID).
+		ReadMACAddressResponse([8]byte{}, []uint8{})
+	s.Verify("driver -> /devices/zonebeast1_28/meta/name: [Zone Beast 1:28] (QoS 1, retained)")
+
+	s.driver.Poll()
+	s.handler.Verify("03/fe (type fffe) -> 01/1c: <ReadTemperatureValues Celsius>")
+	s.VerifyUnordered(
+		"driver -> /devices/sbusstats/controls/Frames In: [1] (QoS 1, retained)",
+		"driver -> /devices/sbusstats/controls/Frames Out: [2] (QoS 1, retained)",
+		`driver -> /devices/sbusstats/controls/Frames In By Opcode: [{"ReadMACAddressResponse":1}] (QoS 1, retained)`,
+		`driver -> /devices/sbusstats/controls/Frames Out By Opcode: [{"ReadMACAddress":1,"ReadTemperatureValues":1}] (QoS 1, retained)`,
+		`driver -> /devices/sbusstats/controls/Frames In By Device: [{"1:28":1}] (QoS 1, retained)`,
+		`driver -> /devices/sbusstats/controls/Frames Out By Device: [{"1:28":1,"255:255":1}] (QoS 1, retained)`,
 	)
 }
 
 func TestSmartbusDriverSuite(t *testing.T) {
-	testutils.RunSuites(t, new(DDPSuite), new(ZoneBeastSuite))
+	testutils.RunSuites(t, new(DDPSuite), new(ZoneBeastSuite), new(DeviceConfigSuite), new(VirtualDeviceSuite), new(MultiBusSuite), new(MirrorSuite), new(ScanSuite), new(DiscoverySuite), new(RelayRestoreSuite), new(StateSuite), new(StatsSuite))
 }
 
 // TBD: outdated ZoneBeastBroadcast messages still arrive sometimes, need to fix this
@@ -2,6 +2,7 @@ package smartbus
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"github.com/contactless/wbgo/testutils"
@@ -1004,6 +1005,96 @@ var messageTestCases []MessageTestCase = []MessageTestCase{
 			0x93, // CRC(lo)
 		},
 	},
+	{
+		// opcode 0xff00 seems to be some kind of broadcast query no one answers
+		Name:   "RawMessage (no payload)",
+		Opcode: 0xff00,
+		SmartbusMessage: SmartbusMessage{
+			MessageHeader{
+				OrigSubnetID:   SAMPLE_SUBNET,
+				OrigDeviceID:   SAMPLE_DDP_DEVICE_ID,
+				OrigDeviceType: SAMPLE_DDP_DEVICE_TYPE,
+				TargetSubnetID: BROADCAST_SUBNET,
+				TargetDeviceID: BROADCAST_DEVICE,
+			},
+			&RawMessage{
+				RawOpcode: 0xff00,
+				Payload:   []uint8{},
+			},
+		},
+		Packet: []byte{
+			0xaa, // Sync1
+			0xaa, // Sync2
+			0x0b, // Len
+			0x01, // OrigSubnetID
+			0x14, // OrigDeviceID
+			0x00, // OrigDeviceType(hi)
+			0x95, // OrigDeviceType(lo)
+			0xff, // Opcode(hi)
+			0x00, // Opcode(lo)
+			0xff, // TargetSubnetID
+			0xff, // TargetDeviceID
+			0xe6, // CRC(hi)
+			0xa4, // CRC(lo)
+		},
+	},
+	{
+		// http://smarthomebus.com/dealers/Protocols/9in1%20Protocol%20v1.1.pdf p.20
+		// opcode 0x284 - check for adddress conflict
+		Name:   "RawMessage",
+		Opcode: 0x0284,
+		SmartbusMessage: SmartbusMessage{
+			MessageHeader{
+				OrigSubnetID:   SAMPLE_SUBNET,
+				OrigDeviceID:   SAMPLE_DDP_DEVICE_ID,
+				OrigDeviceType: SAMPLE_DDP_DEVICE_TYPE,
+				TargetSubnetID: SAMPLE_SUBNET,
+				TargetDeviceID: BROADCAST_DEVICE,
+			},
+			&RawMessage{
+				RawOpcode: 0x0284,
+				Payload: []uint8{
+					0x01, 0x14, 0x53, 0x03, 0x00,
+					0x00, 0x00, 0x00, 0x30, 0xc3,
+				},
+			},
+		},
+		Packet: []byte{
+			0xaa, // Sync1
+			0xaa, // Sync2
+			0x15, // Len
+			0x01, // OrigSubnetID
+			0x14, // OrigDeviceID
+			0x00, // OrigDeviceType(hi)
+			0x95, // OrigDeviceType(lo)
+			0x02, // Opcode(hi)
+			0x84, // Opcode(lo)
+			0x01, // TargetSubnetID
+			0xff, // TargetDeviceID
+			0x01, // [data]
+			0x14, // [data]
+			0x53, // [data]
+			0x03, // [data]
+			0x00, // [data]
+			0x00, // [data]
+			0x00, // [data]
+			0x00, // [data]
+			0x30, // [data]
+			0xc3, // [data]
+			0x4f, // CRC(hi)
+			0xff, // CRC(lo)
+		},
+	},
+}
+
+func findMessageTestCase(t *testing.T, name string) MessageTestCase {
+	for _, mtc := range messageTestCases {
+		if mtc.Name == name {
+			return mtc
+		}
+	}
+	t.Fatalf("message test case not found: %s", name)
+	return MessageTestCase{}
 }
 
 // http://smarthomebus.com/dealers/Protocols/Smart%20Bus%20Commands%20V5.10.pdf page 88
@@ -1011,14 +1102,6 @@ var messageTestCases []MessageTestCase = []MessageTestCase{
 // 00000010  00 00 00 00 00 00 00 00  00 e6 34                 |..........4|
 // opcode 0x0034 - response to QueryChannelStatuses
 
-// 00000000  0b 01 14 00 95 ff 00 ff  ff e6 a4                 |...........|
-// opcode 0xff00 seems to be some kind of broadcast query no one answers
-
-// http://smarthomebus.com/dealers/Protocols/9in1%20Protocol%20v1.1.pdf p.20
-// 00000000  15 01 14 00 95 02 84 01  ff 01 14 53 03 00 00 00  |...........S....|
-// 00000010  00 30 c3 4f ff                                    |.0.O.|
-// opcode 0x284 - check for adddress conflict
-
 type FakeMutex struct {
 	t           *testing.T
 	internalMtx sync.Mutex
@@ -1324,11 +1407,53 @@ func TestSmartbusEndpointReceive(t *testing.T) {
 	handler.Verify("01/14 (type 0095) -> 01/1c: <SingleChannelControlCommand 7/100/0>")
 	r.Write(messageTestCases[1].Packet)
 	handler.Verify("01/1c (type 139c) -> ff/ff: <SingleChannelControlResponse 7/true/0/------x-------->")
+	// unrecognized opcodes are passed as raw messages
+	r.Write(findMessageTestCase(t, "RawMessage").Packet)
+	handler.Verify("01/14 (type 0095) -> 01/ff: <RawMessage 0284 [01 14 53 03 00 00 00 00 30 c3]>")
 
 	conn.Close()
 	r.Close()
 }
 
+func TestSmartbusEndpointSubscribe(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	bus := NewSimulatedBus()
+	defer bus.Close()
+	bus.AddDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, NewSimulatedZoneBeast(4, []int8{22}))
+	bus.AddDevice(SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID, NewSimulatedPanel())
+
+	rec := testutils.NewRecorder(t)
+	conn := NewSmartbusConnection(bus.NewIO())
+	defer conn.Close()
+	ep := conn.MakeSmartbusEndpoint(SAMPLE_APP_SUBNET, SAMPLE_APP_DEVICE_ID, SAMPLE_APP_DEVICE_TYPE)
+	filter := MessageTypes(&ReadMACAddressResponse{})
+	filter.Sources = []AddressRange{{SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, SAMPLE_RELAY_DEVICE_ID}}
+	sub := ep.Subscribe(filter, func(msg Message, header *MessageHeader) {
+		rec.Rec("%02x/%02x: %s", header.OrigSubnetID, header.OrigDeviceID, MessageName(msg))
+	})
+	ep.Subscribe(SubscriptionFilter{Kind: SUBSCRIBE_SENT}, func(msg Message, header *MessageHeader) {
+		rec.Rec("sent: %s", MessageName(msg))
+	})
+
+	ep.GetBroadcastDevice().ReadMACAddress()
+	rec.Verify(
+		"sent: ReadMACAddress",
+		"01/1c: ReadMACAddressResponse",
+	)
+
+	// the handler is not called after the subscription is cancelled
+	sub.Cancel()
+	ep.GetBroadcastDevice().ReadMACAddress()
+	rec.Verify("sent: ReadMACAddress")
+	// make sure the responses are received
+	ep.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID).Request(
+		context.Background(), &ReadMACAddress{})
+	rec.Verify("sent: ReadMACAddress")
+	rec.VerifyEmpty()
+}
+
 var fakeTimeout = errors.New("fake timeout")
 
 type fakeTimeoutConnectionWrapper struct {
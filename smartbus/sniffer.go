@@ -0,0 +1,218 @@
+package smartbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/contactless/wbgo"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SNIFF_FORMAT_TEXT = "text"
+	SNIFF_FORMAT_HEX  = "hex"
+	SNIFF_FORMAT_JSON = "json"
+
+	SNIFF_TIME_FORMAT = "2006-01-02 15:04:05.000"
+)
+
+// SnifferFilter selects the frames shown by the sniffer.
+// Empty lists match any frame.
+type SnifferFilter struct {
+	Sources     []AddressRange
+	Targets     []AddressRange
+	DeviceTypes []uint16
+	Opcodes     []uint16
+}
+
+func matchAddress(ranges []AddressRange, subnetID uint8, deviceID uint8) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if r.Contains(subnetID, deviceID) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchUint16(values []uint16, v uint16) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (filter *SnifferFilter) Matches(header *MessageHeader) bool {
+	return matchAddress(filter.Sources, header.OrigSubnetID, header.OrigDeviceID) &&
+		matchAddress(filter.Targets, header.TargetSubnetID, header.TargetDeviceID) &&
+		matchUint16(filter.DeviceTypes, header.OrigDeviceType) &&
+		matchUint16(filter.Opcodes, header.Opcode)
+}
+
+// ParseAddressRange parses an address range specified as
+// subnet, subnet:device or subnet:fromDevice-toDevice
+func ParseAddressRange(s string) (AddressRange, error) {
+	parseByte := func(s string) (uint8, error) {
+		n, err := strconv.ParseUint(s, 0, 8)
+		return uint8(n), err
+	}
+	parts := strings.SplitN(s, ":", 2)
+	subnetID, err := parseByte(parts[0])
+	if err != nil {
+		return AddressRange{}, fmt.Errorf("bad address %q", s)
+	}
+	if len(parts) == 1 {
+		return AddressRange{subnetID, 0, BROADCAST_DEVICE}, nil
+	}
+	devices := strings.SplitN(parts[1], "-", 2)
+	fromDevice, err := parseByte(devices[0])
+	if err != nil {
+		return AddressRange{}, fmt.Errorf("bad address %q", s)
+	}
+	toDevice := fromDevice
+	if len(devices) == 2 {
+		if toDevice, err = parseByte(devices[1]); err != nil || toDevice < fromDevice {
+			return AddressRange{}, fmt.Errorf("bad address %q", s)
+		}
+	}
+	return AddressRange{subnetID, fromDevice, toDevice}, nil
+}
+
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ParseSnifferFilter makes a filter from comma-separated lists
+// of source and target address ranges, device types and opcodes
+func ParseSnifferFilter(sources, targets, deviceTypes, opcodes string) (*SnifferFilter, error) {
+	filter := &SnifferFilter{}
+	for _, item := range splitList(sources) {
+		r, err := ParseAddressRange(item)
+		if err != nil {
+			return nil, err
+		}
+		filter.Sources = append(filter.Sources, r)
+	}
+	for _, item := range splitList(targets) {
+		r, err := ParseAddressRange(item)
+		if err != nil {
+			return nil, err
+		}
+		filter.Targets = append(filter.Targets, r)
+	}
+	for _, item := range splitList(deviceTypes) {
+		n, err := strconv.ParseUint(item, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad device type %q", item)
+		}
+		filter.DeviceTypes = append(filter.DeviceTypes, uint16(n))
+	}
+	for _, item := range splitList(opcodes) {
+		opcode, err := ParseOpcode(item)
+		if err != nil {
+			return nil, err
+		}
+		filter.Opcodes = append(filter.Opcodes, opcode)
+	}
+	return filter, nil
+}
+
+type sniffDocument struct {
+	Time    string          `json:"time"`
+	Message SmartbusMessage `json:"message"`
+}
+
+// Sniffer decodes the raw frames and writes the ones
+// that pass the filter in the specified format:
+// "text" (decoded messages), "hex" (text capture format
+// that can be used for replay) or "json" (one JSON
+// document per line)
+type Sniffer struct {
+	writer   io.Writer
+	format   string
+	filter   *SnifferFilter
+	timeFunc func() time.Time
+}
+
+func NewSniffer(writer io.Writer, format string, filter *SnifferFilter) (*Sniffer, error) {
+	switch format {
+	case SNIFF_FORMAT_TEXT, SNIFF_FORMAT_HEX, SNIFF_FORMAT_JSON:
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	if filter == nil {
+		filter = &SnifferFilter{}
+	}
+	return &Sniffer{writer, format, filter, time.Now}, nil
+}
+
+// SetTimeFunc sets the function that is used to obtain
+// frame timestamps
+func (sniffer *Sniffer) SetTimeFunc(timeFunc func() time.Time) {
+	sniffer.timeFunc = timeFunc
+}
+
+// HandleFrame decodes the frame (without the sync bytes)
+// and writes it if it passes the filter
+func (sniffer *Sniffer) HandleFrame(frame []byte) error {
+	ts := sniffer.timeFunc()
+	msg, err := ParseFrame(frame)
+	if err != nil {
+		if sniffer.format == SNIFF_FORMAT_JSON {
+			// bad frames are not shown in JSON mode
+			wbgo.Warn.Printf("bad frame [%s]: %s", formatHexBytes(frame), err)
+			return nil
+		}
+		_, err = fmt.Fprintf(sniffer.writer, "%s <bad frame [%s]: %s>\n",
+			ts.Format(SNIFF_TIME_FORMAT), formatHexBytes(frame), err)
+		return err
+	}
+	if !sniffer.filter.Matches(&msg.Header) {
+		return nil
+	}
+
+	switch sniffer.format {
+	case SNIFF_FORMAT_HEX:
+		_, err = fmt.Fprintln(sniffer.writer, formatCapturedFrame(
+			&CapturedFrame{ts, CAPTURE_DIRECTION_IN, frame}))
+	case SNIFF_FORMAT_JSON:
+		var bs []byte
+		bs, err = json.Marshal(&sniffDocument{ts.UTC().Format(time.RFC3339Nano), *msg})
+		if err == nil {
+			_, err = fmt.Fprintf(sniffer.writer, "%s\n", bs)
+		}
+	default:
+		var text string
+		formatter := &MessageFormatter{func(format string, args ...interface{}) {
+			text = fmt.Sprintf(format, args...)
+		}}
+		wbgo.Visit(formatter, msg.Message, "On", &msg.Header)
+		_, err = fmt.Fprintf(sniffer.writer, "%s %s\n", ts.Format(SNIFF_TIME_FORMAT), text)
+	}
+	return err
+}
+
+// Run handles the frames until the channel is closed
+func (sniffer *Sniffer) Run(frames chan []byte) error {
+	for frame := range frames {
+		if err := sniffer.HandleFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
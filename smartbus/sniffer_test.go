@@ -0,0 +1,110 @@
+package smartbus
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSnifferFilter(t *testing.T) {
+	filter, err := ParseSnifferFilter("1:20, 2", "1:28-30", "0x139c,0x149", "SingleChannelControlCommand,0x0032")
+	if err != nil {
+		t.Fatalf("ParseSnifferFilter(): %s", err)
+	}
+	for _, item := range []struct {
+		header   MessageHeader
+		expected bool
+	}{
+		{MessageHeader{1, 20, 0x139c, 0x0031, 1, 28}, true},
+		{MessageHeader{2, 5, 0x149, 0x0032, 1, 30}, true},
+		{MessageHeader{1, 21, 0x139c, 0x0031, 1, 28}, false},
+		{MessageHeader{1, 20, 0x139c, 0x0031, 1, 31}, false},
+		{MessageHeader{1, 20, 0x0095, 0x0031, 1, 28}, false},
+		{MessageHeader{1, 20, 0x139c, 0x0033, 1, 28}, false},
+	} {
+		if filter.Matches(&item.header) != item.expected {
+			t.Errorf("bad match result for %#v (expected %v)", item.header, item.expected)
+		}
+	}
+
+	if !(&SnifferFilter{}).Matches(&MessageHeader{1, 20, 0x139c, 0x0031, 1, 28}) {
+		t.Errorf("empty filter must match everything")
+	}
+
+	for _, args := range [][4]string{
+		{"1:x", "", "", ""},
+		{"", "1:30-28", "", ""},
+		{"", "256", "", ""},
+		{"", "", "foo", ""},
+		{"", "", "", "NoSuchMessage"},
+	} {
+		if _, err := ParseSnifferFilter(args[0], args[1], args[2], args[3]); err == nil {
+			t.Errorf("no error for bad filter %q", args)
+		}
+	}
+}
+
+func TestSniffer(t *testing.T) {
+	frames := [][]byte{
+		{0x0f, 0x03, 0xfe, 0xff, 0xfe, 0x00, 0x31, 0x01, 0x1c, 0x02, 0x64, 0x00, 0x00, 0x2e, 0x6b},
+		{0x10, 0x01, 0x1c, 0x13, 0x9c, 0x00, 0x32, 0x03, 0xfe, 0x02, 0xf8, 0x64, 0x02, 0x02, 0x47, 0xc2},
+	}
+	ts := time.Date(2015, 1, 25, 9, 9, 20, 500000000, time.UTC)
+	filter := &SnifferFilter{Sources: []AddressRange{{1, 0x1c, 0x1c}}}
+	for _, item := range []struct {
+		format   string
+		filter   *SnifferFilter
+		expected string
+	}{
+		{
+			SNIFF_FORMAT_TEXT, nil,
+			ts.Local().Format(SNIFF_TIME_FORMAT) + " 03/fe (type fffe) -> 01/1c: <SingleChannelControlCommand 2/100/0>\n" +
+				ts.Local().Format(SNIFF_TIME_FORMAT) + " 01/1c (type 139c) -> 03/fe: <SingleChannelControlResponse 2/true/100/-x>\n",
+		},
+		{
+			SNIFF_FORMAT_HEX, filter,
+			"2015-01-25T09:09:20.5Z in 10 01 1c 13 9c 00 32 03 fe 02 f8 64 02 02 47 c2\n",
+		},
+		{
+			SNIFF_FORMAT_JSON, filter,
+			`{"time":"2015-01-25T09:09:20.5Z","message":{"opcode":50,"type":"SingleChannelControlResponse",` +
+				`"header":{"origSubnet":1,"origDevice":28,"origDeviceType":5020,"targetSubnet":3,"targetDevice":254},` +
+				`"fields":` +
+				`{"ChannelNo":2,"Success":true,"Level":100,"ChannelStatus":[false,true]}}}` + "\n",
+		},
+	} {
+		var buf bytes.Buffer
+		sniffer, err := NewSniffer(&buf, item.format, item.filter)
+		if err != nil {
+			t.Fatalf("NewSniffer(): %s", err)
+		}
+		sniffer.SetTimeFunc(func() time.Time { return ts.Local() })
+		ch := make(chan []byte, len(frames))
+		for _, frame := range frames {
+			ch <- frame
+		}
+		close(ch)
+		if err := sniffer.Run(ch); err != nil {
+			t.Fatalf("Run(): %s", err)
+		}
+		if buf.String() != item.expected {
+			t.Errorf("bad %s output:\n%s\n(expected:\n%s)", item.format, buf.String(), item.expected)
+		}
+	}
+
+	var buf bytes.Buffer
+	sniffer, _ := NewSniffer(&buf, SNIFF_FORMAT_TEXT, nil)
+	badFrame := append([]byte(nil), frames[0]...)
+	badFrame[len(badFrame)-1] = 0
+	if err := sniffer.HandleFrame(badFrame[:12]); err != nil {
+		t.Fatalf("HandleFrame(): %s", err)
+	}
+	if !strings.Contains(buf.String(), "<bad frame [") {
+		t.Errorf("bad frame not reported: %s", buf.String())
+	}
+
+	if _, err := NewSniffer(&buf, "foo", nil); err == nil {
+		t.Errorf("no error for unknown format")
+	}
+}
@@ -0,0 +1,133 @@
+package smartbus
+
+import (
+	"encoding/json"
+	"github.com/contactless/wbgo"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// DeviceState is the state of a device that's kept across
+// driver restarts. Channels and Temperatures are the numbers
+// of relay channels and temperature sensors discovered,
+// Buttons are DDP button assignments (see DDPDeviceModel).
+type DeviceState struct {
+	SubnetID     uint8  `json:"subnet"`
+	DeviceID     uint8  `json:"device"`
+	DeviceType   uint16 `json:"deviceType"`
+	Channels     int    `json:"channels,omitempty"`
+	Temperatures int    `json:"temperatures,omitempty"`
+	Buttons      []int  `json:"buttons,omitempty"`
+}
+
+// BusState is the contents of the state file
+type BusState struct {
+	Devices []DeviceState `json:"devices"`
+}
+
+// LoadBusState reads the state file. A missing file
+// is not an error, an empty state is returned instead.
+func LoadBusState(path string) (*BusState, error) {
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return &BusState{}, nil
+	case err != nil:
+		return nil, err
+	}
+	state := &BusState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// SaveBusState writes the state file. The file is replaced
+// atomically so that it's not corrupted if the driver is
+// killed while writing it.
+func SaveBusState(path string, state *BusState) error {
+	bs, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// restoreDevices recreates the devices listed in the state file.
+// The devices are considered unconfirmed, i.e. their controls
+// have the error meta set until they respond.
+func (model *SmartbusModel) restoreDevices() {
+	state, err := LoadBusState(model.config.StateFile)
+	if err != nil {
+		wbgo.Error.Printf("failed to load the state file: %s", err)
+		return
+	}
+	for i := range state.Devices {
+		devState := &state.Devices[i]
+		key := deviceKey(devState.SubnetID, devState.DeviceID)
+		if _, found := model.deviceMap[key]; found {
+			continue
+		}
+		dev := model.newDevice(devState.SubnetID, devState.DeviceID, devState.DeviceType)
+		if dev == nil {
+			continue
+		}
+		dev.markUnconfirmed()
+		model.Observer.OnNewDevice(dev)
+		dev.restoreState(devState)
+	}
+	model.savedState = state
+}
+
+// busState returns the current state of the devices
+func (model *SmartbusModel) busState() *BusState {
+	keys := make([]int, 0, len(model.deviceMap))
+	for key := range model.deviceMap {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+	state := &BusState{Devices: make([]DeviceState, 0, len(keys))}
+	for _, key := range keys {
+		dev := model.deviceMap[uint16(key)]
+		devState := DeviceState{
+			SubnetID:   uint8(key >> 8),
+			DeviceID:   uint8(key),
+			DeviceType: dev.Type(),
+		}
+		dev.saveState(&devState)
+		state.Devices = append(state.Devices, devState)
+	}
+	return state
+}
+
+// saveStateIfChanged writes the state file if the state
+// of the devices has changed since it was last written.
+// As only the device list, the numbers of channels and
+// sensors and the button assignments are kept, the file
+// is rarely rewritten even though it's checked on each poll.
+func (model *SmartbusModel) saveStateIfChanged() {
+	state := model.busState()
+	if model.savedState != nil && statesEqual(model.savedState, state) {
+		return
+	}
+	if err := SaveBusState(model.config.StateFile, state); err != nil {
+		wbgo.Error.Printf("failed to save the state file: %s", err)
+		return
+	}
+	model.savedState = state
+}
+
+func statesEqual(a, b *BusState) bool {
+	bsA, errA := json.Marshal(a)
+	bsB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(bsA) == string(bsB)
+}
@@ -0,0 +1,206 @@
+package smartbus
+
+import (
+	"github.com/contactless/wbgo"
+	"sync"
+	"time"
+)
+
+const (
+	RECONNECT_MIN_DELAY = 1 * time.Second
+	RECONNECT_MAX_DELAY = 60 * time.Second
+)
+
+// LinkStateFunc is invoked by ReconnectingIO when the
+// underlying connection goes down or is restored
+type LinkStateFunc func(connected bool)
+
+// ReconnectingIO is a SmartbusIO that establishes the actual
+// connection using the specified Connector and re-establishes it
+// with exponential backoff when the transport fails. The read
+// channel returned by Start() survives reconnections, so
+// SmartbusConnection and its endpoints stay attached.
+type ReconnectingIO struct {
+	sync.Mutex
+	connector   Connector
+	timerFunc   TimerFunc
+	onLinkState LinkStateFunc
+	minDelay    time.Duration
+	maxDelay    time.Duration
+	current     SmartbusIO
+	connected   bool
+	stopped     bool
+	readCh      chan *SmartbusMessage
+	quit        chan struct{}
+}
+
+func NewReconnectingIO(connector Connector, timerFunc TimerFunc, onLinkState LinkStateFunc) *ReconnectingIO {
+	if timerFunc == nil {
+		timerFunc = func(d time.Duration) wbgo.Timer {
+			return wbgo.NewRealTimer(d)
+		}
+	}
+	return &ReconnectingIO{
+		connector:   connector,
+		timerFunc:   timerFunc,
+		onLinkState: onLinkState,
+		minDelay:    RECONNECT_MIN_DELAY,
+		maxDelay:    RECONNECT_MAX_DELAY,
+		readCh:      make(chan *SmartbusMessage),
+		quit:        make(chan struct{}),
+	}
+}
+
+// SetBackoff sets minimum and maximum delay between
+// reconnection attempts. Must be called before Start().
+func (rio *ReconnectingIO) SetBackoff(minDelay, maxDelay time.Duration) {
+	rio.minDelay = minDelay
+	rio.maxDelay = maxDelay
+}
+
+// Start makes the first connection attempt synchronously
+// so that IsConnected() reflects its result right away.
+func (rio *ReconnectingIO) Start() chan *SmartbusMessage {
+	innerCh := rio.tryConnect()
+	rio.Lock()
+	rio.connected = innerCh != nil
+	rio.Unlock()
+	go rio.run(innerCh)
+	return rio.readCh
+}
+
+func (rio *ReconnectingIO) IsConnected() bool {
+	rio.Lock()
+	defer rio.Unlock()
+	return rio.connected
+}
+
+func (rio *ReconnectingIO) tryConnect() chan *SmartbusMessage {
+	smartbusIO, err := rio.connector()
+	if err != nil {
+		wbgo.Error.Printf("failed to connect to Smart-Bus: %s", err)
+		return nil
+	}
+	innerCh := smartbusIO.Start()
+	rio.Lock()
+	defer rio.Unlock()
+	if rio.stopped {
+		smartbusIO.Stop()
+		return nil
+	}
+	rio.current = smartbusIO
+	return innerCh
+}
+
+func (rio *ReconnectingIO) isStopped() bool {
+	rio.Lock()
+	defer rio.Unlock()
+	return rio.stopped
+}
+
+func (rio *ReconnectingIO) setConnected(connected bool) {
+	rio.Lock()
+	changed := rio.connected != connected
+	rio.connected = connected
+	rio.Unlock()
+	if changed && rio.onLinkState != nil {
+		rio.onLinkState(connected)
+	}
+}
+
+func (rio *ReconnectingIO) disconnect() {
+	rio.Lock()
+	smartbusIO := rio.current
+	rio.current = nil
+	rio.Unlock()
+	if smartbusIO != nil {
+		smartbusIO.Stop()
+	}
+}
+
+// forward passes the messages from the underlying connection
+// to the outer read channel. It returns false if the
+// ReconnectingIO was stopped and true if the connection
+// was lost
+func (rio *ReconnectingIO) forward(innerCh chan *SmartbusMessage) bool {
+	for {
+		select {
+		case <-rio.quit:
+			return false
+		case msg, ok := <-innerCh:
+			if !ok {
+				return true
+			}
+			select {
+			case rio.readCh <- msg:
+			case <-rio.quit:
+				return false
+			}
+		}
+	}
+}
+
+func (rio *ReconnectingIO) wait(d time.Duration) bool {
+	timer := rio.timerFunc(d)
+	select {
+	case <-rio.quit:
+		timer.Stop()
+		return false
+	case <-timer.GetChannel():
+		return true
+	}
+}
+
+func (rio *ReconnectingIO) run(innerCh chan *SmartbusMessage) {
+	defer close(rio.readCh)
+	delay := rio.minDelay
+	for {
+		if innerCh != nil {
+			rio.setConnected(true)
+			delay = rio.minDelay
+			if !rio.forward(innerCh) || rio.isStopped() {
+				return
+			}
+			wbgo.Warn.Printf("Smart-Bus connection lost, reconnecting")
+			rio.disconnect()
+			rio.setConnected(false)
+		}
+		if !rio.wait(delay) {
+			return
+		}
+		if delay *= 2; delay > rio.maxDelay {
+			delay = rio.maxDelay
+		}
+		innerCh = rio.tryConnect()
+	}
+}
+
+// Send passes the message to the current connection. The lock
+// is not held while sending so that a stalled write doesn't
+// block the disconnection and IsConnected() calls.
+func (rio *ReconnectingIO) Send(msg SmartbusMessage) {
+	rio.Lock()
+	smartbusIO := rio.current
+	rio.Unlock()
+	if smartbusIO == nil {
+		wbgo.Warn.Printf("Smart-Bus connection is down, dropping outgoing message")
+		return
+	}
+	smartbusIO.Send(msg)
+}
+
+func (rio *ReconnectingIO) Stop() {
+	rio.Lock()
+	if rio.stopped {
+		rio.Unlock()
+		return
+	}
+	rio.stopped = true
+	close(rio.quit)
+	smartbusIO := rio.current
+	rio.current = nil
+	rio.Unlock()
+	if smartbusIO != nil {
+		smartbusIO.Stop()
+	}
+}
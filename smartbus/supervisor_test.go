@@ -0,0 +1,132 @@
+package smartbus
+
+import (
+	"errors"
+	"fmt"
+	"github.com/contactless/wbgo/testutils"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnectingIO(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	rec := testutils.NewRecorder(t)
+	timers := testutils.NewFakeTimerFixture(t, rec)
+	remotes := make(chan net.Conn, 1)
+	failConnect := false
+	connector := func() (SmartbusIO, error) {
+		if failConnect {
+			failConnect = false
+			rec.Rec("connect failed")
+			return nil, errors.New("connection refused")
+		}
+		rec.Rec("connect")
+		p, r := net.Pipe()
+		remotes <- r
+		return NewStreamIO(p, nil), nil
+	}
+	rio := NewReconnectingIO(connector, timers.NewFakeTimer, func(connected bool) {
+		rec.Rec("connected: %v", connected)
+	})
+
+	relayHandler := NewFakeHandler(t)
+	conn := NewSmartbusConnection(rio)
+	relayEp := conn.MakeSmartbusEndpoint(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID, SAMPLE_RELAY_DEVICE_TYPE)
+	relayEp.Observe(relayHandler)
+	relayToDDPDev := relayEp.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID)
+	rec.Verify("connect")
+	if !rio.IsConnected() {
+		t.Fatalf("ReconnectingIO not connected after Start()")
+	}
+
+	ddpHandler := NewFakeHandler(t)
+	connectRemote := func() *SmartbusConnection {
+		remoteConn := NewSmartbusConnection(NewStreamIO(<-remotes, nil))
+		ddpEp := remoteConn.MakeSmartbusEndpoint(SAMPLE_SUBNET, SAMPLE_DDP_DEVICE_ID, SAMPLE_DDP_DEVICE_TYPE)
+		ddpEp.Observe(ddpHandler)
+		ddpEp.GetSmartbusDevice(SAMPLE_SUBNET, SAMPLE_RELAY_DEVICE_ID).SingleChannelControl(7, LIGHT_LEVEL_ON, 0)
+		relayHandler.Verify("01/14 (type 0095) -> 01/1c: <SingleChannelControlCommand 7/100/0>")
+		relayToDDPDev.ReadTemperatureValues(true)
+		ddpHandler.Verify("01/1c (type 139c) -> 01/14: <ReadTemperatureValues Celsius>")
+		return remoteConn
+	}
+
+	remoteConn := connectRemote()
+	// the converter goes away
+	failConnect = true
+	remoteConn.Close()
+	rec.Verify("connected: false", fmt.Sprintf("new fake timer: 1, %d", RECONNECT_MIN_DELAY/time.Millisecond))
+	testutils.EnsureGotWarnings(t)
+	if rio.IsConnected() {
+		t.Fatalf("ReconnectingIO still connected after connection loss")
+	}
+
+	// the delay is doubled after failed attempt
+	timers.FireTimer(1, timers.AdvanceTime(RECONNECT_MIN_DELAY))
+	rec.Verify("timer.fire(): 1", "connect failed",
+		fmt.Sprintf("new fake timer: 2, %d", 2*RECONNECT_MIN_DELAY/time.Millisecond))
+	testutils.EnsureGotErrors(t)
+
+	timers.FireTimer(2, timers.AdvanceTime(2*RECONNECT_MIN_DELAY))
+	rec.Verify("timer.fire(): 2", "connect", "connected: true")
+
+	// the endpoint is still attached after reconnection
+	remoteConn = connectRemote()
+
+	conn.Close()
+	remoteConn.Close()
+	rec.VerifyEmpty()
+}
+
+func TestReconnectingIOStalledWrite(t *testing.T) {
+	testutils.SetupTestLogging(t)
+	defer testutils.EnsureNoErrorsOrWarnings(t)
+
+	// nobody reads from the remote end of the pipe,
+	// so the writes stall
+	p, r := net.Pipe()
+	defer r.Close()
+	rio := NewReconnectingIO(func() (SmartbusIO, error) {
+		return NewStreamIO(p, nil), nil
+	}, nil, nil)
+	rio.Start()
+	msg := SmartbusMessage{
+		Header: MessageHeader{
+			OrigSubnetID:   SAMPLE_SUBNET,
+			OrigDeviceID:   SAMPLE_DDP_DEVICE_ID,
+			OrigDeviceType: SAMPLE_DDP_DEVICE_TYPE,
+			TargetSubnetID: SAMPLE_SUBNET,
+			TargetDeviceID: SAMPLE_RELAY_DEVICE_ID,
+		},
+		Message: &SingleChannelControlCommand{7, LIGHT_LEVEL_ON, 0},
+	}
+	sent := make(chan struct{})
+	go func() {
+		// the first message stalls in the writer,
+		// the second one blocks in Send()
+		rio.Send(msg)
+		rio.Send(msg)
+		close(sent)
+	}()
+
+	// let the writes stall
+	time.Sleep(100 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		if !rio.IsConnected() {
+			t.Errorf("ReconnectingIO not connected")
+		}
+		rio.Stop()
+		close(stopped)
+	}()
+	for _, ch := range []chan struct{}{stopped, sent} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ReconnectingIO blocked by a stalled write")
+		}
+	}
+}
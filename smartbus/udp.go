@@ -26,6 +26,7 @@ type DatagramIO struct {
 	readCh            chan *SmartbusMessage
 	writeCh           chan interface{}
 	rawReadCh         chan []byte
+	tap               FrameTap
 }
 
 func allBroadcast(b []byte) bool {
@@ -69,6 +70,9 @@ func (dgramIO *DatagramIO) processUdpPacket(packet []byte) {
 		wbgo.Error.Println("invalid udp packet:", hex.Dump(packet))
 		return
 	}
+	if dgramIO.tap != nil {
+		dgramIO.tap(CAPTURE_DIRECTION_IN, packet[len(udpSignature)+4:])
+	}
 	if dgramIO.rawReadCh != nil {
 		dgramIO.rawReadCh <- packet[len(udpSignature)+4:]
 		return
@@ -96,6 +100,15 @@ func (dgramIO *DatagramIO) doSend(msg interface{}) {
 	if _, err := dgramIO.conn.WriteToUDP(buf.Bytes(), &dgramIO.smartbusGwAddress); err != nil {
 		wbgo.Error.Printf("UDP SEND ERROR: %s", err)
 	}
+	if dgramIO.tap != nil {
+		dgramIO.tap(CAPTURE_DIRECTION_OUT, buf.Bytes()[len(udpSignature)+4:])
+	}
+}
+
+// SetFrameTap makes the DatagramIO pass all the raw
+// frames to the specified tap. Must be called before Start().
+func (dgramIO *DatagramIO) SetFrameTap(tap FrameTap) {
+	dgramIO.tap = tap
 }
 
 func (dgramIO *DatagramIO) Start() chan *SmartbusMessage {
@@ -103,6 +116,9 @@ func (dgramIO *DatagramIO) Start() chan *SmartbusMessage {
 		var err error
 		defer func() {
 			close(dgramIO.readCh)
+			if dgramIO.rawReadCh != nil {
+				close(dgramIO.rawReadCh)
+			}
 			// FIXME: check err values when closing the socket from Stop()
 			switch {
 			case err == io.EOF || err == io.ErrUnexpectedEOF:
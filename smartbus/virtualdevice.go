@@ -0,0 +1,158 @@
+package smartbus
+
+import (
+	"fmt"
+)
+
+// relayEmulator answers the standard queries addressed to an
+// endpoint of the driver as a relay module with the virtual
+// relays would, so the driver is visible to the panels and to
+// the vendor configuration software. The replies are sent to
+// the device that has sent the query. The messages sent by the
+// driver itself are ignored, as the UDP transport receives the
+// driver's own broadcasts.
+type relayEmulator struct {
+	model  *SmartbusModel
+	ep     *SmartbusEndpoint
+	remark []uint8
+	relays *VirtualRelayDevice
+}
+
+// virtualDeviceMAC returns the MAC address reported by the
+// driver and the virtual devices. Like the MACs of the real
+// devices, it ends with the device address.
+func virtualDeviceMAC(subnetID uint8, deviceID uint8) [8]uint8 {
+	return [8]uint8{0x53, 0x03, 0x00, 0x00, 0x00, 0x00, subnetID, deviceID}
+}
+
+// isOwnMessage returns true if the message is sent by the
+// driver or one of its virtual devices
+func (em *relayEmulator) isOwnMessage(header *MessageHeader) bool {
+	model := em.model
+	if header.OrigSubnetID == model.subnetID && header.OrigDeviceID == model.deviceID {
+		return true
+	}
+	for _, vdev := range model.virtualDevs {
+		if header.OrigSubnetID == vdev.subnetID && header.OrigDeviceID == vdev.deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+func (em *relayEmulator) reply(header *MessageHeader) *SmartbusDevice {
+	return em.ep.GetSmartbusDevice(header.OrigSubnetID, header.OrigDeviceID)
+}
+
+func (em *relayEmulator) OnReadMACAddress(msg *ReadMACAddress, header *MessageHeader) {
+	if em.isOwnMessage(header) {
+		return
+	}
+	em.reply(header).ReadMACAddressResponse(virtualDeviceMAC(em.ep.SubnetID, em.ep.DeviceID), em.remark)
+}
+
+func (em *relayEmulator) OnQueryChannelStatuses(msg *QueryChannelStatuses, header *MessageHeader) {
+	if em.isOwnMessage(header) {
+		return
+	}
+	em.model.Observer.CallSync(func() {
+		status := em.relays.RelayStatus()
+		levels := make([]uint8, len(status))
+		for i, on := range status {
+			if on {
+				levels[i] = LIGHT_LEVEL_ON
+			}
+		}
+		em.reply(header).QueryChannelStatusesResponse(levels)
+	})
+}
+
+func (em *relayEmulator) OnQueryModules(msg *QueryModules, header *MessageHeader) {
+	if em.isOwnMessage(header) {
+		return
+	}
+	em.reply(header).QueryModulesResponse(QUERY_MODULES_DEV_RELAY, uint8(em.relays.RelayCount()))
+}
+
+// announce broadcasts the status of the relay that was switched
+// via MQTT, like a relay module does after switching a channel,
+// so the panels can update their button LEDs
+func (em *relayEmulator) announce(channelNo int) {
+	level := uint8(LIGHT_LEVEL_OFF)
+	if em.relays.RelayStatus()[channelNo-1] {
+		level = LIGHT_LEVEL_ON
+	}
+	em.ep.GetBroadcastDevice().SingleChannelControlResponse(
+		uint8(channelNo), true, level, em.relays.RelayStatus())
+}
+
+// VirtualDevice is a relay module emulated by the driver at its
+// own bus address. Besides answering the standard queries, it
+// switches its relays upon SingleChannelControlCommand, so the
+// panels can use it like a real relay module. The relays are
+// published as a separate MQTT device.
+type VirtualDevice struct {
+	relayEmulator
+	subnetID   uint8
+	deviceID   uint8
+	deviceType uint16
+}
+
+func newVirtualDevice(model *SmartbusModel, config *VirtualDeviceConfig) *VirtualDevice {
+	vdev := &VirtualDevice{
+		relayEmulator: relayEmulator{
+			model:  model,
+			remark: []uint8(config.Remark),
+			relays: NewVirtualRelayDevice(config.Channels),
+		},
+		subnetID:   config.SubnetID,
+		deviceID:   config.DeviceID,
+		deviceType: config.DeviceType,
+	}
+	if vdev.deviceType == 0 {
+		vdev.deviceType = model.deviceType
+	}
+	vdev.relays.DevName = fmt.Sprintf("sbusvrelay%d_%d", config.SubnetID, config.DeviceID)
+	if config.Name != "" {
+		vdev.relays.DevName = config.Name
+	}
+	vdev.relays.DevName = model.qualifiedName(vdev.relays.DevName)
+	vdev.relays.DevTitle = fmt.Sprintf("Smartbus Virtual Relays %d:%d", config.SubnetID, config.DeviceID)
+	if config.Title != "" {
+		vdev.relays.DevTitle = config.Title
+	}
+	vdev.relays.DevTitle = model.qualifiedTitle(vdev.relays.DevTitle)
+	return vdev
+}
+
+// attach creates the endpoint of the device. The incoming
+// traffic is already counted, mirrored and dumped by the
+// driver's own endpoint, so only the received messages are
+// dumped and the sent ones are passed to the diagnostics here.
+func (vdev *VirtualDevice) attach(conn *SmartbusConnection) {
+	vdev.ep = conn.MakeSmartbusEndpoint(vdev.subnetID, vdev.deviceID, vdev.deviceType)
+	if vdev.model.stats != nil {
+		vdev.model.stats.AttachOutput(vdev.ep)
+	}
+	vdev.ep.Observe(vdev)
+	vdev.ep.Observe(NewMessageDumper("MESSAGE FOR US"))
+	vdev.ep.AddOutputSniffer(NewMessageDumper("OUTGOING"))
+	if vdev.model.mirror != nil {
+		vdev.model.mirror.AttachOutput(vdev.ep)
+	}
+	vdev.relays.onChange = vdev.announce
+}
+
+func (vdev *VirtualDevice) OnSingleChannelControlCommand(msg *SingleChannelControlCommand, header *MessageHeader) {
+	if vdev.isOwnMessage(header) {
+		return
+	}
+	vdev.model.Observer.CallSync(func() {
+		success := msg.ChannelNo >= 1 && int(msg.ChannelNo) <= vdev.relays.RelayCount()
+		if success {
+			vdev.relays.SetRelayOn(int(msg.ChannelNo), msg.Level > 0)
+		}
+		vdev.reply(header).SingleChannelControlResponse(msg.ChannelNo, success, msg.Level,
+			vdev.relays.RelayStatus())
+	})
+}
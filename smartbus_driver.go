@@ -1,23 +1,194 @@
 package main
 
 import (
-	"github.com/contactless/wb-mqtt-smartbus/smartbus"
 	"flag"
+	"fmt"
+	"github.com/contactless/wb-mqtt-smartbus/smartbus"
 	"github.com/contactless/wbgo"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
+// loadConfig loads the config file, if specified, and applies
+// -serial, -gw, -capture and -capture-format options set
+// on the command line
+func loadConfig(flags *flag.FlagSet, configPath, serial string, gw bool,
+	capture, captureFormat string) *smartbus.DriverConfig {
+	config := smartbus.NewDriverConfig()
+	if configPath != "" {
+		var err error
+		if config, err = smartbus.LoadConfig(configPath); err != nil {
+			wbgo.Error.Printf("failed to load config: %s", err)
+			os.Exit(1)
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "serial", "gw", "capture", "capture-format":
+		default:
+			return
+		}
+		if len(config.Buses) > 0 {
+			wbgo.Error.Printf("-%s cannot be used when buses are specified in the config", f.Name)
+			os.Exit(1)
+		}
+		switch f.Name {
+		case "serial":
+			config.Transport.Address = serial
+		case "gw":
+			config.Transport.Gateway = gw
+		case "capture":
+			config.Transport.Capture = capture
+		case "capture-format":
+			config.Transport.CaptureFormat = captureFormat
+		}
+	})
+	return config
+}
+
+func scan(args []string) {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	configPath := flags.String("config", "", "config file path")
+	serial := flags.String("serial", smartbus.DEFAULT_SERIAL_ADDRESS, "serial port address (/dev/... or host:port), overrides the config")
+	busName := flags.String("bus", "", "name of the bus to scan when several buses are configured")
+	subnet := flags.Int("subnet", -1, "subnet to scan (defaults to the scan addresses from the config or the driver's own subnet)")
+	from := flags.Int("from", 1, "first device id to scan")
+	to := flags.Int("to", 254, "last device id to scan")
+	timeout := flags.Int("timeout", 0, "probe timeout in milliseconds, overrides the config")
+	output := flags.String("o", "", "output file (defaults to stdout)")
+	format := flags.String("format", "", "inventory format, json or csv (defaults to the output file extension)")
+	debug := flags.Bool("debug", false, "Enable debugging")
+	flags.Parse(args)
+	if *debug {
+		wbgo.SetDebuggingEnabled(true)
+	}
+
+	config := loadConfig(flags, *configPath, *serial, false, "", "")
+	if err := config.Validate(); err != nil {
+		wbgo.Error.Printf("%s", err)
+		os.Exit(1)
+	}
+	var bus *smartbus.BusConfig
+	for _, b := range config.BusConfigs() {
+		if *busName == "" || b.Name == *busName {
+			bus = b
+			break
+		}
+	}
+	switch {
+	case bus == nil:
+		wbgo.Error.Printf("bus not found: %s", *busName)
+		os.Exit(1)
+	case *busName == "" && len(config.Buses) > 1:
+		wbgo.Error.Printf("-bus must be specified when there's more than one bus")
+		os.Exit(1)
+	}
+	if *timeout > 0 {
+		bus.Scan.Timeout = *timeout
+	}
+
+	var ranges []smartbus.AddressRange
+	if *subnet >= 0 {
+		if *subnet > 254 || *from < 0 || *to > 254 || *from > *to {
+			wbgo.Error.Printf("bad address range %d:%d-%d", *subnet, *from, *to)
+			os.Exit(1)
+		}
+		ranges = []smartbus.AddressRange{{uint8(*subnet), uint8(*from), uint8(*to)}}
+	}
+
+	if *format == "" {
+		*format = "json"
+		if strings.ToLower(filepath.Ext(*output)) == ".csv" {
+			*format = "csv"
+		}
+	}
+	if *format != "json" && *format != "csv" {
+		wbgo.Error.Printf("bad format: %s", *format)
+		os.Exit(1)
+	}
+
+	entries, err := smartbus.ScanBus(bus, ranges)
+	if err != nil {
+		wbgo.Error.Printf("scan failed: %s", err)
+		os.Exit(1)
+	}
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			wbgo.Error.Printf("%s", err)
+			os.Exit(1)
+		}
+		defer out.Close()
+	}
+	if err := smartbus.WriteInventory(out, entries, *format); err != nil {
+		wbgo.Error.Printf("failed to write the inventory: %s", err)
+		os.Exit(1)
+	}
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "%d device(s) found\n", len(entries))
+	}
+}
+
+// convertToPcap converts the text capture to pcap format
+func convertToPcap(args []string) {
+	flags := flag.NewFlagSet("pcap", flag.ExitOnError)
+	udp := flags.Bool("udp", false, "encapsulate the frames in SMARTCLOUD UDP packets")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s pcap [-udp] capture-file pcap-file\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		wbgo.Error.Printf("%s", err)
+		os.Exit(1)
+	}
+	defer in.Close()
+	out, err := os.Create(flags.Arg(1))
+	if err != nil {
+		wbgo.Error.Printf("%s", err)
+		os.Exit(1)
+	}
+	if err := smartbus.ConvertCapture(in, out, *udp); err != nil {
+		wbgo.Error.Printf("%s: %s", flags.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
 func main() {
-	serial := flag.String("serial", "/dev/ttyNSC1", "serial port address (/dev/... or host:port)")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "scan":
+			scan(os.Args[2:])
+			return
+		case "pcap":
+			convertToPcap(os.Args[2:])
+			return
+		}
+	}
+
+	configPath := flag.String("config", "", "config file path")
+	serial := flag.String("serial", smartbus.DEFAULT_SERIAL_ADDRESS, "serial port address (/dev/..., host:port or replay:capture-file), overrides the config")
+	capture := flag.String("capture", "", "capture file to record the bus traffic to, overrides the config")
+	captureFormat := flag.String("capture-format", smartbus.CAPTURE_FORMAT_TEXT, "capture file format (text, pcap or pcap-udp), overrides the config")
 	broker := flag.String("broker", "tcp://localhost:1883", "MQTT broker url")
-	gw := flag.Bool("gw", false, "Provide UDP gateway")
+	gw := flag.Bool("gw", false, "Provide UDP gateway, overrides the config")
 	debug := flag.Bool("debug", false, "Enable debugging")
 	flag.Parse()
 	if *debug {
 		wbgo.SetDebuggingEnabled(true)
 	}
-	if driver, err := smartbus.NewSmartbusTCPDriver(*serial, *broker, *gw); err != nil {
-		panic(err)
+
+	config := loadConfig(flag.CommandLine, *configPath, *serial, *gw, *capture, *captureFormat)
+	if driver, err := smartbus.NewSmartbusDriver(config, *broker); err != nil {
+		wbgo.Error.Printf("failed to create the driver: %s", err)
+		os.Exit(1)
 	} else {
 		if err := driver.Start(); err != nil {
 			panic(err)